@@ -0,0 +1,66 @@
+package main
+
+import (
+	"aibird/image/comfyui"
+	"aibird/logger"
+	"fmt"
+	"os"
+)
+
+const usage = `usage: aibird [command]
+
+Run without a command to start the bot.
+
+Commands:
+  workflows validate [dir]   check every workflow's aibird_meta against its graph or pipeline, dir defaults to comfyuijson
+`
+
+// runCommand runs a command line subcommand and returns the exit code
+func runCommand(args []string) int {
+	switch {
+	case len(args) >= 2 && args[0] == "workflows" && args[1] == "validate" && len(args) <= 3:
+		dir := comfyui.WorkflowDir
+		if len(args) == 3 {
+			dir = args[2]
+		}
+		return validateWorkflows(dir)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+}
+
+// validateWorkflows prints the problems with every workflow in dir, failing if there are any
+func validateWorkflows(dir string) int {
+	// Problems are printed below, the registry only needs to speak up when something is badly wrong
+	logger.Init(logger.Config{Level: logger.LevelError, Format: "text"})
+
+	snapshot := comfyui.NewRegistry(dir).Snapshot()
+	names := snapshot.Names()
+	if len(names) == 0 {
+		fmt.Fprintf(os.Stderr, "No workflows found in %s\n", dir)
+		return 1
+	}
+
+	failed := 0
+	for _, name := range names {
+		workflow, _ := snapshot.Get(name)
+		problems := workflow.Validate(snapshot)
+		if len(problems) == 0 {
+			fmt.Printf("ok    %s\n", name)
+			continue
+		}
+
+		failed++
+		fmt.Printf("FAIL  %s\n", name)
+		for _, problem := range problems {
+			fmt.Printf("      %s\n", problem)
+		}
+	}
+
+	fmt.Printf("%d of %d workflows failed validation\n", failed, len(names))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
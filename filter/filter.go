@@ -0,0 +1,279 @@
+// Package filter checks prompts against policies of ordered block, allow and replace rules, loaded
+// from TOML files and compiled once.
+package filter
+
+import (
+	"aibird/logger"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/BurntSushi/toml"
+)
+
+// DefaultDir is where policy files are kept, relative to the working directory
+const DefaultDir = "filters"
+
+// DefaultPolicy is used where no network, channel or workflow names one
+const DefaultPolicy = "default"
+
+// NoPolicy has no rules of its own, only comfyui.badWords
+const NoPolicy = "none"
+
+//go:embed default.toml
+var builtinDefault []byte
+
+// Action is what a rule does when it matches
+type Action string
+
+const (
+	Block   Action = "block"   // refuse the prompt, or replace all of it when the rule has a replacement
+	Allow   Action = "allow"   // accept the prompt as it is so far, no later rule is applied
+	Replace Action = "replace" // replace every match and carry on with the next rule
+)
+
+// Mode is whether a policy changes prompts or only logs what it would do
+type Mode string
+
+const (
+	Enforce Mode = "enforce"
+	Audit   Mode = "audit"
+)
+
+// ruleFile is a policy as written in <dir>/<policy>.toml
+type ruleFile struct {
+	Description string `toml:"description"`
+	Mode        Mode   `toml:"mode"`
+	Rules       []struct {
+		Name          string   `toml:"name"`
+		Action        Action   `toml:"action"`
+		Phrases       []string `toml:"phrases"` // matched anywhere, as written
+		Pattern       string   `toml:"pattern"` // a regular expression
+		Replacement   string   `toml:"replacement"`
+		CaseSensitive bool     `toml:"caseSensitive"`
+	} `toml:"rules"`
+}
+
+// Rule is a compiled rule of a policy
+type Rule struct {
+	Name        string
+	Action      Action
+	Replacement string
+	re          *regexp.Regexp
+}
+
+// Policy is an ordered list of rules, applied to a prompt from the first to the last
+type Policy struct {
+	Name        string
+	Description string
+	Mode        Mode
+	Rules       []Rule
+}
+
+// Hit is a rule that matched a prompt, and the first text it matched
+type Hit struct {
+	Rule   string
+	Action Action
+	Match  string
+}
+
+// Result is a prompt after a policy was applied to it
+type Result struct {
+	Policy  string
+	Prompt  string
+	Blocked bool  // the prompt must not be used at all
+	Hits    []Hit // the rules that fired, in order
+	Audit   bool  // the policy only logged its hits, Prompt is unchanged
+}
+
+var policies atomic.Pointer[map[string]*Policy]
+
+// Load compiles the built-in default policy and every policy file in dir, a file named default.toml
+// replacing the built-in one. Bad words, if any, go before the rules of every policy and replace the
+// whole prompt with badWordsPrompt. Files that fail to load are logged and left out.
+func Load(dir string, badWords []string, badWordsPrompt string) error {
+	loaded := map[string]*Policy{NoPolicy: {Name: NoPolicy, Mode: Enforce}}
+
+	policy, err := compile(DefaultPolicy, builtinDefault)
+	if err != nil {
+		return fmt.Errorf("built-in default policy: %w", err)
+	}
+	loaded[DefaultPolicy] = policy
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.toml"))
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".toml")
+		data, err := os.ReadFile(file)
+		if err == nil {
+			policy, err = compile(name, data)
+		}
+		if err != nil {
+			logger.Error("Failed to load filter policy", "file", file, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
+			continue
+		}
+		loaded[name] = policy
+	}
+
+	if len(badWords) > 0 {
+		rule := Rule{Name: "comfyui.badWords", Action: Block, Replacement: badWordsPrompt, re: phrasesRegexp(badWords, false)}
+		for _, policy := range loaded {
+			policy.Rules = append([]Rule{rule}, policy.Rules...)
+		}
+	}
+
+	policies.Store(&loaded)
+	logger.Info("Loaded filter policies", "dir", dir, "policies", len(loaded))
+	return errors.Join(errs...)
+}
+
+func compile(name string, data []byte) (*Policy, error) {
+	var file ruleFile
+	if _, err := toml.Decode(string(data), &file); err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{Name: name, Description: file.Description, Mode: file.Mode}
+	switch policy.Mode {
+	case "":
+		policy.Mode = Enforce
+	case Enforce, Audit:
+	default:
+		return nil, fmt.Errorf("unknown mode %q, use enforce or audit", file.Mode)
+	}
+
+	for i, r := range file.Rules {
+		rule := Rule{Name: r.Name, Action: r.Action, Replacement: r.Replacement}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rules[%d]", i)
+		}
+		switch rule.Action {
+		case Block, Allow, Replace:
+		default:
+			return nil, fmt.Errorf("rule %s: unknown action %q, use block, allow or replace", rule.Name, r.Action)
+		}
+
+		switch {
+		case r.Pattern != "" && len(r.Phrases) > 0:
+			return nil, fmt.Errorf("rule %s: has both a pattern and phrases", rule.Name)
+		case r.Pattern != "":
+			pattern := r.Pattern
+			if !r.CaseSensitive {
+				pattern = "(?i)" + pattern
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			rule.re = re
+		case len(r.Phrases) > 0:
+			rule.re = phrasesRegexp(r.Phrases, r.CaseSensitive)
+		default:
+			return nil, fmt.Errorf("rule %s: needs a pattern or phrases", rule.Name)
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, nil
+}
+
+// phrasesRegexp matches any of the phrases as written
+func phrasesRegexp(phrases []string, caseSensitive bool) *regexp.Regexp {
+	quoted := make([]string, len(phrases))
+	for i, phrase := range phrases {
+		quoted[i] = regexp.QuoteMeta(phrase)
+	}
+	pattern := strings.Join(quoted, "|")
+	if !caseSensitive {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.MustCompile(pattern)
+}
+
+// Get returns a loaded policy by name
+func Get(name string) (*Policy, bool) {
+	loaded := policies.Load()
+	if loaded == nil {
+		if err := Load(DefaultDir, nil, ""); err != nil {
+			logger.Error("Failed to load filter policies", "error", err)
+		}
+		loaded = policies.Load()
+	}
+	policy, ok := (*loaded)[name]
+	return policy, ok
+}
+
+// Names returns the names of the loaded policies, sorted
+func Names() []string {
+	Get(DefaultPolicy) // loads the policies on first use
+	loaded := *policies.Load()
+	names := make([]string, 0, len(loaded))
+	for name := range loaded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check applies the named policy to a prompt. An unknown policy falls back to the default one, so a
+// typo in a setting can't turn filtering off.
+func Check(name, prompt string) Result {
+	policy, ok := Get(name)
+	if !ok {
+		logger.Warn("Unknown filter policy, using the default", "policy", name)
+		policy, _ = Get(DefaultPolicy)
+	}
+	return policy.Apply(prompt)
+}
+
+// Apply runs the rules over the prompt in order. In audit mode the hits are logged and the prompt
+// is returned as it was given.
+func (p *Policy) Apply(prompt string) Result {
+	original := strings.TrimSpace(prompt)
+	result := Result{Policy: p.Name, Prompt: original, Audit: p.Mode == Audit}
+
+rules:
+	for _, rule := range p.Rules {
+		loc := rule.re.FindStringIndex(result.Prompt)
+		if loc == nil {
+			continue
+		}
+		result.Hits = append(result.Hits, Hit{Rule: rule.Name, Action: rule.Action, Match: result.Prompt[loc[0]:loc[1]]})
+
+		switch rule.Action {
+		case Block:
+			if rule.Replacement != "" {
+				result.Prompt = rule.Replacement
+			} else {
+				result.Prompt, result.Blocked = "", true
+			}
+			break rules
+		case Allow:
+			break rules
+		case Replace:
+			result.Prompt = rule.re.ReplaceAllString(result.Prompt, rule.Replacement)
+		}
+	}
+	result.Prompt = strings.Join(strings.Fields(result.Prompt), " ")
+
+	for _, hit := range result.Hits {
+		if result.Audit {
+			logger.Info("Filter rule would fire", "policy", p.Name, "rule", hit.Rule, "action", hit.Action, "match", hit.Match)
+		} else {
+			logger.Debug("Filter rule fired", "policy", p.Name, "rule", hit.Rule, "action", hit.Action, "match", hit.Match)
+		}
+	}
+	if result.Audit {
+		result.Prompt, result.Blocked = strings.Join(strings.Fields(original), " "), false
+	}
+	return result
+}
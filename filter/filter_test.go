@@ -0,0 +1,140 @@
+package filter
+
+import (
+	"aibird/logger"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init(logger.Config{Level: logger.LevelError, Format: "text"})
+	os.Exit(m.Run())
+}
+
+// testRules replace cat with dog, let a good dog through, block any other dog and replace bird with
+// fish, in that order
+const testRules = `
+[[rules]]
+name = "cats"
+action = "replace"
+phrases = ["cat"]
+replacement = "dog"
+
+[[rules]]
+name = "good dogs"
+action = "allow"
+phrases = ["good dog"]
+
+[[rules]]
+name = "dogs"
+action = "block"
+phrases = ["dog"]
+
+[[rules]]
+name = "sunsets"
+action = "block"
+pattern = '\bnight\b'
+replacement = "a sunset"
+
+[[rules]]
+name = "birds"
+action = "replace"
+phrases = ["bird"]
+replacement = "fish"
+`
+
+func TestDefaultPolicy(t *testing.T) {
+	if err := Load(t.TempDir(), nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prompt  string
+		want    string
+		blocked bool
+	}{
+		{"a little girl in a park", "a woman in a park", false},
+		{"a LITTLE BOY on a bike", "a man on a bike", false},
+		{"a girl scout selling cookies", "a adult group selling cookies", false},
+		{"a teen at high school", "a adult at workplace", false},
+		{"she is 12 years old", "she is 25 years old", false},
+		{"my girlfriend at the beach", "my girlfriend at the beach", false},
+		{"a   cat  on a mat ", "a cat on a mat", false},
+		{"jailbait", "", true},
+	}
+	for _, tt := range tests {
+		result := Check(DefaultPolicy, tt.prompt)
+		if result.Prompt != tt.want || result.Blocked != tt.blocked {
+			t.Errorf("Check(%q) = %q blocked %v, want %q blocked %v", tt.prompt, result.Prompt, result.Blocked, tt.want, tt.blocked)
+		}
+	}
+}
+
+func TestApplyOrder(t *testing.T) {
+	policy, err := compile("test", []byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prompt  string
+		want    string
+		blocked bool
+		hits    []string
+	}{
+		{"a bird", "a fish", false, []string{"birds"}},
+		// The cat becomes a dog before the dog rules run
+		{"a cat", "", true, []string{"cats", "dogs"}},
+		// An allow ends the run, the bird is left alone
+		{"a good cat and a bird", "a good dog and a bird", false, []string{"cats", "good dogs"}},
+		// So does a block, replacing the whole prompt when it has a replacement
+		{"a bird at night", "a sunset", false, []string{"sunsets"}},
+		{"a dog at night", "", true, []string{"dogs"}},
+	}
+	for _, tt := range tests {
+		result := policy.Apply(tt.prompt)
+		var hits []string
+		for _, hit := range result.Hits {
+			hits = append(hits, hit.Rule)
+		}
+		if result.Prompt != tt.want || result.Blocked != tt.blocked || !reflect.DeepEqual(hits, tt.hits) {
+			t.Errorf("Apply(%q) = %q blocked %v hits %v, want %q blocked %v hits %v", tt.prompt, result.Prompt, result.Blocked, hits, tt.want, tt.blocked, tt.hits)
+		}
+	}
+}
+
+func TestAuditMode(t *testing.T) {
+	policy, err := compile("audit", []byte("mode = \"audit\"\n"+testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := policy.Apply(" a  cat ")
+	if result.Prompt != "a cat" || result.Blocked || !result.Audit {
+		t.Errorf("expected an audited prompt to pass unchanged, got %q blocked %v audit %v", result.Prompt, result.Blocked, result.Audit)
+	}
+	if len(result.Hits) != 2 || result.Hits[0].Rule != "cats" || result.Hits[1].Rule != "dogs" {
+		t.Errorf("expected the rules that would fire to be reported, got %+v", result.Hits)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "pets.toml"), []byte(testRules), 0o644)
+	os.WriteFile(filepath.Join(dir, "broken.toml"), []byte("mode = \"sometimes\""), 0o644)
+
+	if err := Load(dir, []string{"forbidden"}, "a landscape"); err == nil {
+		t.Error("expected the broken policy to be reported")
+	}
+	if _, ok := Get("broken"); ok {
+		t.Error("a policy that failed to load should be left out")
+	}
+	if got := Check("pets", "a forbidden cat"); got.Prompt != "a landscape" {
+		t.Errorf("expected bad words to go before the rules of every policy, got %q", got.Prompt)
+	}
+	if got := Check(NoPolicy, "a forbidden cat"); got.Prompt != "a landscape" {
+		t.Errorf("expected bad words to apply without a policy, got %q", got.Prompt)
+	}
+	if got := Check("typo", "a little girl"); got.Policy != DefaultPolicy || got.Prompt != "a woman" {
+		t.Errorf("expected an unknown policy to fall back to the default, got %q from %s", got.Prompt, got.Policy)
+	}
+}
@@ -0,0 +1,290 @@
+// Package fetch downloads media from URLs users give, refusing hosts on loopback, private and
+// link-local addresses, capping the size and checking the content before anything uses it.
+package fetch
+
+import (
+	"aibird/settings"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DefaultTimeout is how long a fetch may take in all, redirects included, when Options set none
+const DefaultTimeout = 30 * time.Second
+
+// maxRedirects is how many redirects are followed, each to a host that is checked again
+const maxRedirects = 5
+
+// sniffBytes is how much of a body http.DetectContentType looks at
+const sniffBytes = 512
+
+var (
+	ErrScheme         = errors.New("only http and https URLs can be fetched")
+	ErrBlockedAddress = errors.New("the URL points at a private address")
+	ErrTooLarge       = errors.New("the file is too large")
+	ErrContentType    = errors.New("the file is not of an accepted type")
+)
+
+// Options limits what a fetch accepts
+type Options struct {
+	// ContentTypes are the accepted media types, sniffed from the content rather than taken from
+	// the header. One ending in "/", like "image/", accepts the whole family. Empty accepts anything.
+	ContentTypes []string
+	MaxBytes     int64 // 0 means no limit
+	Timeout      time.Duration
+}
+
+// File is a fetched body written to a temporary file, which the caller removes
+type File struct {
+	Path        string
+	ContentType string
+	Size        int64
+}
+
+// Info is what a HEAD request says about a URL, as the server reports it
+type Info struct {
+	ContentType string
+	Size        int64 // -1 when the server didn't say
+}
+
+var client atomic.Pointer[http.Client]
+
+func init() {
+	client.Store(newClient(nil))
+}
+
+// UseProxy sends every fetch through the proxy. Hosts are still checked before each request and
+// redirect, but the proxy makes the connection so the address it connects to can't be.
+func UseProxy(proxy settings.Proxy) error {
+	if proxy.Host == "" || proxy.Port == "" {
+		return errors.New("the proxy needs a host and a port")
+	}
+	proxyURL := &url.URL{Scheme: "http", Host: net.JoinHostPort(proxy.Host, proxy.Port)}
+	if proxy.User != "" {
+		proxyURL.User = url.UserPassword(proxy.User, proxy.Pass)
+	}
+	client.Store(newClient(proxyURL))
+	return nil
+}
+
+func newClient(proxyURL *url.URL) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	} else {
+		// The address is checked again as it is connected to, after DNS, so a name that resolves
+		// differently the second time still can't reach a private address
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if blocked(addr) {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, addr)
+			}
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return checkURL(req.Context(), req.URL)
+		},
+	}
+}
+
+// blockedPrefixes are the ranges blocked on top of those netip can name
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT, and Tailscale
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, which reaches any IPv4 address
+}
+
+// blocked reports whether an address is one a user's URL mustn't reach
+func blocked(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckURL reports whether a URL may be fetched, for URLs another service fetches on our behalf
+func CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	return checkURL(ctx, u)
+}
+
+func checkURL(ctx context.Context, u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrScheme
+	}
+	host := u.Hostname()
+	if host == "" {
+		return errors.New("the URL has no host")
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("could not resolve %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if !blocked(addr) {
+			continue
+		}
+		if addr.Unmap().String() == host {
+			return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+		}
+		return fmt.Errorf("%w: %s is %s", ErrBlockedAddress, host, addr.Unmap())
+	}
+	return nil
+}
+
+// Head asks the server about a URL without downloading it
+func Head(ctx context.Context, rawURL string, timeout time.Duration) (*Info, error) {
+	resp, cancel, err := do(ctx, http.MethodHead, rawURL, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	resp.Body.Close()
+
+	return &Info{ContentType: resp.Header.Get("Content-Type"), Size: resp.ContentLength}, nil
+}
+
+// Fetch downloads a URL to a temporary file, refusing it once it is larger than opts.MaxBytes or if
+// its content is not one of opts.ContentTypes
+func Fetch(ctx context.Context, rawURL string, opts Options) (*File, error) {
+	resp, cancel, err := do(ctx, http.MethodGet, rawURL, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+
+	if opts.MaxBytes > 0 && resp.ContentLength > opts.MaxBytes {
+		return nil, fmt.Errorf("%w, the limit is %d bytes", ErrTooLarge, opts.MaxBytes)
+	}
+
+	head := make([]byte, sniffBytes)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read the response: %w", err)
+	}
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+	if !accepted(contentType, opts.ContentTypes) {
+		return nil, fmt.Errorf("%w: %s", ErrContentType, contentType)
+	}
+
+	file, err := os.CreateTemp("", "aibird-fetch-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a temporary file: %w", err)
+	}
+	body := io.MultiReader(bytes.NewReader(head), resp.Body)
+	if opts.MaxBytes > 0 {
+		body = io.LimitReader(body, opts.MaxBytes+1)
+	}
+	size, err := io.Copy(file, body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	switch {
+	case err != nil:
+		err = fmt.Errorf("failed to download: %w", err)
+	case opts.MaxBytes > 0 && size > opts.MaxBytes:
+		err = fmt.Errorf("%w, the limit is %d bytes", ErrTooLarge, opts.MaxBytes)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &File{Path: file.Name(), ContentType: contentType, Size: size}, nil
+}
+
+// do checks the URL and sends the request, cancel must be called once the body is read
+func do(ctx context.Context, method, rawURL string, timeout time.Duration) (*http.Response, context.CancelFunc, error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	u, err := url.Parse(rawURL)
+	if err == nil {
+		err = checkURL(ctx, u)
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	resp, err := client.Load().Do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, nil, fmt.Errorf("the server responded %s", resp.Status)
+	}
+	return resp, cancel, nil
+}
+
+// accepted reports whether a sniffed content type is one of the accepted ones
+func accepted(contentType string, accepted []string) bool {
+	if len(accepted) == 0 {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	for _, a := range accepted {
+		if mediaType == a || (strings.HasSuffix(a, "/") && strings.HasPrefix(mediaType, a)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package fetch
+
+import (
+	"aibird/settings"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// png is enough of a PNG for http.DetectContentType
+var png = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestBlocked(t *testing.T) {
+	tests := []struct {
+		addr    string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.10", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.101.102.103", true},
+		{"100.127.255.255", true},
+		{"192.0.0.8", true},
+		{"198.18.0.1", true},
+		{"198.19.255.255", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"::", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"ff02::1", true},
+		{"::ffff:10.0.0.1", true},
+		{"64:ff9b::a00:1", true},
+		{"64:ff9b::808:808", true},
+		{"8.8.8.8", false},
+		{"100.63.255.255", false},
+		{"100.128.0.0", false},
+		{"192.0.2.1", false},
+		{"198.20.0.1", false},
+		{"203.0.113.10", false},
+		{"2001:4860:4860::8888", false},
+		{"::ffff:8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		if got := blocked(netip.MustParseAddr(tt.addr)); got != tt.blocked {
+			t.Errorf("blocked(%s) = %v, want %v", tt.addr, got, tt.blocked)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url string
+		err error
+	}{
+		{"http://203.0.113.10/cat.png", nil},
+		{"https://[2001:4860:4860::8888]/cat.png", nil},
+		{"http://127.0.0.1:8188/view", ErrBlockedAddress},
+		{"http://100.100.1.1:8188/view", ErrBlockedAddress},
+		{"http://[64:ff9b::a00:1]/", ErrBlockedAddress},
+		{"ftp://203.0.113.10/cat.png", ErrScheme},
+		{"file:///etc/passwd", ErrScheme},
+	}
+	for _, tt := range tests {
+		err := CheckURL(context.Background(), tt.url)
+		if tt.err == nil && err != nil || tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("CheckURL(%s) = %v, want %v", tt.url, err, tt.err)
+		}
+	}
+}
+
+func TestFetchPrivate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("a private address was fetched")
+	}))
+	defer server.Close()
+
+	if _, err := Fetch(context.Background(), server.URL+"/cat.png", Options{}); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("expected a loopback URL to be refused, got %v", err)
+	}
+}
+
+func TestRedirectToPrivate(t *testing.T) {
+	redirect := newClient(nil).CheckRedirect
+	from, _ := http.NewRequest(http.MethodGet, "http://203.0.113.10/cat.png", nil)
+	for _, target := range []string{"http://10.0.0.1/", "http://100.64.0.1:8188/view", "http://[::1]/"} {
+		to, _ := http.NewRequest(http.MethodGet, target, nil)
+		if err := redirect(to, []*http.Request{from}); !errors.Is(err, ErrBlockedAddress) {
+			t.Errorf("expected a redirect to %s to be refused, got %v", target, err)
+		}
+	}
+
+	to, _ := http.NewRequest(http.MethodGet, "http://203.0.113.11/cat.png", nil)
+	if err := redirect(to, []*http.Request{from}); err != nil {
+		t.Errorf("expected a redirect to a public address to be followed, got %v", err)
+	}
+	if err := redirect(to, make([]*http.Request, maxRedirects)); err == nil {
+		t.Errorf("expected redirects to stop after %d", maxRedirects)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	defer client.Store(newClient(nil))
+
+	// The proxy stands in for the internet, it is asked for every URL the client fetches
+	var requests atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Host + r.URL.Path {
+		case "203.0.113.10/cat.png":
+			w.Write(png)
+		case "203.0.113.10/moved":
+			http.Redirect(w, r, "http://192.168.1.1/admin", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer proxy.Close()
+
+	u, _ := url.Parse(proxy.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	if err := UseProxy(settings.Proxy{Host: host, Port: port}); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := Fetch(context.Background(), "http://203.0.113.10/cat.png", Options{ContentTypes: []string{"image/"}})
+	if err != nil {
+		t.Fatalf("expected a fetch through the proxy, got %v", err)
+	}
+	os.Remove(file.Path)
+	if file.ContentType != "image/png" || requests.Load() != 1 {
+		t.Errorf("expected a PNG fetched through the proxy, got %s after %d requests", file.ContentType, requests.Load())
+	}
+
+	requests.Store(0)
+	if _, err := Fetch(context.Background(), "http://10.0.0.1/cat.png", Options{}); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("expected a private URL to be refused before the proxy, got %v", err)
+	}
+	if requests.Load() != 0 {
+		t.Error("a private URL was sent to the proxy")
+	}
+
+	if _, err := Fetch(context.Background(), "http://203.0.113.10/moved", Options{}); !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("expected a redirect to a private address to be refused, got %v", err)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected the proxy to be asked once, not for the redirect, got %d requests", requests.Load())
+	}
+}
@@ -1,8 +1,10 @@
 package request
 
 import (
+	"aibird/http/fetch"
 	"aibird/logger"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,8 +14,8 @@ import (
 	"net/textproto"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"time"
 )
 
 func (r *Request) GetUrl() string {
@@ -218,24 +220,14 @@ func (r *Request) Download() error {
 }
 
 func IsImage(url string) bool {
-	// Validate URL to prevent SSRF attacks
-	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
-		logger.Error("Invalid URL scheme", "url", url)
-		return false
-	}
-
-	resp, err := http.Head(url)
+	info, err := fetch.Head(context.Background(), url, 10*time.Second)
 	if err != nil {
 		logger.Error("Error checking image URL", "url", url, "error", err)
 		return false
 	}
-	defer resp.Body.Close()
-
-	contentType := resp.Header.Get("Content-Type")
-	contentLength, _ := strconv.Atoi(resp.Header.Get("Content-Length"))
 
 	// Check if Content-Type header starts with "image/" and Content-Length is less than 5MB
-	if strings.HasPrefix(contentType, "image/") && contentLength <= 5*1024*1024 {
+	if strings.HasPrefix(info.ContentType, "image/") && info.Size <= 5*1024*1024 {
 		return true
 	}
 
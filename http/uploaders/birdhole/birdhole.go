@@ -3,6 +3,7 @@ package birdhole
 import (
 	"aibird/http/request"
 	"aibird/image"
+	"aibird/metrics"
 	"aibird/settings"
 	"encoding/json"
 	"os"
@@ -34,11 +35,13 @@ func BirdHole(fileName string, message string, fields []request.Fields, config s
 	var response string
 	err := birdHoleUpload.Call(&response)
 	if err != nil {
+		metrics.BirdholeUploadFailures.Inc()
 		return "", err
 	} else {
 		var jsonResponse map[string]string
 		err = json.Unmarshal([]byte(response), &jsonResponse)
 		if err != nil {
+			metrics.BirdholeUploadFailures.Inc()
 			return "", err
 		}
 
@@ -0,0 +1,169 @@
+package comfyui
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/richinsley/comfy2go/graphapi"
+)
+
+// Format is how a workflow file was saved from ComfyUI
+type Format int
+
+const (
+	FormatGraph    Format = iota // the UI graph, with aibird_meta in a text node inside the API group
+	FormatAPI                    // "Save (API format)", with aibird_meta in a <workflow>.aibird.toml sidecar
+	FormatPipeline               // a <workflow>.aibird.toml with no JSON, declaring a pipeline of other workflows
+)
+
+// SidecarSuffix replaces .json in the name of an API format workflow to give its aibird_meta file
+const SidecarSuffix = ".aibird.toml"
+
+// apiPrompt is an API format workflow, keyed by node id
+type apiPrompt map[string]*apiNode
+
+type apiNode struct {
+	ClassType string                 `json:"class_type"`
+	Inputs    map[string]interface{} `json:"inputs"`
+	Meta      struct {
+		Title string `json:"title"`
+	} `json:"_meta"`
+}
+
+// sidecarFile returns the aibird_meta file that goes with an API format workflow
+func sidecarFile(workflowFile string) string {
+	return strings.TrimSuffix(workflowFile, ".json") + SidecarSuffix
+}
+
+// detectFormat tells the two formats apart, the graph has a list of nodes where the API format
+// is an object of nodes that each name their class
+func detectFormat(data []byte) Format {
+	var prompt apiPrompt
+	if err := json.Unmarshal(data, &prompt); err != nil || len(prompt) == 0 {
+		return FormatGraph
+	}
+	for _, node := range prompt {
+		if node == nil || node.ClassType == "" {
+			return FormatGraph
+		}
+	}
+	return FormatAPI
+}
+
+// parseSidecar reads the aibird_meta of an API format workflow from its sidecar file
+func parseSidecar(workflowFile string) (*AibirdMeta, error) {
+	file := sidecarFile(workflowFile)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("API format workflow needs its aibird_meta in %s: %w", file, err)
+	}
+
+	var meta AibirdMeta
+	if _, err := toml.Decode(string(data), &meta); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", file, err)
+	}
+	return &meta, nil
+}
+
+// parsePipeline reads a standalone aibird_meta, which is only of use if it declares a pipeline
+func parsePipeline(file string) (*AibirdMeta, error) {
+	var meta AibirdMeta
+	if _, err := toml.DecodeFile(file, &meta); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", file, err)
+	}
+	if len(meta.Pipeline) == 0 {
+		return nil, fmt.Errorf("%s has no workflow JSON and declares no pipeline", file)
+	}
+	return &meta, nil
+}
+
+// find returns the nodes a target names, by id or by _meta.title
+func (p apiPrompt) find(name string) []*apiNode {
+	if node, ok := p[name]; ok {
+		return []*apiNode{node}
+	}
+
+	var nodes []*apiNode
+	for _, node := range p {
+		if node.Meta.Title == name {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// apply writes the updates to the node inputs they target. Like widgets in the graph format,
+// inputs that don't exist are skipped, `aibird workflows validate` reports them.
+func (p apiPrompt) apply(updates []update, promptTarget PromptTarget) {
+	for _, u := range updates {
+		for _, node := range p.find(u.target.Node) {
+			current, ok := node.Inputs[u.target.Input]
+			if !ok {
+				continue
+			}
+
+			// The saved prompt text is kept in front of the user's, as it is for the graph format
+			value := u.value
+			if u.target.Node == promptTarget.Node && u.target.Input == promptTarget.Input {
+				if original, ok := current.(string); ok && original != "" {
+					value = original + " " + u.value.(string)
+				}
+			}
+			node.Inputs[u.target.Input] = value
+		}
+	}
+}
+
+// graph wraps the prompt in a graph so comfy2go can queue it and follow its progress like any
+// other workflow. Each input becomes a property holding its raw value, links included, so the
+// prompt is sent as it was saved.
+func (p apiPrompt) graph() (*graphapi.Graph, error) {
+	graph := &graphapi.Graph{
+		NodesByID: make(map[int]*graphapi.GraphNode, len(p)),
+		LinksByID: make(map[int]*graphapi.Link),
+	}
+
+	for id, node := range p {
+		nodeID, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("node id %q is not a number", id)
+		}
+
+		title := node.Meta.Title
+		if title == "" {
+			title = node.ClassType
+		}
+		graphNode := &graphapi.GraphNode{
+			ID:          nodeID,
+			Type:        node.ClassType,
+			Title:       title,
+			DisplayName: title,
+			Properties:  make(map[string]graphapi.Property, len(node.Inputs)),
+			Graph:       graph,
+		}
+		for name, value := range node.Inputs {
+			graphNode.Properties[name] = &rawInput{value: value}
+		}
+
+		graph.Nodes = append(graph.Nodes, graphNode)
+		graph.NodesByID[nodeID] = graphNode
+	}
+
+	sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].ID < graph.Nodes[j].ID })
+	graph.NodesInExecutionOrder = append([]*graphapi.GraphNode(nil), graph.Nodes...)
+	return graph, nil
+}
+
+// rawInput is an API format input as a graph property, its value is sent to ComfyUI untouched
+type rawInput struct {
+	graphapi.UnknownProperty
+	value interface{}
+}
+
+func (r *rawInput) GetValue() interface{} { return r.value }
+func (r *rawInput) Serializable() bool    { return true }
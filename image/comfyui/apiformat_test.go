@@ -0,0 +1,146 @@
+package comfyui
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// testPrompt is a small API format workflow, two of its nodes share a title
+const testPrompt = `{
+	"3": {"class_type": "KSampler", "inputs": {"seed": 1, "steps": 20, "model": ["4", 0], "positive": ["6", 0]}, "_meta": {"title": "Sampler"}},
+	"4": {"class_type": "CheckpointLoaderSimple", "inputs": {"ckpt_name": "model.safetensors"}},
+	"6": {"class_type": "CLIPTextEncode", "inputs": {"text": "masterpiece,", "clip": ["4", 1]}, "_meta": {"title": "Prompt"}},
+	"7": {"class_type": "CLIPTextEncode", "inputs": {"text": "", "clip": ["4", 1]}, "_meta": {"title": "Prompt"}}
+}`
+
+func parsePrompt(t *testing.T, data string) apiPrompt {
+	t.Helper()
+	var prompt apiPrompt
+	if err := json.Unmarshal([]byte(data), &prompt); err != nil {
+		t.Fatal(err)
+	}
+	return prompt
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Format
+	}{
+		{"api", testPrompt, FormatAPI},
+		{"graph", `{"last_node_id": 9, "nodes": [{"id": 3, "type": "KSampler"}], "links": []}`, FormatGraph},
+		{"graph without nodes", `{"version": 0.4}`, FormatGraph},
+		{"node without a class", `{"3": {"class_type": "KSampler", "inputs": {}}, "4": {"inputs": {}}}`, FormatGraph},
+		{"empty", `{}`, FormatGraph},
+		{"not json", `nodes`, FormatGraph},
+	}
+	for _, tt := range tests {
+		if got := detectFormat([]byte(tt.data)); got != tt.want {
+			t.Errorf("%s: got format %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	prompt := parsePrompt(t, testPrompt)
+	tests := []struct {
+		name  string
+		nodes []*apiNode
+	}{
+		{"3", []*apiNode{prompt["3"]}},
+		{"Sampler", []*apiNode{prompt["3"]}},
+		{"CheckpointLoaderSimple", nil},
+		{"Missing", nil},
+	}
+	for _, tt := range tests {
+		if got := prompt.find(tt.name); !reflect.DeepEqual(got, tt.nodes) {
+			t.Errorf("find(%q) found %d nodes, want %d", tt.name, len(got), len(tt.nodes))
+		}
+	}
+
+	if got := prompt.find("Prompt"); len(got) != 2 {
+		t.Errorf("expected a shared title to find both nodes, got %d", len(got))
+	}
+}
+
+func TestApply(t *testing.T) {
+	prompt := parsePrompt(t, testPrompt)
+	target := PromptTarget{Node: "Prompt", Input: "text"}
+	prompt.apply([]update{
+		{Target{Node: "Prompt", Input: "text"}, "a cat"},
+		{Target{Node: "3", Input: "seed"}, int64(42)},
+		{Target{Node: "Sampler", Input: "steps"}, int64(30)},
+		{Target{Node: "4", Input: "ckpt_name"}, "other.safetensors"},
+		{Target{Node: "3", Input: "cfg"}, 7.5},
+		{Target{Node: "Missing", Input: "text"}, "lost"},
+	}, target)
+
+	checks := []struct {
+		node, input string
+		want        interface{}
+	}{
+		{"6", "text", "masterpiece, a cat"},
+		{"7", "text", "a cat"},
+		{"3", "seed", int64(42)},
+		{"3", "steps", int64(30)},
+		{"4", "ckpt_name", "other.safetensors"},
+	}
+	for _, c := range checks {
+		if got := prompt[c.node].Inputs[c.input]; got != c.want {
+			t.Errorf("node %s input %s = %v, want %v", c.node, c.input, got, c.want)
+		}
+	}
+	if _, ok := prompt["3"].Inputs["cfg"]; ok {
+		t.Error("an input the node doesn't have should be skipped")
+	}
+
+	// Only the prompt target keeps its saved text in front
+	prompt = parsePrompt(t, testPrompt)
+	prompt.apply([]update{{Target{Node: "6", Input: "text"}, "a dog"}}, PromptTarget{Node: "7", Input: "text"})
+	if got := prompt["6"].Inputs["text"]; got != "a dog" {
+		t.Errorf("expected text that isn't the prompt to be replaced, got %q", got)
+	}
+}
+
+func TestApplyLinked(t *testing.T) {
+	prompt := parsePrompt(t, testPrompt)
+	prompt.apply([]update{{Target{Node: "3", Input: "positive"}, "a cat"}}, PromptTarget{Node: "3", Input: "positive"})
+	if got := prompt["3"].Inputs["positive"]; got != "a cat" {
+		t.Errorf("expected a linked prompt input to be replaced without its link in front, got %v", got)
+	}
+	if got := prompt["3"].Inputs["model"]; !reflect.DeepEqual(got, []interface{}{"4", 0.0}) {
+		t.Errorf("expected other links to be left alone, got %v", got)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	graph, err := parsePrompt(t, testPrompt).graph()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int
+	for _, node := range graph.Nodes {
+		ids = append(ids, node.ID)
+	}
+	if !reflect.DeepEqual(ids, []int{3, 4, 6, 7}) || len(graph.NodesInExecutionOrder) != 4 {
+		t.Fatalf("expected nodes 3, 4, 6 and 7 in order, got %v", ids)
+	}
+
+	sampler := graph.NodesByID[3]
+	if sampler.Type != "KSampler" || sampler.Title != "Sampler" || graph.NodesByID[4].Title != "CheckpointLoaderSimple" {
+		t.Errorf("expected titles from _meta or the class, got %q and %q", sampler.Title, graph.NodesByID[4].Title)
+	}
+	if got := sampler.Properties["model"].GetValue(); !reflect.DeepEqual(got, []interface{}{"4", 0.0}) {
+		t.Errorf("expected a link to be sent as saved, got %v", got)
+	}
+	if got := sampler.Properties["steps"].GetValue(); got != 20.0 {
+		t.Errorf("expected a value to be sent as saved, got %v", got)
+	}
+
+	if _, err := parsePrompt(t, `{"3": {"class_type": "KSampler", "inputs": {}}, "sampler": {"class_type": "KSampler", "inputs": {}}}`).graph(); err == nil {
+		t.Error("expected a node id that isn't a number to be refused")
+	}
+}
@@ -0,0 +1,230 @@
+package comfyui
+
+import (
+	"aibird/birdbase"
+	"aibird/irc/state"
+	"aibird/logger"
+	"aibird/settings"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resultKeyPrefix is followed by the hash of everything that went into a generation in birdbase
+const resultKeyPrefix = "result_"
+
+// FreshArgument makes a command generate anew rather than be answered from the result cache
+const FreshArgument = "fresh"
+
+// CachedResult is an uploaded generation, found again by the workflow and values that made it. It is
+// kept for as long as birdhole keeps the upload.
+type CachedResult struct {
+	Links      string    `json:"links"`
+	Generation string    `json:"generation"`
+	Seed       *int64    `json:"seed,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// Summary names the generation the result came from for a reply
+func (c *CachedResult) Summary() string {
+	g := Generation{ID: c.Generation, Seed: c.Seed}
+	return g.Summary() + ", cached"
+}
+
+// cacheExpiryHours is how long a result is cached, comfyui.cacheExpiryHours but never longer than
+// birdhole keeps the upload it links to. 0 turns the cache off.
+func cacheExpiryHours(config *settings.Config) int {
+	if config == nil {
+		return 0
+	}
+	hours := config.ComfyUi.CacheExpiryHours
+	if config.Birdhole.Expiry > 0 {
+		hours = min(hours, config.Birdhole.Expiry)
+	}
+	return hours
+}
+
+// CachedResultFor returns the result of an earlier generation of exactly what the command asks for.
+// Commands given --fresh, workflows the user may not run and prompts the filter blocks are never
+// answered from the cache, nor is anything when the cache is off.
+func CachedResultFor(irc state.State) (*CachedResult, bool) {
+	if cacheExpiryHours(irc.Config) <= 0 || irc.GetBoolArg(FreshArgument) {
+		return nil, false
+	}
+	workflow, ok := Workflows.Get(irc.Action())
+	if !ok || workflow.Err != nil || irc.User == nil || irc.User.GetAccessLevel() < workflow.Meta.AccessLevel {
+		return nil, false
+	}
+
+	key, ok := resultKey(irc, workflow, nil)
+	if !ok || !birdbase.Has(key) {
+		return nil, false
+	}
+	data, err := birdbase.Get(key)
+	if err != nil {
+		logger.Error("Failed to load cached result", "workflow", workflow.Name, "error", err)
+		return nil, false
+	}
+	var result CachedResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		logger.Error("Failed to unmarshal cached result", "workflow", workflow.Name, "error", err)
+		return nil, false
+	}
+	return &result, true
+}
+
+// CacheResult keeps the links a generation was uploaded to for commands asking for the same again.
+// A generation whose seed was drawn at random is also kept under its seed, so asking for that seed,
+// as !again does, finds it too.
+func CacheResult(irc state.State, links string, generation *Generation) error {
+	if cacheExpiryHours(irc.Config) <= 0 {
+		return nil
+	}
+	workflow, ok := Workflows.Get(irc.Action())
+	if !ok || workflow.Err != nil {
+		return nil
+	}
+
+	data, err := json.Marshal(CachedResult{Links: links, Generation: generation.ID, Seed: generation.Seed, CreatedAt: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal cached result: %w", err)
+	}
+
+	seeds := []*int64{nil}
+	if given, _ := irc.GetStringArg("seed", ""); given == "" && generation.Seed != nil {
+		seeds = append(seeds, generation.Seed)
+	}
+	for _, seed := range seeds {
+		key, ok := resultKey(irc, workflow, seed)
+		if !ok {
+			return nil
+		}
+		if err := birdbase.PutBytesExpireHours(key, data, cacheExpiryHours(irc.Config)); err != nil {
+			return fmt.Errorf("failed to cache result: %w", err)
+		}
+	}
+	return nil
+}
+
+// resultKey hashes the workflow's files and the values the command's prompt and arguments resolve to,
+// resolved as process does so that spelling a value differently finds the same result. The seed is
+// only part of it when the user pinned one or a drawn one is passed in. ok is false for prompts the
+// filter blocks, which are never generated.
+func resultKey(irc state.State, workflow *Workflow, seed *int64) (string, bool) {
+	prompt, err := FilterPrompt(irc, irc.Message())
+	if err != nil {
+		return "", false
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "workflow %s %s\nprompt %q\n", workflow.Name, workflow.Hash, prompt)
+
+	if given, _ := irc.GetStringArg("seed", ""); given != "" {
+		fmt.Fprintf(h, "seed %s\n", canonicalValue("int", given, nil))
+	} else if seed != nil {
+		fmt.Fprintf(h, "seed %d\n", *seed)
+	}
+
+	parameters := make(map[string]bool)
+	if len(workflow.Meta.Pipeline) == 0 && !hashParameters(h, irc, workflow, "", "", parameters) {
+		return "", false
+	}
+	for i, stage := range workflow.Meta.Pipeline {
+		stageWorkflow, ok := Workflows.Get(stage.Workflow)
+		if !ok || stageWorkflow.Err != nil {
+			return "", false
+		}
+		skip := ""
+		if i > 0 {
+			skip = stage.Input
+		}
+		fmt.Fprintf(h, "stage %s %s\n", stageWorkflow.Name, stageWorkflow.Hash)
+		if !hashParameters(h, stageState(irc, stage), stageWorkflow, stageWorkflow.Name+".", skip, parameters) {
+			return "", false
+		}
+	}
+
+	// Arguments that aren't parameters, like --pe, still change what is generated
+	var extra []string
+	for _, arg := range irc.Arguments {
+		switch {
+		case parameters[arg.Key], arg.Key == "seed", arg.Key == FreshArgument, arg.Key == RerunArgument, arg.Key == "help":
+			continue
+		}
+		extra = append(extra, fmt.Sprintf("%s=%v", arg.Key, arg.Value))
+	}
+	slices.Sort(extra)
+	fmt.Fprintf(h, "arguments %q\n", extra)
+
+	return resultKeyPrefix + hex.EncodeToString(h.Sum(nil)), true
+}
+
+// hashParameters writes the value every parameter of the workflow but the seed resolves to, the
+// user's or the default, and marks the parameters as seen. It returns false when --ar or --size
+// can't be applied, which fails the generation so nothing is cached for it.
+func hashParameters(h io.Writer, irc state.State, workflow *Workflow, prefix, skip string, seen map[string]bool) bool {
+	sized, err := stageSizeArguments(irc, workflow.Meta, prefix)
+	if err != nil {
+		return false
+	}
+	for _, name := range sortedKeys(workflow.Meta.Parameters) {
+		seen[name] = true
+		if name == "seed" || name == skip {
+			continue
+		}
+		param := workflow.Meta.Parameters[name]
+
+		value := ""
+		switch raw := irc.FindArgument(name, "").(type) {
+		case bool:
+			if raw {
+				value = "true"
+			}
+		case string:
+			value = raw
+		}
+		if size, ok := sized[name]; ok {
+			value = size
+		}
+		if value != "" {
+			value = canonicalValue(param.Type, value, param.Values)
+		} else if param.Default != nil {
+			value = fmt.Sprint(param.Default)
+		}
+		fmt.Fprintf(h, "%s%s %q\n", prefix, name, value)
+	}
+	return true
+}
+
+// canonicalValue writes a value the way process reads it, or as given if it can't be read, in which
+// case the generation fails and nothing is cached
+func canonicalValue(paramType, value string, values []string) string {
+	switch paramType {
+	case "int":
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return strconv.FormatInt(n, 10)
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+	case "bool":
+		if b, err := parseBool(value); err == nil {
+			return strconv.FormatBool(b)
+		}
+	case "enum":
+		if v, ok := matchValue(value, values); ok {
+			return v
+		}
+	case "comfy_list":
+		// Matched against the backend's choices ignoring case
+		return strings.ToLower(value)
+	}
+	return value
+}
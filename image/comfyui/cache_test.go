@@ -0,0 +1,168 @@
+package comfyui
+
+import (
+	"aibird/birdbase"
+	"aibird/filter"
+	"aibird/irc/state"
+	"aibird/irc/users"
+	"aibird/settings"
+	"testing"
+
+	"git.mills.io/prologic/bitcask"
+)
+
+// useCache opens a birdbase of its own for the test, with the default filter policy and a
+// workflow to generate with
+func useCache(t *testing.T) {
+	t.Helper()
+	db, err := bitcask.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := birdbase.Data
+	birdbase.Data = db
+	t.Cleanup(func() {
+		db.Close()
+		birdbase.Data = previous
+	})
+
+	if err := filter.Load(t.TempDir(), nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	useWorkflows(t, &Workflow{Name: "sdxl", Hash: "1", Meta: parseMeta(t, `
+accessLevel = 1
+[parameters.seed]
+type = "int"
+[parameters.steps]
+type = "int"
+default = 20
+`)})
+}
+
+// cacheState is a command for the test workflow
+func cacheState(prompt string, args ...state.Argument) state.State {
+	config := &settings.Config{}
+	config.ComfyUi.CacheExpiryHours = 72
+	return state.State{
+		Command:   state.Command{Action: "sdxl", Message: prompt},
+		Arguments: args,
+		User:      &users.User{AccessLevel: 1},
+		Config:    config,
+	}
+}
+
+func TestCacheExpiryHours(t *testing.T) {
+	tests := []struct {
+		cache, birdhole, want int
+	}{
+		{72, 0, 72},
+		{72, 24, 24},
+		{12, 24, 12},
+		{0, 24, 0},
+	}
+	for _, tt := range tests {
+		config := &settings.Config{}
+		config.ComfyUi.CacheExpiryHours = tt.cache
+		config.Birdhole.Expiry = tt.birdhole
+		if got := cacheExpiryHours(config); got != tt.want {
+			t.Errorf("cache %d and birdhole %d hours: got %d, want %d", tt.cache, tt.birdhole, got, tt.want)
+		}
+	}
+	if cacheExpiryHours(nil) != 0 {
+		t.Error("expected no config to turn the cache off")
+	}
+}
+
+func TestResultKeySeed(t *testing.T) {
+	useCache(t)
+	workflow, _ := Workflows.Get("sdxl")
+	key := func(irc state.State, seed *int64) string {
+		t.Helper()
+		k, ok := resultKey(irc, workflow, seed)
+		if !ok {
+			t.Fatalf("expected a key for %+v", irc.Arguments)
+		}
+		return k
+	}
+	seed := int64(5)
+
+	unpinned := key(cacheState("a cat"), nil)
+	pinned := key(cacheState("a cat", state.Argument{Key: "seed", Value: "5"}), nil)
+	if unpinned == pinned {
+		t.Error("expected a pinned seed to be part of the key")
+	}
+	if key(cacheState("a cat", state.Argument{Key: "seed", Value: "05"}), nil) != pinned {
+		t.Error("expected the seed to be read as a number")
+	}
+	if key(cacheState("a cat"), &seed) != pinned {
+		t.Error("expected a drawn seed to give the key of asking for it")
+	}
+	if key(cacheState("a cat", state.Argument{Key: FreshArgument, Value: true}), nil) != unpinned {
+		t.Error("expected --fresh to be left out of the key")
+	}
+	if key(cacheState("a cat", state.Argument{Key: "steps", Value: "20"}), nil) != unpinned {
+		t.Error("expected a parameter given its default to find the same result")
+	}
+	if key(cacheState("a dog"), nil) == unpinned {
+		t.Error("expected the prompt to be part of the key")
+	}
+}
+
+func TestCachedResult(t *testing.T) {
+	useCache(t)
+	seed := int64(7)
+	if err := CacheResult(cacheState("a cat"), "https://example.com/cat.png", &Generation{ID: "abc", Seed: &seed}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		irc   state.State
+		found bool
+	}{
+		{"same again", cacheState("a cat"), true},
+		{"drawn seed", cacheState("a cat", state.Argument{Key: "seed", Value: "7"}), true},
+		{"other seed", cacheState("a cat", state.Argument{Key: "seed", Value: "8"}), false},
+		{"other prompt", cacheState("a dog"), false},
+		{"fresh", cacheState("a cat", state.Argument{Key: FreshArgument, Value: true}), false},
+	}
+	for _, tt := range tests {
+		result, found := CachedResultFor(tt.irc)
+		if found != tt.found {
+			t.Errorf("%s: found %v, want %v", tt.name, found, tt.found)
+		} else if found && (result.Links != "https://example.com/cat.png" || result.Generation != "abc") {
+			t.Errorf("%s: got %+v", tt.name, result)
+		}
+	}
+
+	// A pinned seed is cached under that seed alone
+	pinned := cacheState("a bird", state.Argument{Key: "seed", Value: "9"})
+	seed = 9
+	if err := CacheResult(pinned, "https://example.com/bird.png", &Generation{ID: "def", Seed: &seed}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := CachedResultFor(cacheState("a bird")); found {
+		t.Error("expected a pinned seed not to answer a command without one")
+	}
+	if _, found := CachedResultFor(pinned); !found {
+		t.Error("expected the pinned seed to find its result")
+	}
+}
+
+func TestCachedResultBlocked(t *testing.T) {
+	useCache(t)
+	blocked := cacheState("jailbait")
+	workflow, _ := Workflows.Get("sdxl")
+	if _, ok := resultKey(blocked, workflow, nil); ok {
+		t.Error("expected a blocked prompt to have no key")
+	}
+	if err := CacheResult(blocked, "https://example.com/nope.png", &Generation{ID: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := CachedResultFor(blocked); found {
+		t.Error("expected a blocked prompt never to be answered from the cache")
+	}
+	if keys := birdbase.Data.Len(); keys != 0 {
+		t.Errorf("expected nothing cached for a blocked prompt, got %d keys", keys)
+	}
+}
@@ -0,0 +1,376 @@
+package comfyui
+
+import (
+	"aibird/logger"
+	"aibird/settings"
+	"aibird/shared/meta"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProbeInterval is how often every backend is asked what it can run and how busy it is
+const ProbeInterval = time.Minute
+
+// modelExtensions are the widget values taken for model files a backend must have
+var modelExtensions = []string{".safetensors", ".ckpt", ".pt", ".pth", ".bin", ".gguf", ".sft", ".onnx"}
+
+// frontendNodes only exist in the ComfyUI editor and are never sent to a backend
+var frontendNodes = []string{"Note", "MarkdownNote", "Reroute", "PrimitiveNode"}
+
+// Graph node modes that keep a node from running
+const (
+	modeMuted    = 2
+	modeBypassed = 4
+)
+
+// ModelFile is a model a node of a workflow loads
+type ModelFile struct {
+	Node string // node class, whose choices must include the file
+	File string
+}
+
+// Requirements are the node classes and model files a workflow can't run without
+type Requirements struct {
+	Nodes  []string
+	Models []ModelFile
+}
+
+// add merges other into r, keeping both lists sorted and free of repeats
+func (r *Requirements) add(other Requirements) {
+	r.Nodes = append(r.Nodes, other.Nodes...)
+	slices.Sort(r.Nodes)
+	r.Nodes = slices.Compact(r.Nodes)
+
+	r.Models = append(r.Models, other.Models...)
+	slices.SortFunc(r.Models, func(a, b ModelFile) int {
+		return strings.Compare(a.Node+"\x00"+a.File, b.Node+"\x00"+b.File)
+	})
+	r.Models = slices.Compact(r.Models)
+}
+
+// requirements reads what a workflow's graph needs from a backend, nothing if it can't be read, in
+// which case Validate says why
+func requirements(format Format, data []byte) Requirements {
+	var r Requirements
+	addNode := func(class string, values []interface{}) {
+		r.add(Requirements{Nodes: []string{class}})
+		for _, value := range values {
+			if file, ok := value.(string); ok && isModelFile(file) {
+				r.add(Requirements{Models: []ModelFile{{Node: class, File: modelPath(file)}}})
+			}
+		}
+	}
+
+	switch format {
+	case FormatAPI:
+		var prompt apiPrompt
+		if err := json.Unmarshal(data, &prompt); err != nil {
+			return r
+		}
+		for _, node := range prompt {
+			if node == nil || node.ClassType == "" {
+				continue
+			}
+			values := make([]interface{}, 0, len(node.Inputs))
+			for _, value := range node.Inputs {
+				values = append(values, value)
+			}
+			addNode(node.ClassType, values)
+		}
+	case FormatGraph:
+		var graph struct {
+			Nodes []struct {
+				Type         string      `json:"type"`
+				Mode         int         `json:"mode"`
+				WidgetValues interface{} `json:"widgets_values"`
+			} `json:"nodes"`
+		}
+		if err := json.Unmarshal(data, &graph); err != nil {
+			return r
+		}
+		for _, node := range graph.Nodes {
+			if node.Type == "" || node.Mode == modeMuted || node.Mode == modeBypassed || slices.Contains(frontendNodes, node.Type) {
+				continue
+			}
+			// Group nodes are made of other nodes in the editor, their type is not a node class
+			if strings.HasPrefix(node.Type, "workflow>") || strings.HasPrefix(node.Type, "workflow/") {
+				continue
+			}
+			var values []interface{}
+			switch widgets := node.WidgetValues.(type) {
+			case []interface{}:
+				values = widgets
+			case map[string]interface{}:
+				for _, value := range widgets {
+					values = append(values, value)
+				}
+			}
+			addNode(node.Type, values)
+		}
+	}
+	return r
+}
+
+func isModelFile(value string) bool {
+	return slices.Contains(modelExtensions, strings.ToLower(path.Ext(value)))
+}
+
+// modelPath writes a model file the same way whichever OS the workflow was saved on
+func modelPath(file string) string {
+	return strings.ReplaceAll(file, `\`, "/")
+}
+
+// Requirements returns what the workflow needs from a backend, for a pipeline what all of its
+// stages need
+func (s *Snapshot) Requirements(w *Workflow) Requirements {
+	if w.Meta == nil || len(w.Meta.Pipeline) == 0 {
+		return w.Needs
+	}
+	var r Requirements
+	for _, stage := range w.Meta.Pipeline {
+		if stageWorkflow, ok := s.Get(stage.Workflow); ok {
+			r.add(stageWorkflow.Needs)
+		}
+	}
+	return r
+}
+
+// Capabilities is what a backend reported the last time it was probed
+type Capabilities struct {
+	Nodes     map[string]map[string]bool // node classes and the model files each offers
+	VramTotal int64                      // bytes, of the first device
+	VramFree  int64
+	Running   int // prompts ComfyUI is running, ours and anyone else's
+	Pending   int // prompts waiting in ComfyUI's own queue
+	CheckedAt time.Time
+	Err       error // why the backend couldn't be probed, it is treated as offline
+}
+
+// Missing lists what the backend lacks of the requirements. A model file is only looked for on a
+// node that offers model files to choose from, a node taking a free text path can't be checked.
+func (c *Capabilities) Missing(r Requirements) []string {
+	var missing []string
+	for _, node := range r.Nodes {
+		if _, ok := c.Nodes[node]; !ok {
+			missing = append(missing, "node "+node)
+		}
+	}
+	for _, model := range r.Models {
+		files := c.Nodes[model.Node]
+		if len(files) > 0 && !files[model.File] {
+			missing = append(missing, "model "+model.File)
+		}
+	}
+	return missing
+}
+
+// BackendRegistry keeps the capabilities of every backend, probed in the background
+type BackendRegistry struct {
+	mutex        sync.RWMutex
+	capabilities map[meta.Backend]*Capabilities
+}
+
+// Backends is what every configured backend could run when last probed, shared by all packages
+var Backends = NewBackendRegistry()
+
+// NewBackendRegistry returns a registry that knows no backend until it probes them
+func NewBackendRegistry() *BackendRegistry {
+	return &BackendRegistry{capabilities: make(map[meta.Backend]*Capabilities)}
+}
+
+// Get returns what the backend reported, ok is false until it has been probed
+func (r *BackendRegistry) Get(backend meta.Backend) (*Capabilities, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	c, ok := r.capabilities[backend]
+	return c, ok
+}
+
+// Set records a backend's capabilities
+func (r *BackendRegistry) Set(backend meta.Backend, c *Capabilities) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.capabilities[backend] = c
+}
+
+// JobFinished forgets how busy the backend's last probe found it once one of our jobs on it ends. The
+// probe may still count that job, which would make the backend look busy until the next one.
+func (r *BackendRegistry) JobFinished(backend meta.Backend) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c, ok := r.capabilities[backend]
+	if !ok || c.Err != nil {
+		return
+	}
+	settled := *c
+	settled.Running, settled.Pending = 0, 0
+	r.capabilities[backend] = &settled
+}
+
+// Check reports whether the backend can run the workflow as far as is known. A backend not probed
+// yet is given the benefit of the doubt, one whose last probe failed is not.
+func (r *BackendRegistry) Check(backend meta.Backend, w *Workflow) error {
+	c, ok := r.Get(backend)
+	if !ok {
+		return nil
+	}
+	if c.Err != nil {
+		return fmt.Errorf("%s is offline", backend)
+	}
+	if missing := c.Missing(Workflows.Snapshot().Requirements(w)); len(missing) > 0 {
+		return fmt.Errorf("%s has no %s", backend, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Runnable reports whether any probed backend can run the workflow, or true before any has been
+func (r *BackendRegistry) Runnable(w *Workflow) bool {
+	r.mutex.RLock()
+	backends := make([]meta.Backend, 0, len(r.capabilities))
+	for backend := range r.capabilities {
+		backends = append(backends, backend)
+	}
+	r.mutex.RUnlock()
+
+	for _, backend := range backends {
+		if r.Check(backend, w) == nil {
+			return true
+		}
+	}
+	return len(backends) == 0
+}
+
+// Probe asks every configured backend at once what it can run and how busy it is
+func (r *BackendRegistry) Probe(config settings.ComfyUiConfig) {
+	var wg sync.WaitGroup
+	for _, port := range config.Ports {
+		wg.Add(1)
+		go func(backend meta.Backend) {
+			defer wg.Done()
+			c := probe(config, backend)
+			previous, known := r.Get(backend)
+			switch {
+			case c.Err != nil && (!known || previous.Err == nil):
+				logger.Warn("ComfyUI backend is offline", "backend", backend, "error", c.Err)
+			case c.Err == nil && known && previous.Err != nil:
+				logger.Info("ComfyUI backend is back online", "backend", backend)
+			}
+			r.Set(backend, c)
+		}(meta.Backend(port.Name))
+	}
+	wg.Wait()
+}
+
+// Watch probes the backends now and then every interval until ctx is cancelled
+func (r *BackendRegistry) Watch(ctx context.Context, config settings.ComfyUiConfig, interval time.Duration) {
+	go func() {
+		r.Probe(config)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.Probe(config)
+			}
+		}
+	}()
+}
+
+// probe fetches /object_info, /system_stats and /queue from one backend
+func probe(config settings.ComfyUiConfig, backend meta.Backend) *Capabilities {
+	c := &Capabilities{CheckedAt: time.Now()}
+	clientAddr, clientPort, found := getBackendAddress(config, backend)
+	if !found {
+		c.Err = fmt.Errorf("ComfyUI backend %q is not configured", backend)
+		return c
+	}
+	base := fmt.Sprintf("http://%s:%d", clientAddr, clientPort)
+
+	var info map[string]json.RawMessage
+	if c.Err = getJSON(base+"/object_info", &info); c.Err != nil {
+		return c
+	}
+	c.Nodes = make(map[string]map[string]bool, len(info))
+	for class, raw := range info {
+		c.Nodes[class] = nodeModelFiles(raw)
+	}
+
+	var stats struct {
+		Devices []struct {
+			VramTotal int64 `json:"vram_total"`
+			VramFree  int64 `json:"vram_free"`
+		} `json:"devices"`
+	}
+	if c.Err = getJSON(base+"/system_stats", &stats); c.Err != nil {
+		return c
+	}
+	if len(stats.Devices) > 0 {
+		c.VramTotal, c.VramFree = stats.Devices[0].VramTotal, stats.Devices[0].VramFree
+	}
+
+	var queue struct {
+		Running []json.RawMessage `json:"queue_running"`
+		Pending []json.RawMessage `json:"queue_pending"`
+	}
+	if c.Err = getJSON(base+"/queue", &queue); c.Err != nil {
+		return c
+	}
+	c.Running, c.Pending = len(queue.Running), len(queue.Pending)
+	return c
+}
+
+// nodeModelFiles returns the model files offered by the choices of a node's inputs. A node whose
+// inputs can't be read still counts as installed.
+func nodeModelFiles(raw json.RawMessage) map[string]bool {
+	var node struct {
+		Input struct {
+			Required map[string][]json.RawMessage `json:"required"`
+			Optional map[string][]json.RawMessage `json:"optional"`
+		} `json:"input"`
+	}
+	files := make(map[string]bool)
+	if err := json.Unmarshal(raw, &node); err != nil {
+		return files
+	}
+	for _, inputs := range []map[string][]json.RawMessage{node.Input.Required, node.Input.Optional} {
+		for _, spec := range inputs {
+			if len(spec) == 0 {
+				continue
+			}
+			values, err := comboValues(spec)
+			if err != nil {
+				continue
+			}
+			for _, value := range values {
+				if isModelFile(value) {
+					files[modelPath(value)] = true
+				}
+			}
+		}
+	}
+	return files
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := apiClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed with status: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("could not decode %s: %w", url, err)
+	}
+	return nil
+}
@@ -2,43 +2,141 @@ package comfyui
 
 import (
 	"aibird/birdbase"
+	"aibird/http/fetch"
 	"aibird/irc/state"
 	"aibird/logger"
 	"aibird/settings"
 	"aibird/text/gemini"
+	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"aibird/shared/meta"
 
 	"github.com/richinsley/comfy2go/client"
+	"github.com/richinsley/comfy2go/graphapi"
 	"github.com/schollz/progressbar/v3"
 )
 
-// Define a local struct for status.AibirdMeta
-// Only the fields needed for access/routing
+// getBackendAddress searches for a backend by name in the ComfyUiConfig.
+// An empty name selects the first configured port. It returns the address, the port
+// and a boolean indicating if it was found.
+func getBackendAddress(config settings.ComfyUiConfig, name meta.Backend) (string, int, bool) {
+	for _, p := range config.Ports {
+		if name == "" || p.Name == string(name) {
+			if p.Url != "" {
+				return p.Url, p.Port, true
+			}
+			return config.Url, p.Port, true
+		}
+	}
+	return "", 0, false
+}
 
-type StatusAibirdMeta struct {
-	AccessLevel int
-	BigModel    bool
+// ErrCancelled is returned by Process when its context is cancelled, e.g. by !cancel or !removecurrent
+var ErrCancelled = errors.New("🛑 Your request was cancelled")
+
+// ErrTimeout is wrapped by the error Process returns when a prompt never starts within its timeout,
+// though the backend doesn't have it waiting in its queue
+var ErrTimeout = errors.New("⏱️ ComfyUI stopped responding")
+
+// ErrStalled is wrapped by the error Process returns when a generation that had started goes without
+// progress for its timeout. Unlike ErrTimeout it is not retried elsewhere, the job would start over.
+var ErrStalled = errors.New("⏱️ ComfyUI stopped making progress")
+
+// DefaultTimeout is how long a generation may go without progress when neither the workflow nor
+// comfyui.timeout set one
+const DefaultTimeout = 5 * time.Minute
+
+// maxLyricsBytes is the largest lyrics file a lyrics parameter will download
+const maxLyricsBytes = 64 << 10
+
+// apiClient is used for ComfyUI's small control endpoints so a hung backend can't hold up the caller
+var apiClient = &http.Client{Timeout: 30 * time.Second}
+
+// WorkflowTimeout returns how long a workflow may go without progress, its own timeout wins over
+// comfyui.timeout
+func WorkflowTimeout(metaData *AibirdMeta, config settings.ComfyUiConfig) time.Duration {
+	switch {
+	case metaData != nil && metaData.Timeout > 0:
+		return time.Duration(metaData.Timeout) * time.Second
+	case config.Timeout > 0:
+		return time.Duration(config.Timeout) * time.Second
+	default:
+		return DefaultTimeout
+	}
 }
 
-// getPortByName searches for a port by name in the ComfyUiConfig.
-// It returns the port string and a boolean indicating if it was found.
-func getPortByName(config settings.ComfyUiConfig, name string) (int, bool) {
-	for _, p := range config.Ports {
-		if p.Name == name {
-			return p.Port, true
+// promptPending reports whether the prompt is still waiting in the backend's queue, false if the
+// backend can't say
+func promptPending(clientAddr string, clientPort int, promptID string) bool {
+	var queue struct {
+		Pending [][]json.RawMessage `json:"queue_pending"`
+	}
+	if err := getJSON(fmt.Sprintf("http://%s:%d/queue", clientAddr, clientPort), &queue); err != nil {
+		logger.Warn("Could not check the ComfyUI queue", "prompt_id", promptID, "error", err)
+		return false
+	}
+	for _, entry := range queue.Pending {
+		var id string
+		if len(entry) > 1 && json.Unmarshal(entry[1], &id) == nil && id == promptID {
+			return true
 		}
 	}
-	return 0, false
+	return false
+}
+
+// deleteQueuedPrompt removes a prompt from ComfyUI's pending queue
+func deleteQueuedPrompt(clientAddr string, clientPort int, promptID string) error {
+	url := fmt.Sprintf("http://%s:%d/queue", clientAddr, clientPort)
+	body := fmt.Sprintf(`{"delete": [%q]}`, promptID)
+
+	resp, err := apiClient.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not send queue delete request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("queue delete request failed with status: %s", resp.Status)
+	}
+	return nil
+}
+
+// cancelPrompt stops a prompt whether it is still waiting in ComfyUI's queue or already running,
+// then removes it from the history
+func cancelPrompt(c *client.ComfyClient, clientAddr string, clientPort int, promptID string) {
+	if err := deleteQueuedPrompt(clientAddr, clientPort, promptID); err != nil {
+		logger.Error("Error deleting prompt from ComfyUI queue", "prompt_id", promptID, "error", err)
+	}
+	if err := c.Interrupt(); err != nil {
+		logger.Error("Error interrupting ComfyUI", "prompt_id", promptID, "error", err)
+	}
+	if err := c.EraseHistoryItem(promptID); err != nil {
+		logger.Error("Error erasing ComfyUI history item", "prompt_id", promptID, "error", err)
+	}
+	logger.Info("Cancelled ComfyUI prompt", "prompt_id", promptID, "address", clientAddr, "port", clientPort)
+}
+
+// FreeVram unloads every model from the backend and frees its memory. The queue decides when for its
+// jobs, by the backend's vramPolicy, and Process frees after every run outside the queue.
+func FreeVram(config settings.ComfyUiConfig, backend meta.Backend) error {
+	clientAddr, clientPort, found := getBackendAddress(config, backend)
+	if !found {
+		return fmt.Errorf("ComfyUI backend %q is not configured", backend)
+	}
+	return freeVram(clientAddr, clientPort)
 }
 
 func freeVram(clientAddr string, clientPort int) error {
@@ -54,7 +152,7 @@ func freeVram(clientAddr string, clientPort int) error {
 	req.Body = io.NopCloser(strings.NewReader(body))
 	req.ContentLength = int64(len(body))
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := apiClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("could not send free request: %w", err)
 	}
@@ -64,337 +162,524 @@ func freeVram(clientAddr string, clientPort int) error {
 		return fmt.Errorf("free request failed with status: %s", resp.Status)
 	}
 
-	logger.Info("Successfully sent free VRAM request to ComfyUI")
+	logger.Info("Successfully sent free VRAM request to ComfyUI", "address", clientAddr, "port", clientPort)
 	return nil
 }
 
-func Process(irc state.State, aiEnhancedPrompt string, gpu meta.GPUType) (string, error) {
-	logger.Debug("Starting comfyui.Process", "gpu", gpu, "action", irc.Action())
-	comfyUiConfig := irc.Config.ComfyUi
-	model := irc.Action()
-	workflowFile := "comfyuijson/" + model + ".json"
-	metaData, err := GetAibirdMeta(workflowFile)
-	if err == nil {
-		logger.Info("Using V2 metadata-driven processing", "model", model)
-		if irc.User.GetAccessLevel() < metaData.AccessLevel {
-			logger.Error("Access level too low", "required", metaData.AccessLevel, "user", irc.User.GetAccessLevel())
-			return "", fmt.Errorf("⛔️ Sorry, you need access level %d to use this command. Check !support for more info", metaData.AccessLevel)
+// update is a value the parameter engine writes to a target, in either workflow format
+type update struct {
+	target Target
+	value  interface{}
+}
+
+// buildGraph loads a workflow as a graph comfy2go can queue and writes the updates into it
+func buildGraph(c *client.ComfyClient, workflow *Workflow, metaData *AibirdMeta, updates []update) (*graphapi.Graph, error) {
+	if workflow.Format == FormatAPI {
+		var prompt apiPrompt
+		if err := json.Unmarshal(workflow.Data, &prompt); err != nil {
+			return nil, fmt.Errorf("error loading API format JSON: %w", err)
 		}
-		var clientPort int
-		var portFound bool
-		if gpu == meta.GPU4090 {
-			clientPort, portFound = getPortByName(comfyUiConfig, "4090")
-		} else {
-			clientPort, portFound = getPortByName(comfyUiConfig, "2070")
+		prompt.apply(updates, metaData.PromptTarget)
+		return prompt.graph()
+	}
+
+	graph, _, err := c.NewGraphFromJsonReader(bytes.NewReader(workflow.Data))
+	if err != nil {
+		return nil, fmt.Errorf("error loading graph JSON: %w", err)
+	}
+
+	widgetUpdates := make(map[string]map[int]interface{})
+	for _, u := range updates {
+		if _, ok := widgetUpdates[u.target.Node]; !ok {
+			widgetUpdates[u.target.Node] = make(map[int]interface{})
 		}
-		if !portFound {
-			if len(comfyUiConfig.Ports) > 0 {
-				clientPort = comfyUiConfig.Ports[0].Port
-				portFound = true
-			}
+		widgetUpdates[u.target.Node][u.target.WidgetIndex] = u.value
+	}
+
+	// Get only the nodes in the "API" group
+	apiNodes := graph.GetNodesInGroup(graph.GetGroupWithTitle("API"))
+
+	// Apply the updates to the graph nodes
+	for _, node := range apiNodes {
+		nodeUpdates, typeExists := widgetUpdates[node.Type]
+		if !typeExists {
+			nodeUpdates = widgetUpdates[node.Title]
 		}
-		if !portFound {
-			logger.Error("No ComfyUI ports configured")
-			return "", errors.New("no ComfyUI ports configured")
+
+		if typeExists || (nodeUpdates != nil) {
+			if values, ok := node.WidgetValues.([]interface{}); ok {
+				for widgetIndex, value := range nodeUpdates {
+					if widgetIndex < len(values) {
+						// Special handling for the original prompt which might be a concatenation
+						if (node.Title == metaData.PromptTarget.Node || node.Type == metaData.PromptTarget.Node) && widgetIndex == metaData.PromptTarget.WidgetIndex {
+							if originalPrompt, ok := values[widgetIndex].(string); ok && originalPrompt != "" {
+								values[widgetIndex] = originalPrompt + " " + value.(string)
+							} else {
+								values[widgetIndex] = value
+							}
+						} else {
+							values[widgetIndex] = value
+						}
+						logger.Debug("Set widget value", "widget", widgetIndex, "node", node.Title, "type", node.Type, "value", value)
+					}
+				}
+			}
 		}
-		clientAddr := comfyUiConfig.Url
+	}
+
+	return graph, nil
+}
+
+// Process runs the workflow for the command and downloads every file it outputs. The files are
+// returned in the order ComfyUI produced them and are the caller's to remove, along with the record
+// of the generation that is saved so it can be run again.
+func Process(ctx context.Context, irc state.State, aiEnhancedPrompt string, backend meta.Backend) ([]string, *Generation, error) {
+	logger.Debug("Starting comfyui.Process", "backend", backend, "action", irc.Action())
+	model := irc.Action()
+	workflow, ok := Workflows.Get(model)
+	if !ok {
+		return nil, nil, fmt.Errorf("no workflow named %s", model)
+	}
+	if workflow.Err != nil {
+		logger.Error("Failed to load workflow metadata", "error", workflow.Err)
+		return nil, nil, fmt.Errorf("failed to process workflow metadata for %s: %w", model, workflow.Err)
+	}
+
+	// The queue applies the backend's vramPolicy to its own jobs, a run outside it frees once it's done
+	if backend == "" {
 		defer func() {
-			if err := freeVram(clientAddr, clientPort); err != nil {
+			if err := FreeVram(irc.Config.ComfyUi, backend); err != nil {
 				logger.Error("Error freeing VRAM", "error", err)
 			}
 		}()
-		var message string
-		if !irc.IsAction("tts") {
-			message = CleanPrompt(irc.Message())
-		} else {
-			message = irc.Message()
-		}
-		if BadWordsCheck(message, comfyUiConfig) {
-			message = comfyUiConfig.BadWordsPrompt
+	}
+
+	generation := newGeneration(irc, aiEnhancedPrompt, backend)
+	var outputs []string
+	var err error
+	if len(workflow.Meta.Pipeline) > 0 {
+		outputs, err = runPipeline(ctx, irc, workflow, aiEnhancedPrompt, backend, generation)
+	} else {
+		outputs, err = process(ctx, irc, aiEnhancedPrompt, backend, run{workflow: workflow}, generation)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Example of a post-generation action, can be made generic later
+	if strings.Contains(model, "wan") && irc.User.GetAccessLevel() <= 2 {
+		cacheKey := fmt.Sprintf("img2wan_%s", irc.User.NickName)
+		err := birdbase.PutStringExpireSeconds(cacheKey, "1", 60*60*3)
+		if err != nil {
+			logger.Error("Failed to set cache key", "error", err)
 		}
-		if aiEnhancedPrompt != "" {
-			message = aiEnhancedPrompt
+	}
+
+	if err := generation.Save(); err != nil {
+		logger.Error("Failed to save generation", "id", generation.ID, "error", err)
+	}
+
+	logger.Debug("Finishing comfyui.Process", "backend", backend, "action", irc.Action(), "outputs", len(outputs))
+	return outputs, generation, nil
+}
+
+// run is one run of a workflow, on its own or as a stage of a pipeline
+type run struct {
+	workflow *Workflow
+	inputs   map[string]string // parameters given a file output by the stage before
+	seed     *int64            // replaces the seed parameter, pipelines derive every stage's seed from one
+	stage    string            // put in front of node titles in progress reports
+	prefix   string            // put in front of parameter names in the generation record
+}
+
+// process runs one workflow on the backend and returns the files it output
+func process(ctx context.Context, irc state.State, aiEnhancedPrompt string, backend meta.Backend, r run, generation *Generation) ([]string, error) {
+	comfyUiConfig := irc.Config.ComfyUi
+	workflow, metaData, model := r.workflow, r.workflow.Meta, r.workflow.Name
+	logger.Info("Using V2 metadata-driven processing", "model", model)
+	if irc.User.GetAccessLevel() < metaData.AccessLevel {
+		logger.Error("Access level too low", "required", metaData.AccessLevel, "user", irc.User.GetAccessLevel())
+		return nil, fmt.Errorf("⛔️ Sorry, you need access level %d to use this command. Check !support for more info", metaData.AccessLevel)
+	}
+	message, err := FilterPrompt(irc, irc.Message())
+	if err != nil {
+		return nil, err
+	}
+	clientAddr, clientPort, found := getBackendAddress(comfyUiConfig, backend)
+	if !found {
+		logger.Error("ComfyUI backend is not configured", "backend", backend)
+		return nil, fmt.Errorf("ComfyUI backend %q is not configured", backend)
+	}
+	if aiEnhancedPrompt != "" {
+		message = aiEnhancedPrompt
+	}
+
+	// The values to write into the workflow, in order so later ones win
+	var updates []update
+
+	// --- Process Prompt ---
+	if metaData.PromptTarget.Node != "" {
+		updates = append(updates, update{target: Target(metaData.PromptTarget), value: message})
+	}
+
+	// --ar and --size become the width and height, stages of a pipeline without them leave it to the others
+	sized, err := stageSizeArguments(irc, metaData, r.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// --- Generic Parameter Processing ---
+	for paramName, paramDef := range metaData.Parameters {
+		// A file output by the stage before goes in whatever the user gave
+		if file, ok := r.inputs[paramName]; ok {
+			input, err := readInput(paramName, file)
+			if err != nil {
+				return nil, err
+			}
+			for _, target := range paramDef.Targets {
+				updates = append(updates, update{target: target, value: input})
+			}
+			continue
 		}
 
-		// Create a map to hold the widget values that need to be updated
-		widgetUpdates := make(map[string]map[int]interface{})
+		// A flag given without a value, like --upscale, is true
+		rawArgument := irc.FindArgument(paramName, "")
+		rawUserInput, _ := rawArgument.(string)
+		if value, ok := sized[paramName]; ok {
+			rawUserInput = value
+		}
+		if flag, ok := rawArgument.(bool); ok && flag {
+			if paramDef.Type != "bool" {
+				return nil, fmt.Errorf("⚠️ --%s needs a value, like --%s=value", paramName, paramName)
+			}
+			rawUserInput = "true"
+		}
+		userInputProvided := rawUserInput != ""
 
-		// --- Process Prompt ---
-		if metaData.PromptTarget.Node != "" {
-			if _, ok := widgetUpdates[metaData.PromptTarget.Node]; !ok {
-				widgetUpdates[metaData.PromptTarget.Node] = make(map[int]interface{})
+		// Special pre-flight check for image URLs to give users faster feedback, image parameters are downloaded instead
+		if paramName == "img" && userInputProvided && paramDef.Type != "image" {
+			logger.Debug("Performing pre-flight check for image URL", "url", rawUserInput)
+			if _, err := fetch.Head(ctx, rawUserInput, 0); err != nil {
+				return nil, fmt.Errorf("⚠️ The image URL for --img can't be used: %v. Please check the link.", err)
 			}
-			widgetUpdates[metaData.PromptTarget.Node][metaData.PromptTarget.WidgetIndex] = message
 		}
 
-		// --- Generic Parameter Processing ---
-		for paramName, paramDef := range metaData.Parameters {
-			rawUserInput := irc.FindArgument(paramName, "").(string)
-			userInputProvided := rawUserInput != ""
-
-			// Special pre-flight check for image URLs to give users faster feedback
-			if paramName == "img" && userInputProvided {
-				// Validate URL to prevent SSRF attacks
-				if !strings.HasPrefix(rawUserInput, "http://") && !strings.HasPrefix(rawUserInput, "https://") {
-					errMsg := fmt.Sprintf("⚠️ Invalid URL scheme for --img: %s", rawUserInput)
-					return "", errors.New(errMsg)
-				}
+		var finalValue interface{}
 
-				logger.Debug("Performing pre-flight check for image URL", "url", rawUserInput)
-				resp, err := http.Head(rawUserInput)
-				if err != nil {
-					errMsg := fmt.Sprintf("⚠️ Failed to reach the image URL for --img: %v", err)
-					return "", errors.New(errMsg)
+		if !userInputProvided {
+			finalValue = paramDef.Default
+		} else {
+			var parseErr error
+			switch paramDef.Type {
+			case "string":
+				finalValue = rawUserInput
+			case "int":
+				val, parseErr := strconv.ParseInt(rawUserInput, 10, 64)
+				if parseErr == nil {
+					finalValue = val
+					// Perform validation
+					if paramDef.Min != nil && float64(val) < *paramDef.Min {
+						errMsg := fmt.Sprintf("⚠️ Value for --%s is too low. Minimum is %g, but you gave %d.", paramName, *paramDef.Min, val)
+						return nil, errors.New(errMsg)
+					}
+					if paramDef.Max != nil && float64(val) > *paramDef.Max {
+						errMsg := fmt.Sprintf("⚠️ Value for --%s is too high. Maximum is %g, but you gave %d.", paramName, *paramDef.Max, val)
+						return nil, errors.New(errMsg)
+					}
 				}
-				resp.Body.Close()
-				if resp.StatusCode != http.StatusOK {
-					errMsg := fmt.Sprintf("⚠️ The image URL for --img appears to be invalid (server response: %s). Please check the link.", resp.Status)
-					return "", errors.New(errMsg)
+			case "float":
+				val, parseErr := strconv.ParseFloat(rawUserInput, 64)
+				if parseErr == nil {
+					finalValue = val
+					// Perform validation
+					if paramDef.Min != nil && val < *paramDef.Min {
+						errMsg := fmt.Sprintf("⚠️ Value for --%s is too low. Minimum is %g, but you gave %g.", paramName, *paramDef.Min, val)
+						return nil, errors.New(errMsg)
+					}
+					if paramDef.Max != nil && val > *paramDef.Max {
+						errMsg := fmt.Sprintf("⚠️ Value for --%s is too high. Maximum is %g, but you gave %g.", paramName, *paramDef.Max, val)
+						return nil, errors.New(errMsg)
+					}
 				}
-				logger.Debug("Image URL check passed", "status", resp.Status)
-			}
-
-			var finalValue interface{}
-
-			if !userInputProvided {
-				finalValue = paramDef.Default
-			} else {
-				var parseErr error
-				switch paramDef.Type {
-				case "string":
-					finalValue = rawUserInput
-				case "int":
-					val, parseErr := strconv.ParseInt(rawUserInput, 10, 64)
-					if parseErr == nil {
-						finalValue = val
-						// Perform validation
-						if paramDef.Min != nil && float64(val) < *paramDef.Min {
-							errMsg := fmt.Sprintf("⚠️ Value for --%s is too low. Minimum is %g, but you gave %d.", paramName, *paramDef.Min, val)
-							return "", errors.New(errMsg)
-						}
-						if paramDef.Max != nil && float64(val) > *paramDef.Max {
-							errMsg := fmt.Sprintf("⚠️ Value for --%s is too high. Maximum is %g, but you gave %d.", paramName, *paramDef.Max, val)
-							return "", errors.New(errMsg)
-						}
+			case "lyrics":
+				lyricsPrompt := rawUserInput
+				var lyrics string
+				var lyErr error
+				if lyricsPrompt == "" {
+					if paramDef.Default != nil {
+						lyrics = paramDef.Default.(string)
+					} else {
+						lyrics = ""
 					}
-				case "float":
-					val, parseErr := strconv.ParseFloat(rawUserInput, 64)
-					if parseErr == nil {
-						finalValue = val
-						// Perform validation
-						if paramDef.Min != nil && val < *paramDef.Min {
-							errMsg := fmt.Sprintf("⚠️ Value for --%s is too low. Minimum is %g, but you gave %g.", paramName, *paramDef.Min, val)
-							return "", errors.New(errMsg)
+				} else {
+					if strings.HasPrefix(lyricsPrompt, "http") && strings.HasSuffix(lyricsPrompt, ".txt") {
+						irc.Send("📜 Downloading lyrics from URL! ✨")
+						file, fetchErr := fetch.Fetch(ctx, lyricsPrompt, fetch.Options{ContentTypes: []string{"text/plain"}, MaxBytes: maxLyricsBytes})
+						if fetchErr != nil {
+							return nil, fmt.Errorf("failed to download lyrics from URL: %w", fetchErr)
 						}
-						if paramDef.Max != nil && val > *paramDef.Max {
-							errMsg := fmt.Sprintf("⚠️ Value for --%s is too high. Maximum is %g, but you gave %g.", paramName, *paramDef.Max, val)
-							return "", errors.New(errMsg)
-						}
-					}
-				case "lyrics":
-					lyricsPrompt := rawUserInput
-					var lyrics string
-					var lyErr error
-					if lyricsPrompt == "" {
-						if paramDef.Default != nil {
-							lyrics = paramDef.Default.(string)
-						} else {
-							lyrics = ""
+						bodyBytes, ioErr := os.ReadFile(file.Path)
+						os.Remove(file.Path)
+						if ioErr != nil {
+							return nil, fmt.Errorf("failed to read the downloaded lyrics: %w", ioErr)
 						}
+						lyrics = string(bodyBytes)
 					} else {
-						if strings.HasPrefix(lyricsPrompt, "http") && strings.HasSuffix(lyricsPrompt, ".txt") {
-							irc.Send("📜 Downloading lyrics from URL! ✨")
-							resp, httpErr := http.Get(lyricsPrompt)
-							if httpErr != nil {
-								return "", fmt.Errorf("failed to download lyrics from URL: %w", httpErr)
-							}
-							defer resp.Body.Close()
-
-							if resp.StatusCode != http.StatusOK {
-								return "", fmt.Errorf("failed to download lyrics from URL: status code %d", resp.StatusCode)
-							}
-
-							bodyBytes, ioErr := io.ReadAll(resp.Body)
-							if ioErr != nil {
-								return "", fmt.Errorf("failed to read lyrics from response body: %w", ioErr)
-							}
-							lyrics = string(bodyBytes)
-						} else {
-							irc.Send("✍️ Generating lyrics with ai! ✨")
-							lyrics, lyErr = gemini.GenerateLyrics(lyricsPrompt, irc.Config.Gemini)
-							if lyErr != nil {
-								return "", fmt.Errorf("failed to generate lyrics: %w", lyErr)
-							}
+						irc.Send("✍️ Generating lyrics with ai! ✨")
+						lyrics, lyErr = gemini.GenerateLyrics(lyricsPrompt, irc.Config.Gemini)
+						if lyErr != nil {
+							return nil, fmt.Errorf("failed to generate lyrics: %w", lyErr)
 						}
 					}
-					finalValue = lyrics
-					parseErr = nil
-				default:
-					return "", fmt.Errorf("unsupported parameter type '%s' in metadata for '%s'", paramDef.Type, paramName)
 				}
+				finalValue = lyrics
+				parseErr = nil
+			case "enum":
+				value, ok := matchValue(rawUserInput, paramDef.Values)
+				if !ok {
+					return nil, fmt.Errorf("⚠️ Invalid value for --%s. Choose one of: %s", paramName, strings.Join(paramDef.Values, ", "))
+				}
+				finalValue = value
+			case "bool":
+				finalValue, parseErr = parseBool(rawUserInput)
+			case "image", "audio":
+				finalValue, parseErr = downloadInput(ctx, paramName, paramDef.Type, rawUserInput)
 				if parseErr != nil {
-					errMsg := fmt.Sprintf("⚠️ Invalid value for --%s. Expected a %s, but got '%s'.", paramName, paramDef.Type, rawUserInput)
-					return "", errors.New(errMsg) // also return error to stop processing
+					return nil, parseErr
 				}
-			}
-
-			// Handle special case for seed randomization
-			if paramName == "seed" && !userInputProvided {
-				// Use crypto/rand for secure random number generation
-				seed, err := rand.Int(rand.Reader, big.NewInt(1<<63-1))
+			case "comfy_list":
+				values, err := objectInfoValues(clientAddr, clientPort, paramDef.Source)
 				if err != nil {
-					return "", fmt.Errorf("failed to generate random seed: %w", err)
+					return nil, fmt.Errorf("could not check --%s against the backend: %w", paramName, err)
 				}
-				finalValue = seed.Int64()
-			}
-
-			// Handle special case for voice filename to add .wav suffix
-			if paramName == "voice" {
-				if voiceStr, ok := finalValue.(string); ok && !strings.HasSuffix(voiceStr, ".wav") {
-					finalValue = voiceStr + ".wav"
+				value, ok := matchValue(rawUserInput, values)
+				if !ok {
+					return nil, fmt.Errorf("⚠️ %s is not available for --%s. Choose one of: %s", rawUserInput, paramName, listValues(values, maxListedValues))
 				}
+				finalValue = value
+			default:
+				return nil, fmt.Errorf("unsupported parameter type '%s' in metadata for '%s'", paramDef.Type, paramName)
 			}
-
-			// Apply value to all targets, if a value was determined
-			if finalValue != nil {
-				for _, target := range paramDef.Targets {
-					if _, ok := widgetUpdates[target.Node]; !ok {
-						widgetUpdates[target.Node] = make(map[int]interface{})
-					}
-					logger.Debug("Setting parameter", "param", paramName, "node", target.Node, "widget", target.WidgetIndex, "value", finalValue)
-					widgetUpdates[target.Node][target.WidgetIndex] = finalValue
-				}
+			if parseErr != nil {
+				errMsg := fmt.Sprintf("⚠️ Invalid value for --%s. Expected a %s, but got '%s'.", paramName, paramDef.Type, rawUserInput)
+				return nil, errors.New(errMsg) // also return error to stop processing
 			}
 		}
 
-		// --- Process Hardcoded Values ---
-		for paramName, hardcodedDef := range metaData.Hardcoded {
-			finalValue := hardcodedDef.Value
-			if finalValue != nil {
-				for _, target := range hardcodedDef.Targets {
-					if _, ok := widgetUpdates[target.Node]; !ok {
-						widgetUpdates[target.Node] = make(map[int]interface{})
-					}
-					logger.Debug("Setting hardcoded parameter", "param", paramName, "node", target.Node, "widget", target.WidgetIndex, "value", finalValue)
-					widgetUpdates[target.Node][target.WidgetIndex] = finalValue
-				}
+		// Handle special case for seed randomization
+		if paramName == "seed" && !userInputProvided {
+			// Use crypto/rand for secure random number generation
+			seed, err := rand.Int(rand.Reader, big.NewInt(1<<63-1))
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate random seed: %w", err)
 			}
+			finalValue = seed.Int64()
+		}
+		if paramName == "seed" && r.seed != nil {
+			finalValue = *r.seed
 		}
 
-		// Create ComfyUI client
-		c := client.NewComfyClient(clientAddr, clientPort, nil)
-		if !c.IsInitialized() {
-			if err := c.Init(); err != nil {
-				return "", fmt.Errorf("error initializing client: %w", err)
+		// Handle special case for voice filename to add .wav suffix
+		if paramName == "voice" {
+			if voiceStr, ok := finalValue.(string); ok && !strings.HasSuffix(voiceStr, ".wav") {
+				finalValue = voiceStr + ".wav"
 			}
 		}
 
-		// Load the workflow graph
-		graph, _, err := c.NewGraphFromJsonFile(workflowFile)
-		if err != nil {
-			return "", fmt.Errorf("error loading graph JSON: %w", err)
+		// Record the value, images by their URL rather than the downloaded file
+		if paramName == "seed" && r.seed == nil {
+			if seed, ok := finalValue.(int64); ok {
+				generation.Seed = &seed
+			}
+		}
+		if _, ok := finalValue.(*inputUpload); ok {
+			generation.Parameters[r.prefix+paramName] = rawUserInput
+		} else if finalValue != nil {
+			generation.Parameters[r.prefix+paramName] = fmt.Sprint(finalValue)
 		}
 
-		// Get only the nodes in the "API" group
-		apiNodes := graph.GetNodesInGroup(graph.GetGroupWithTitle("API"))
-
-		// Apply the updates to the graph nodes
-		for _, node := range apiNodes {
-			updates, typeExists := widgetUpdates[node.Type]
-			if !typeExists {
-				updates = widgetUpdates[node.Title]
+		// Apply value to all targets, if a value was determined
+		if finalValue != nil {
+			for _, target := range paramDef.Targets {
+				logger.Debug("Setting parameter", "param", paramName, "node", target.Node, "widget", target.WidgetIndex, "input", target.Input, "value", finalValue)
+				updates = append(updates, update{target: target, value: finalValue})
 			}
+		}
+	}
 
-			if typeExists || (updates != nil) {
-				if values, ok := node.WidgetValues.([]interface{}); ok {
-					for widgetIndex, value := range updates {
-						if widgetIndex < len(values) {
-							// Special handling for the original prompt which might be a concatenation
-							if (node.Title == metaData.PromptTarget.Node || node.Type == metaData.PromptTarget.Node) && widgetIndex == metaData.PromptTarget.WidgetIndex {
-								if originalPrompt, ok := values[widgetIndex].(string); ok && originalPrompt != "" {
-									values[widgetIndex] = originalPrompt + " " + value.(string)
-								} else {
-									values[widgetIndex] = value
-								}
-							} else {
-								values[widgetIndex] = value
-							}
-							logger.Debug("Set widget value", "widget", widgetIndex, "node", node.Title, "type", node.Type, "value", value)
-						}
-					}
-				}
+	// --- Process Hardcoded Values ---
+	for paramName, hardcodedDef := range metaData.Hardcoded {
+		finalValue := hardcodedDef.Value
+		if finalValue != nil {
+			for _, target := range hardcodedDef.Targets {
+				logger.Debug("Setting hardcoded parameter", "param", paramName, "node", target.Node, "widget", target.WidgetIndex, "input", target.Input, "value", finalValue)
+				updates = append(updates, update{target: target, value: finalValue})
 			}
 		}
+	}
 
-		// Queue the prompt
-		item, err := c.QueuePrompt(graph)
-		if err != nil {
-			return "", fmt.Errorf("failed to queue prompt: %w", err)
+	// Create ComfyUI client
+	c := client.NewComfyClient(clientAddr, clientPort, nil)
+	if !c.IsInitialized() {
+		if err := c.Init(); err != nil {
+			return nil, transient(fmt.Errorf("error initializing client: %w", err))
 		}
+	}
 
-		// --- Handle Queue and Get Result ---
-		var bar *progressbar.ProgressBar = nil
-		var currentNodeTitle string
-		for continueLoop := true; continueLoop; {
-			msg := <-item.Messages
-			switch msg.Type {
-			case "started":
-				qm := msg.ToPromptMessageStarted()
-				logger.Info("Start executing prompt", "prompt_id", qm.PromptID)
-			case "executing":
-				bar = nil
-				qm := msg.ToPromptMessageExecuting()
-				currentNodeTitle = qm.Title
-				logger.Debug("Executing node", "node_id", qm.NodeID)
-			case "progress":
-				qm := msg.ToPromptMessageProgress()
-				if bar == nil {
-					bar = progressbar.Default(int64(qm.Max), currentNodeTitle)
-				}
-				bar.Set(qm.Value)
-			case "stopped":
-				qm := msg.ToPromptMessageStopped()
-				if qm.Exception != nil {
-					return "", fmt.Errorf("execution stopped with exception: %s: %s", qm.Exception.ExceptionType, qm.Exception.ExceptionMessage)
-				}
-				continueLoop = false
-			case "data":
-				qm := msg.ToPromptMessageData()
-				for k, v := range qm.Data {
-					if k == "images" || k == "gifs" || k == "audio" {
-						for _, output := range v {
-							img_data, err := c.GetImage(output)
-							if err != nil {
-								return "", fmt.Errorf("failed to get image: %w", err)
-							}
-							f, err := os.Create(output.Filename)
-							if err != nil {
-								return "", fmt.Errorf("failed to write image: %w", err)
-							}
-							f.Write(*img_data)
-							f.Close()
-
-							// Example of a post-generation action, can be made generic later
-							if strings.Contains(model, "wan") && irc.User.GetAccessLevel() <= 2 {
-								cacheKey := fmt.Sprintf("img2wan_%s", irc.User.NickName)
-								err := birdbase.PutStringExpireSeconds(cacheKey, "1", 60*60*3)
-								if err != nil {
-									logger.Error("Failed to set cache key", "error", err)
-								}
-							}
+	// Files are only pushed to the backend once it is known to be up
+	if err := uploadInputs(c, updates); err != nil {
+		return nil, err
+	}
+
+	// Load the workflow with the values written in
+	graph, err := buildGraph(c, workflow, metaData, updates)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't start anything on the GPU if the request was cancelled while being prepared
+	if ctx.Err() != nil {
+		return nil, ErrCancelled
+	}
+
+	// Queue the prompt
+	item, err := c.QueuePrompt(graph)
+	if err != nil {
+		return nil, transient(fmt.Errorf("failed to queue prompt: %w", err))
+	}
+
+	// The watchdog stops generations that go quiet, e.g. after a websocket drop or a crashed custom
+	// node. Every message about the prompt resets it, and it waits on while the prompt is still in the
+	// backend's own queue behind prompts that aren't ours, so long jobs that keep progressing run on.
+	timeout := WorkflowTimeout(metaData, comfyUiConfig)
+	watchdog := time.NewTimer(timeout)
+	defer watchdog.Stop()
+	started := false
+
+	// --- Handle Queue and Get Result ---
+	var bar *progressbar.ProgressBar = nil
+	var currentNodeTitle string
+	var outputs, previews []string
+	removeAll := func() {
+		for _, file := range append(outputs, previews...) {
+			os.Remove(file)
+		}
+	}
+	for continueLoop := true; continueLoop; {
+		var msg client.PromptMessage
+		select {
+		case <-ctx.Done():
+			cancelPrompt(c, clientAddr, clientPort, item.PromptID)
+			removeAll()
+			return nil, ErrCancelled
+		case <-watchdog.C:
+			if !started && promptPending(clientAddr, clientPort, item.PromptID) {
+				watchdog.Reset(timeout)
+				continue
+			}
+			logger.Warn("ComfyUI prompt timed out", "prompt_id", item.PromptID, "backend", backend, "timeout", timeout, "started", started)
+			// The backend may not answer at all, interrupt it in the background so the queue can move on
+			go cancelPrompt(c, clientAddr, clientPort, item.PromptID)
+			removeAll()
+			if started {
+				return nil, fmt.Errorf("%w for %s, your request was stopped", ErrStalled, timeout)
+			}
+			return nil, fmt.Errorf("%w, your request was stopped after %s", ErrTimeout, timeout)
+		case msg = <-item.Messages:
+		}
+		// Any message means the prompt has left the backend's queue
+		watchdog.Reset(timeout)
+		started = true
+		switch msg.Type {
+		case "started":
+			qm := msg.ToPromptMessageStarted()
+			logger.Info("Start executing prompt", "prompt_id", qm.PromptID)
+		case "executing":
+			bar = nil
+			qm := msg.ToPromptMessageExecuting()
+			currentNodeTitle = qm.Title
+			logger.Debug("Executing node", "node_id", qm.NodeID)
+		case "progress":
+			qm := msg.ToPromptMessageProgress()
+			if bar == nil {
+				bar = progressbar.Default(int64(qm.Max), currentNodeTitle)
+			}
+			bar.Set(qm.Value)
+			meta.ReportProgress(ctx, r.stage+currentNodeTitle, qm.Value, qm.Max)
+		case "stopped":
+			qm := msg.ToPromptMessageStopped()
+			if qm.Exception != nil {
+				removeAll()
+				return nil, stoppedError(qm.Exception)
+			}
+			continueLoop = false
+		case "data":
+			qm := msg.ToPromptMessageData()
+			for k, v := range qm.Data {
+				if k == "images" || k == "gifs" || k == "audio" {
+					for _, output := range v {
+						img_data, err := c.GetImage(output)
+						if err != nil {
+							removeAll()
+							return nil, transient(fmt.Errorf("failed to get image: %w", err))
+						}
+						file, err := writeOutput(output.Filename, *img_data)
+						if err != nil {
+							removeAll()
+							return nil, fmt.Errorf("failed to write image: %w", err)
+						}
 
-							return output.Filename, nil
+						// Preview nodes write temp files, they are only kept when nothing was saved
+						if output.Type == "temp" {
+							previews = append(previews, file)
+						} else {
+							outputs = append(outputs, file)
+						}
+
+						// Cancelled while downloading, the outputs are no longer wanted
+						if ctx.Err() != nil {
+							removeAll()
+							return nil, ErrCancelled
 						}
 					}
 				}
 			}
 		}
+	}
 
-		logger.Debug("Finishing comfyui.Process", "gpu", gpu, "action", irc.Action())
-		return "", errors.New("error processing comfyui: no output file received")
+	if len(outputs) == 0 {
+		outputs, previews = previews, nil
+	} else {
+		for _, file := range previews {
+			os.Remove(file)
+		}
+	}
+	if len(outputs) == 0 {
+		logger.Debug("Finishing comfyui.Process", "backend", backend, "action", irc.Action())
+		return nil, errors.New("error processing comfyui: no output file received")
 	}
+
+	return outputs, nil
+}
+
+// writeOutput saves a file ComfyUI output under a name of its own in the working directory, keeping
+// the extension. ComfyUI's names repeat across backends and subfolders, so jobs running side by side
+// would overwrite each other's files.
+func writeOutput(name string, data []byte) (string, error) {
+	f, err := os.CreateTemp(".", "aibird-*"+filepath.Ext(name))
 	if err != nil {
-		logger.Error("Failed to load workflow metadata", "error", err)
+		return "", err
+	}
+	// A bare name, the uploaders refuse paths
+	file := filepath.Base(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(file)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(file)
+		return "", err
 	}
-	return "", fmt.Errorf("failed to process workflow metadata for %s: %w", model, err)
+	return file, nil
 }
@@ -0,0 +1,45 @@
+package comfyui
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/richinsley/comfy2go/client"
+)
+
+// transientError is a failure of the backend rather than of the request, such as a restarted
+// container, a dropped connection or running out of VRAM. The same job may well work elsewhere.
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string { return e.err.Error() }
+func (e transientError) Unwrap() error { return e.err }
+
+// transient marks err as a backend failure
+func transient(err error) error {
+	return transientError{err: err}
+}
+
+// IsTransient reports whether a Process error came from the backend failing, in which case the job
+// can be retried on another backend. Bad parameters, access levels, cancellations and generations that
+// stalled after starting are not transient.
+func IsTransient(err error) bool {
+	var t transientError
+	return errors.As(err, &t) || errors.Is(err, ErrTimeout)
+}
+
+// outOfMemoryMarkers are found in the type or message of the exceptions torch raises when VRAM runs out
+var outOfMemoryMarkers = []string{"OutOfMemoryError", "out of memory", "Allocation on device"}
+
+// stoppedError turns the exception ComfyUI stopped a prompt with into an error, out of memory is transient
+func stoppedError(exception *client.PromptMessageStoppedException) error {
+	err := fmt.Errorf("execution stopped with exception: %s: %s", exception.ExceptionType, exception.ExceptionMessage)
+	for _, marker := range outOfMemoryMarkers {
+		if strings.Contains(exception.ExceptionType, marker) || strings.Contains(exception.ExceptionMessage, marker) {
+			return transient(err)
+		}
+	}
+	return err
+}
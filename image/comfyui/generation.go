@@ -0,0 +1,143 @@
+package comfyui
+
+import (
+	"aibird/birdbase"
+	"aibird/irc/state"
+	"aibird/shared/meta"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// generationKeyPrefix is followed by the generation ID in birdbase
+const generationKeyPrefix = "generation_"
+
+// GenerationExpiryHours is how long a generation can be run again with !again or !reroll
+const GenerationExpiryHours = 30 * 24
+
+// RerunArgument names the generation a command is a rerun of, its enhanced prompt is reused rather
+// than asking the AI for a new one
+const RerunArgument = "from"
+
+// Generation is everything that went into one generation, so it can be told apart from its
+// neighbours and run again. Seeds are kept as int64 outside of Parameters as JSON would round them.
+type Generation struct {
+	ID             string            `json:"id"`
+	Parent         string            `json:"parent,omitempty"` // the generation this one is a rerun of
+	Workflow       string            `json:"workflow"`
+	Prompt         string            `json:"prompt"` // with its {a|b} options and __name__ wildcards expanded
+	EnhancedPrompt string            `json:"enhancedPrompt,omitempty"`
+	Seed           *int64            `json:"seed,omitempty"`
+	Arguments      []state.Argument  `json:"arguments"`  // every --arg as the user gave it
+	Parameters     map[string]string `json:"parameters"` // every parameter as it was resolved
+	Backend        meta.Backend      `json:"backend"`
+	Network        string            `json:"network"`
+	Nick           string            `json:"nick"`
+	CreatedAt      time.Time         `json:"createdAt"`
+}
+
+// newGeneration starts the record of a generation of the command in irc
+func newGeneration(irc state.State, aiEnhancedPrompt string, backend meta.Backend) *Generation {
+	g := &Generation{
+		ID:             strings.SplitN(uuid.NewString(), "-", 2)[0],
+		Workflow:       irc.Action(),
+		Prompt:         irc.Message(),
+		EnhancedPrompt: aiEnhancedPrompt,
+		Parameters:     make(map[string]string),
+		Backend:        backend,
+		CreatedAt:      time.Now(),
+	}
+	for _, arg := range irc.Arguments {
+		if arg.Key == RerunArgument {
+			g.Parent, _ = arg.Value.(string)
+			continue
+		}
+		g.Arguments = append(g.Arguments, arg)
+	}
+	if irc.Network != nil {
+		g.Network = irc.Network.NetworkName
+	}
+	if irc.User != nil {
+		g.Nick = irc.User.NickName
+	}
+	return g
+}
+
+// Save stores the generation so !again and !reroll can find it by ID
+func (g *Generation) Save() error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return fmt.Errorf("failed to marshal generation %s: %w", g.ID, err)
+	}
+	return birdbase.PutBytesExpireHours(generationKeyPrefix+g.ID, data, GenerationExpiryHours)
+}
+
+// LoadGeneration returns the stored generation with the given ID
+func LoadGeneration(id string) (*Generation, error) {
+	key := generationKeyPrefix + strings.ToLower(strings.TrimSpace(id))
+	if !birdbase.Has(key) {
+		return nil, fmt.Errorf("no generation with ID %s, they are kept for %d days", id, GenerationExpiryHours/24)
+	}
+
+	data, err := birdbase.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load generation %s: %w", id, err)
+	}
+	var g Generation
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal generation %s: %w", id, err)
+	}
+	return &g, nil
+}
+
+// EnhancedPromptFor returns the enhanced prompt of the generation the command reruns, if it is a
+// rerun of the same prompt, so the result doesn't change with a new answer from the AI
+func EnhancedPromptFor(irc state.State) (string, bool) {
+	id, _ := irc.GetStringArg(RerunArgument, "")
+	if id == "" {
+		return "", false
+	}
+	g, err := LoadGeneration(id)
+	if err != nil || g.EnhancedPrompt == "" || g.Prompt != irc.Message() {
+		return "", false
+	}
+	return g.EnhancedPrompt, true
+}
+
+// Summary names the generation for a reply by its ID and seed, the rest of the record goes in the
+// birdhole metadata
+func (g *Generation) Summary() string {
+	if g.Seed == nil {
+		return "id " + g.ID
+	}
+	return fmt.Sprintf("id %s, seed %d", g.ID, *g.Seed)
+}
+
+// RerunArguments returns the arguments to run the generation again with, the overrides replacing
+// the recorded ones. The recorded seed is kept unless newSeed is set, then the workflow draws one.
+func (g *Generation) RerunArguments(overrides []state.Argument, newSeed bool) []state.Argument {
+	overridden := make(map[string]bool, len(overrides))
+	for _, arg := range overrides {
+		overridden[arg.Key] = true
+	}
+
+	args := []state.Argument{{Key: RerunArgument, Value: g.ID}}
+	for _, arg := range g.Arguments {
+		if overridden[arg.Key] || arg.Key == "seed" {
+			continue
+		}
+		args = append(args, arg)
+	}
+	if g.Seed != nil && !newSeed && !overridden["seed"] {
+		args = append(args, state.Argument{Key: "seed", Value: fmt.Sprint(*g.Seed)})
+	}
+	for _, arg := range overrides {
+		if arg.Key != RerunArgument {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
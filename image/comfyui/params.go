@@ -0,0 +1,212 @@
+package comfyui
+
+import (
+	"aibird/http/fetch"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/richinsley/comfy2go/client"
+)
+
+// maxInputBytes is the largest image or audio file a parameter will download
+const maxInputBytes = 10 << 20
+
+// inputExtensionsByType are the files image and audio parameters accept, by parameter type and
+// sniffed content type
+var inputExtensionsByType = map[string]map[string]string{
+	"image": {
+		"image/png":  ".png",
+		"image/jpeg": ".jpg",
+		"image/webp": ".webp",
+		"image/gif":  ".gif",
+	},
+	"audio": {
+		"audio/wave":      ".wav",
+		"audio/mpeg":      ".mp3",
+		"audio/aiff":      ".aiff",
+		"application/ogg": ".ogg",
+	},
+}
+
+// inputKinds names the accepted files of each parameter type for errors
+var inputKinds = map[string]string{
+	"image": "a PNG, JPEG, WebP or GIF image",
+	"audio": "a WAV, MP3, AIFF or Ogg audio file",
+}
+
+// inputUpload is a file for an image or audio parameter, downloaded from the user's URL or output by
+// an earlier pipeline stage. It is uploaded to the backend once the client is connected and the
+// filename ComfyUI gives it goes into the workflow.
+type inputUpload struct {
+	param     string
+	data      []byte
+	extension string
+	name      string // set by upload
+}
+
+// downloadInput fetches an image or audio parameter, refusing anything too large or of the wrong kind
+func downloadInput(ctx context.Context, param, paramType, rawURL string) (*inputUpload, error) {
+	extensions := inputExtensionsByType[paramType]
+	contentTypes := make([]string, 0, len(extensions))
+	for contentType := range extensions {
+		contentTypes = append(contentTypes, contentType)
+	}
+
+	// The content is checked rather than the header, servers often get it wrong
+	file, err := fetch.Fetch(ctx, rawURL, fetch.Options{ContentTypes: contentTypes, MaxBytes: maxInputBytes})
+	switch {
+	case errors.Is(err, fetch.ErrTooLarge):
+		return nil, fmt.Errorf("⚠️ The %s for --%s is too large, the limit is %d MB", paramType, param, maxInputBytes>>20)
+	case errors.Is(err, fetch.ErrContentType):
+		return nil, fmt.Errorf("⚠️ The URL for --%s is not %s", param, inputKinds[paramType])
+	case err != nil:
+		return nil, fmt.Errorf("⚠️ Failed to download the %s for --%s: %v", paramType, param, err)
+	}
+	defer os.Remove(file.Path)
+
+	data, err := os.ReadFile(file.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the %s for --%s: %w", paramType, param, err)
+	}
+	return &inputUpload{param: param, data: data, extension: extensions[file.ContentType]}, nil
+}
+
+// readInput loads a file a pipeline stage output for the next stage
+func readInput(param, file string) (*inputUpload, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s for --%s: %w", file, param, err)
+	}
+	return &inputUpload{param: param, data: data, extension: strings.ToLower(filepath.Ext(file))}, nil
+}
+
+// upload pushes the file to the backend's input folder, once however many targets use it
+func (u *inputUpload) upload(c *client.ComfyClient) (string, error) {
+	if u.name != "" {
+		return u.name, nil
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to name the file for --%s: %w", u.param, err)
+	}
+	name, err := c.UploadFileFromReader(bytes.NewReader(u.data), "aibird_"+hex.EncodeToString(suffix)+u.extension, false, client.InputImageType, "", nil)
+	if err != nil {
+		return "", transient(fmt.Errorf("failed to upload the file for --%s: %w", u.param, err))
+	}
+	u.name = name
+	return name, nil
+}
+
+// uploadInputs replaces the files among the updates with the names the backend gave them
+func uploadInputs(c *client.ComfyClient, updates []update) error {
+	for i, u := range updates {
+		input, ok := u.value.(*inputUpload)
+		if !ok {
+			continue
+		}
+		name, err := input.upload(c)
+		if err != nil {
+			return err
+		}
+		updates[i].value = name
+	}
+	return nil
+}
+
+// objectInfoValues fetches the choices a backend offers for a node input, such as the samplers of
+// KSampler, from /object_info
+func objectInfoValues(clientAddr string, clientPort int, source ListSource) ([]string, error) {
+	endpoint := fmt.Sprintf("http://%s:%d/object_info/%s", clientAddr, clientPort, url.PathEscape(source.Node))
+	resp, err := apiClient.Get(endpoint)
+	if err != nil {
+		return nil, transient(fmt.Errorf("could not fetch the %s options: %w", source.Input, err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("object_info request for %s failed with status: %s", source.Node, resp.Status)
+	}
+
+	var info map[string]struct {
+		Input map[string]map[string][]json.RawMessage `json:"input"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("could not decode object_info for %s: %w", source.Node, err)
+	}
+
+	node, ok := info[source.Node]
+	if !ok {
+		return nil, fmt.Errorf("the backend has no %s node", source.Node)
+	}
+	for _, group := range []string{"required", "optional"} {
+		spec, ok := node.Input[group][source.Input]
+		if !ok || len(spec) == 0 {
+			continue
+		}
+		return comboValues(spec)
+	}
+	return nil, fmt.Errorf("node %s has no input %s", source.Node, source.Input)
+}
+
+// comboValues reads the choices of a combo input, listed either directly as [["a", "b"], {...}]
+// or, by newer ComfyUI versions, as ["COMBO", {"options": ["a", "b"]}]
+func comboValues(spec []json.RawMessage) ([]string, error) {
+	var values []string
+	if err := json.Unmarshal(spec[0], &values); err == nil {
+		return values, nil
+	}
+
+	var kind string
+	if err := json.Unmarshal(spec[0], &kind); err == nil && kind == "COMBO" && len(spec) > 1 {
+		var options struct {
+			Options []string `json:"options"`
+		}
+		if err := json.Unmarshal(spec[1], &options); err == nil {
+			return options.Options, nil
+		}
+	}
+	return nil, errors.New("the input is not a list of choices")
+}
+
+// maxListedValues is how many choices an error lists before cutting the list short
+const maxListedValues = 20
+
+// listValues joins the first limit values for a message
+func listValues(values []string, limit int) string {
+	if len(values) <= limit {
+		return strings.Join(values, ", ")
+	}
+	return strings.Join(values[:limit], ", ") + fmt.Sprintf(" and %d more", len(values)-limit)
+}
+
+// matchValue finds the allowed value the user meant, ignoring case
+func matchValue(value string, allowed []string) (string, bool) {
+	for _, a := range allowed {
+		if strings.EqualFold(value, a) {
+			return a, true
+		}
+	}
+	return "", false
+}
+
+// parseBool reads a bool parameter, accepting on/off and yes/no as well as true/false
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true", "1", "on", "yes":
+		return true, nil
+	case "false", "0", "off", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("not a bool: %s", value)
+}
@@ -0,0 +1,178 @@
+package comfyui
+
+import (
+	"aibird/irc/state"
+	"aibird/logger"
+	"aibird/shared/meta"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// audioOutputExtensions are the outputs a pipeline can pass on to an audio parameter
+var audioOutputExtensions = []string{".wav", ".flac", ".mp3", ".ogg", ".opus", ".m4a"}
+
+// runPipeline runs the stages of a pipeline in turn on the one backend, each given a file the stage
+// before it output. Only the last stage's outputs are returned, the rest are removed once used.
+func runPipeline(ctx context.Context, irc state.State, workflow *Workflow, aiEnhancedPrompt string, backend meta.Backend, generation *Generation) ([]string, error) {
+	if irc.User.GetAccessLevel() < workflow.Meta.AccessLevel {
+		logger.Error("Access level too low", "required", workflow.Meta.AccessLevel, "user", irc.User.GetAccessLevel())
+		return nil, fmt.Errorf("⛔️ Sorry, you need access level %d to use this command. Check !support for more info", workflow.Meta.AccessLevel)
+	}
+
+	// Every stage's seed follows from one, so !again can run the whole pipeline the same way
+	stages := workflow.Meta.Pipeline
+	seed, err := pipelineSeed(irc, len(stages))
+	if err != nil {
+		return nil, err
+	}
+	generation.Seed = &seed
+
+	var previous []string
+	var family string
+	for i, stage := range stages {
+		stageWorkflow, ok := Workflows.Get(stage.Workflow)
+		if !ok || stageWorkflow.Err != nil || len(stageWorkflow.Meta.Pipeline) > 0 {
+			removeFiles(previous)
+			return nil, fmt.Errorf("stage %d of %s, %s, is not a usable workflow", i+1, workflow.Name, stage.Workflow)
+		}
+
+		// The queue only sees the pipeline as a whole, stages loading other models make room for them here
+		if family != "" && family != stageWorkflow.ModelFamily() {
+			if err := FreeVram(irc.Config.ComfyUi, backend); err != nil {
+				logger.Error("Error freeing VRAM between pipeline stages", "pipeline", workflow.Name, "stage", i+1, "error", err)
+			}
+		}
+		family = stageWorkflow.ModelFamily()
+
+		stageSeed := seed + int64(i)
+		r := run{
+			workflow: stageWorkflow,
+			seed:     &stageSeed,
+			stage:    fmt.Sprintf("%d/%d %s: ", i+1, len(stages), stageWorkflow.Name),
+			prefix:   stageWorkflow.Name + ".",
+		}
+		if i > 0 {
+			paramType := stageWorkflow.Meta.Parameters[stage.Input].Type
+			file, ok := stageInput(previous, paramType)
+			if !ok {
+				removeFiles(previous)
+				return nil, fmt.Errorf("stage %d of %s output no %s for %s --%s", i, workflow.Name, paramType, stageWorkflow.Name, stage.Input)
+			}
+			r.inputs = map[string]string{stage.Input: file}
+		}
+
+		logger.Info("Running pipeline stage", "pipeline", workflow.Name, "stage", i+1, "workflow", stageWorkflow.Name, "backend", backend)
+		outputs, err := process(ctx, stageState(irc, stage), aiEnhancedPrompt, backend, r, generation)
+		removeFiles(previous)
+		if err != nil {
+			return nil, err
+		}
+		previous = outputs
+	}
+	return previous, nil
+}
+
+// pipelineSeed is the seed the user gave or a random one, leaving room to add a number per stage
+func pipelineSeed(irc state.State, stages int) (int64, error) {
+	if given, ok := irc.GetStringArg("seed", ""); ok && given != "" {
+		seed, err := strconv.ParseInt(given, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("⚠️ Invalid value for --seed. Expected a int, but got '%s'.", given)
+		}
+		return seed, nil
+	}
+
+	seed, err := rand.Int(rand.Reader, big.NewInt(1<<63-1-int64(stages)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate random seed: %w", err)
+	}
+	return seed.Int64(), nil
+}
+
+// stageState is the command as a stage sees it, its workflow as the action and its arguments added
+// to the ones the user gave
+func stageState(irc state.State, stage PipelineStage) state.State {
+	s := irc
+	s.Command.Action = stage.Workflow
+	s.Arguments = slices.Clone(irc.Arguments)
+	for _, key := range sortedKeys(stage.Arguments) {
+		if slices.ContainsFunc(irc.Arguments, func(arg state.Argument) bool { return arg.Key == key }) {
+			continue
+		}
+		var value interface{} = fmt.Sprint(stage.Arguments[key])
+		if flag, ok := stage.Arguments[key].(bool); ok && flag {
+			value = true
+		}
+		s.Arguments = append(s.Arguments, state.Argument{Key: key, Value: value})
+	}
+	return s
+}
+
+// stageInput picks the output to pass on to an image or audio parameter, the first of its kind
+func stageInput(outputs []string, paramType string) (string, bool) {
+	extensions := imageExtensions
+	if paramType == "audio" {
+		extensions = audioOutputExtensions
+	}
+	for _, file := range outputs {
+		if slices.Contains(extensions, strings.ToLower(filepath.Ext(file))) {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+func removeFiles(files []string) {
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+// Parameters returns the parameters a workflow takes from the user, for a pipeline those of its
+// stages apart from the files passed from one stage to the next. An earlier stage's wins a clash.
+func (s *Snapshot) Parameters(w *Workflow) map[string]ParameterDef {
+	if w.Meta == nil {
+		return nil
+	}
+	if len(w.Meta.Pipeline) == 0 {
+		return w.Meta.Parameters
+	}
+
+	parameters := make(map[string]ParameterDef)
+	for i, stage := range w.Meta.Pipeline {
+		stageWorkflow, ok := s.Get(stage.Workflow)
+		if !ok || stageWorkflow.Meta == nil {
+			continue
+		}
+		for name, param := range stageWorkflow.Meta.Parameters {
+			if _, seen := parameters[name]; seen || (i > 0 && name == stage.Input) {
+				continue
+			}
+			parameters[name] = param
+		}
+	}
+	return parameters
+}
+
+// TakesPrompt reports whether the workflow, or a stage of it, has somewhere to put the prompt
+func (s *Snapshot) TakesPrompt(w *Workflow) bool {
+	if w.Meta == nil {
+		return false
+	}
+	if w.Meta.PromptTarget.Node != "" {
+		return true
+	}
+	for _, stage := range w.Meta.Pipeline {
+		if stageWorkflow, ok := s.Get(stage.Workflow); ok && stageWorkflow.Meta != nil && stageWorkflow.Meta.PromptTarget.Node != "" {
+			return true
+		}
+	}
+	return false
+}
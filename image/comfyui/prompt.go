@@ -0,0 +1,60 @@
+package comfyui
+
+import (
+	"aibird/filter"
+	"aibird/irc/state"
+	"aibird/wildcard"
+	"errors"
+	"fmt"
+)
+
+// ErrPromptBlocked is returned by FilterPrompt when a block rule refused the prompt
+var ErrPromptBlocked = errors.New("⛔️ Your prompt was blocked by the content filter")
+
+// PromptPolicy returns the filter policy for the command: the workflow's, else the channel's, else
+// the network's, else comfyui.filterPolicy
+func PromptPolicy(irc state.State) string {
+	// TTS reads the text out as it was written, only the bad words apply
+	if irc.IsAction("tts") {
+		return filter.NoPolicy
+	}
+	if workflow, ok := Workflows.Get(irc.Action()); ok && workflow.Meta != nil && workflow.Meta.FilterPolicy != "" {
+		return workflow.Meta.FilterPolicy
+	}
+	if irc.Channel != nil && irc.Channel.FilterPolicy != "" {
+		return irc.Channel.FilterPolicy
+	}
+	if irc.Network != nil && irc.Network.FilterPolicy != "" {
+		return irc.Network.FilterPolicy
+	}
+	if irc.Config != nil && irc.Config.ComfyUi.FilterPolicy != "" {
+		return irc.Config.ComfyUi.FilterPolicy
+	}
+	return filter.DefaultPolicy
+}
+
+// FilterPrompt applies the command's filter policy to a prompt
+func FilterPrompt(irc state.State, prompt string) (string, error) {
+	result := filter.Check(PromptPolicy(irc), prompt)
+	if result.Blocked {
+		return "", ErrPromptBlocked
+	}
+	return result.Prompt, nil
+}
+
+// ExpandPrompt picks from the dynamic prompt syntax of a prompt, {a|b} options and __name__
+// wildcards, before the filter sees it
+func ExpandPrompt(irc state.State, prompt string) (string, error) {
+	if irc.IsAction("tts") || !wildcard.HasSyntax(prompt) {
+		return prompt, nil
+	}
+	dir := wildcard.DefaultDir
+	if irc.Config != nil && irc.Config.ComfyUi.WildcardDir != "" {
+		dir = irc.Config.ComfyUi.WildcardDir
+	}
+	expanded, err := wildcard.Expand(dir, prompt)
+	if err != nil {
+		return "", fmt.Errorf("⚠️ Could not expand your prompt: %w", err)
+	}
+	return expanded, nil
+}
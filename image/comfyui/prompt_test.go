@@ -0,0 +1,65 @@
+package comfyui
+
+import (
+	"aibird/filter"
+	"aibird/irc/channels"
+	"aibird/irc/networks"
+	"aibird/irc/state"
+	"aibird/logger"
+	"aibird/settings"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init(logger.Config{Level: logger.LevelError, Format: "text"})
+	os.Exit(m.Run())
+}
+
+// useWorkflows replaces the registry with one holding only the given workflows until the test ends
+func useWorkflows(t *testing.T, workflows ...*Workflow) {
+	t.Helper()
+	snapshot := &Snapshot{byName: map[string]*Workflow{}}
+	for _, workflow := range workflows {
+		snapshot.add(workflow)
+	}
+	registry := NewRegistry(t.TempDir())
+	registry.snapshot.Store(snapshot)
+	previous := Workflows
+	Workflows = registry
+	t.Cleanup(func() { Workflows = previous })
+}
+
+func TestPromptPolicy(t *testing.T) {
+	useWorkflows(t,
+		&Workflow{Name: "strict", Meta: &AibirdMeta{FilterPolicy: "workflow"}},
+		&Workflow{Name: "plain", Meta: &AibirdMeta{}},
+	)
+	channel := &channels.Channel{FilterPolicy: "channel"}
+	network := &networks.Network{FilterPolicy: "network"}
+	config := &settings.Config{}
+	config.ComfyUi.FilterPolicy = "config"
+
+	tests := []struct {
+		name    string
+		action  string
+		channel *channels.Channel
+		network *networks.Network
+		config  *settings.Config
+		want    string
+	}{
+		{"workflow first", "strict", channel, network, config, "workflow"},
+		{"then channel", "plain", channel, network, config, "channel"},
+		{"then network", "plain", &channels.Channel{}, network, config, "network"},
+		{"then config", "plain", nil, &networks.Network{}, config, "config"},
+		{"then default", "plain", nil, nil, nil, filter.DefaultPolicy},
+		{"unknown command", "missing", nil, network, config, "network"},
+		{"tts", "tts", channel, network, config, filter.NoPolicy},
+	}
+	for _, tt := range tests {
+		irc := state.State{Command: state.Command{Action: tt.action}, Channel: tt.channel, Network: tt.network, Config: tt.config}
+		if got := PromptPolicy(irc); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package comfyui
+
+import (
+	"aibird/logger"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WorkflowDir is where the workflow graphs are kept, relative to the working directory
+const WorkflowDir = "comfyuijson"
+
+// WatchInterval is how often the workflow directory is checked for changes
+const WatchInterval = 5 * time.Second
+
+// Workflows is the registry of every workflow in WorkflowDir, shared by all packages
+var Workflows = NewRegistry(WorkflowDir)
+
+// Workflow is one workflow file and its aibird_meta, loaded together so they always match
+type Workflow struct {
+	Name   string       // Command name, the file name without .json
+	File   string       // Path of the workflow JSON, or of the aibird_meta of a standalone pipeline
+	Format Format       // Graph, API or pipeline format
+	Data   []byte       // Workflow JSON as it was when Meta was parsed, nil for a standalone pipeline
+	Meta   *AibirdMeta  // nil when the file has no usable aibird_meta
+	Err    error        // Why Meta could not be loaded
+	Hash   string       // Hash of the workflow file and its sidecar, changes with either
+	Needs  Requirements // Node classes and model files a backend must have, see Snapshot.Requirements
+	stamps [2]fileStamp
+}
+
+// ModelFamily returns the family of models the workflow loads, its own name unless aibird_meta sets
+// modelFamily
+func (w *Workflow) ModelFamily() string {
+	if w.Meta != nil && w.Meta.ModelFamily != "" {
+		return w.Meta.ModelFamily
+	}
+	return w.Name
+}
+
+// fileStamp identifies a version of a file, the zero stamp is a missing file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// stampFiles stamps a workflow file and its sidecar, a change to either reloads the workflow.
+// A standalone pipeline is its own sidecar.
+func stampFiles(file string) ([2]fileStamp, error) {
+	var stamps [2]fileStamp
+	paths := []string{file}
+	if strings.HasSuffix(file, ".json") {
+		paths = append(paths, sidecarFile(file))
+	}
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			if i == 0 {
+				return stamps, err
+			}
+			continue
+		}
+		stamps[i] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps, nil
+}
+
+// Snapshot is the registry at one point in time. It is never changed once published, so a
+// reader holding one sees a consistent set of workflows however many reloads happen meanwhile.
+type Snapshot struct {
+	byName map[string]*Workflow // keyed by lower case name
+	names  []string
+}
+
+// Get returns the workflow for a command name, ignoring case
+func (s *Snapshot) Get(name string) (*Workflow, bool) {
+	workflow, ok := s.byName[strings.ToLower(name)]
+	return workflow, ok
+}
+
+// Names returns every workflow name, sorted
+func (s *Snapshot) Names() []string {
+	return append([]string(nil), s.names...)
+}
+
+// ByType returns the workflows with a usable aibird_meta of the given type, sorted by name
+func (s *Snapshot) ByType(workflowType string) []*Workflow {
+	var workflows []*Workflow
+	for _, name := range s.names {
+		workflow := s.byName[strings.ToLower(name)]
+		if workflow.Meta != nil && workflow.Meta.Type == workflowType {
+			workflows = append(workflows, workflow)
+		}
+	}
+	return workflows
+}
+
+// Registry loads the workflows in a directory once and reloads the ones that change
+type Registry struct {
+	dir      string
+	snapshot atomic.Pointer[Snapshot]
+	mutex    sync.Mutex // serialises reloads
+}
+
+// NewRegistry returns a registry for dir, it is loaded on first use
+func NewRegistry(dir string) *Registry {
+	return &Registry{dir: dir}
+}
+
+// Snapshot returns the current set of workflows
+func (r *Registry) Snapshot() *Snapshot {
+	if snapshot := r.snapshot.Load(); snapshot != nil {
+		return snapshot
+	}
+	r.Reload()
+	return r.snapshot.Load()
+}
+
+// Get returns the workflow for a command name from the current snapshot
+func (r *Registry) Get(name string) (*Workflow, bool) {
+	return r.Snapshot().Get(name)
+}
+
+// Meta returns the aibird_meta of a workflow, or the error it failed to load with
+func (r *Registry) Meta(name string) (*AibirdMeta, error) {
+	workflow, ok := r.Get(name)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return workflow.Meta, workflow.Err
+}
+
+// Reload rescans the directory, parsing new and changed files and reusing the rest, then
+// publishes the result as a new snapshot
+func (r *Registry) Reload() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	previous := r.snapshot.Load()
+	files, err := workflowFiles(r.dir)
+	if err != nil {
+		logger.Error("Failed to glob for workflow files", "dir", r.dir, "error", err)
+		if previous == nil {
+			r.snapshot.Store(&Snapshot{byName: make(map[string]*Workflow)})
+		}
+		return
+	}
+
+	next := &Snapshot{byName: make(map[string]*Workflow, len(files))}
+	changed := previous == nil
+	for _, file := range files {
+		stamps, err := stampFiles(file)
+		if err != nil {
+			// Removed between the glob and now, the next reload will settle it
+			continue
+		}
+
+		name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(file), ".json"), SidecarSuffix)
+		if previous != nil {
+			if old, ok := previous.byName[strings.ToLower(name)]; ok && old.File == file && old.stamps == stamps {
+				next.add(old)
+				continue
+			}
+		}
+
+		changed = true
+		workflow := loadWorkflow(name, file, stamps)
+		if workflow.Err != nil {
+			logger.Warn("Workflow has no usable aibird_meta", "workflow", name, "error", workflow.Err)
+		}
+		next.add(workflow)
+	}
+
+	if previous != nil && len(previous.byName) != len(next.byName) {
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	sort.Strings(next.names)
+	r.snapshot.Store(next)
+	logger.Info("Loaded ComfyUI workflows", "dir", r.dir, "workflows", len(next.names))
+}
+
+// workflowFiles lists the workflow JSON files in dir and the sidecars that have no JSON, which
+// declare pipelines of other workflows
+func workflowFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sidecars, err := filepath.Glob(filepath.Join(dir, "*"+SidecarSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, sidecar := range sidecars {
+		if _, err := os.Stat(strings.TrimSuffix(sidecar, SidecarSuffix) + ".json"); os.IsNotExist(err) {
+			files = append(files, sidecar)
+		}
+	}
+	return files, nil
+}
+
+func (s *Snapshot) add(workflow *Workflow) {
+	s.byName[strings.ToLower(workflow.Name)] = workflow
+	s.names = append(s.names, workflow.Name)
+}
+
+func loadWorkflow(name, file string, stamps [2]fileStamp) *Workflow {
+	workflow := &Workflow{Name: name, File: file, stamps: stamps}
+	if strings.HasSuffix(file, SidecarSuffix) {
+		workflow.Format = FormatPipeline
+		workflow.Meta, workflow.Err = parsePipeline(file)
+		workflow.Hash = hashFiles(file)
+		return workflow
+	}
+
+	workflow.Data, workflow.Err = os.ReadFile(file)
+	if workflow.Err != nil {
+		return workflow
+	}
+
+	workflow.Format = detectFormat(workflow.Data)
+	if workflow.Format == FormatAPI {
+		workflow.Meta, workflow.Err = parseSidecar(file)
+	} else {
+		workflow.Meta, workflow.Err = parseAibirdMeta(file, workflow.Data)
+	}
+	workflow.Hash = hashFiles(file, sidecarFile(file))
+	workflow.Needs = requirements(workflow.Format, workflow.Data)
+	return workflow
+}
+
+// hashFiles hashes the contents of the files in turn, a missing one as empty
+func hashFiles(files ...string) string {
+	h := sha256.New()
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		fmt.Fprintf(h, "%d:", len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Watch polls the directory every interval and reloads changed workflows until ctx is cancelled
+func (r *Registry) Watch(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.Reload()
+			}
+		}
+	}()
+}
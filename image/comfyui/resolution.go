@@ -0,0 +1,258 @@
+package comfyui
+
+import (
+	"aibird/irc/state"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Arguments that set the width and height of any workflow with a resolution, by aspect ratio
+const (
+	AspectArgument = "ar"
+	SizeArgument   = "size"
+)
+
+// Sizes are the aspect ratios --size takes by name, in the order help lists them
+var Sizes = []string{"square", "portrait", "landscape"}
+
+var sizeRatios = map[string]float64{"square": 1, "portrait": 2.0 / 3, "landscape": 3.0 / 2}
+
+// maxAspect is how far from square --ar may go either way
+const maxAspect = 8
+
+// Defaults for a resolution that leaves them unset and width and height parameters without defaults
+const (
+	defaultPixels   = 1024 * 1024
+	defaultMultiple = 8
+)
+
+// errNoResolution is returned for --ar and --size on a workflow with no width and height to set
+var errNoResolution = errors.New("no width and height to set")
+
+// Resolution is how --ar and --size are turned into a workflow's width and height, the [resolution]
+// table of aibird_meta. Whatever it leaves unset is taken from the width and height parameters, so
+// workflows with both can be given a size without declaring one.
+type Resolution struct {
+	Pixels   int64  `toml:"pixels"`   // Pixel budget, width times height, by default the parameters' defaults multiplied
+	Multiple int64  `toml:"multiple"` // Both sides are a multiple of it, e.g. 8, 16 or 64, 8 if unset
+	Min      int64  `toml:"min"`      // Shortest side, the parameters' min if unset
+	Max      int64  `toml:"max"`      // Longest side, the parameters' max if unset
+	Width    string `toml:"width"`    // Parameter names, width and height if unset
+	Height   string `toml:"height"`
+}
+
+// resolution returns the workflow's resolution with what it leaves unset filled in, ok is false when
+// the workflow has no int parameters for the width and height
+func (m *AibirdMeta) resolution() (Resolution, bool) {
+	var r Resolution
+	if m.Resolution != nil {
+		r = *m.Resolution
+	}
+	if r.Width == "" {
+		r.Width = "width"
+	}
+	if r.Height == "" {
+		r.Height = "height"
+	}
+	width, ok := m.Parameters[r.Width]
+	if !ok || width.Type != "int" {
+		return r, false
+	}
+	height, ok := m.Parameters[r.Height]
+	if !ok || height.Type != "int" {
+		return r, false
+	}
+
+	if r.Multiple <= 0 {
+		r.Multiple = defaultMultiple
+	}
+	if r.Pixels <= 0 {
+		w, wok := defaultSide(width.Default)
+		h, hok := defaultSide(height.Default)
+		if wok && hok && w > 0 && h > 0 {
+			r.Pixels = w * h
+		} else {
+			r.Pixels = defaultPixels
+		}
+	}
+	if r.Min <= 0 && width.Min != nil && height.Min != nil {
+		r.Min = int64(math.Ceil(math.Max(*width.Min, *height.Min)))
+	}
+	if r.Max <= 0 && width.Max != nil && height.Max != nil {
+		r.Max = int64(math.Floor(math.Min(*width.Max, *height.Max)))
+	}
+	return r, true
+}
+
+// defaultSide reads the default of a width or height parameter, which TOML gives as an int64 and
+// JSON as a float64
+func defaultSide(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case float64:
+		return int64(math.Round(v)), true
+	}
+	return 0, false
+}
+
+// size returns the width and height closest to the pixel budget at the ratio, width over height. The
+// limits scale both sides at once so the ratio holds, then each side is rounded to the multiple.
+func (r Resolution) size(ratio float64) (int64, int64) {
+	w := math.Sqrt(float64(r.Pixels) * ratio)
+	h := w / ratio
+	if r.Max > 0 {
+		if scale := float64(r.Max) / math.Max(w, h); scale < 1 {
+			w, h = w*scale, h*scale
+		}
+	}
+	if r.Min > 0 {
+		if scale := float64(r.Min) / math.Min(w, h); scale > 1 {
+			w, h = w*scale, h*scale
+		}
+	}
+	return r.side(w), r.side(h)
+}
+
+// side rounds a side to the nearest multiple that is within the limits. When no multiple is, as with
+// limits narrower than the multiple, it is the smallest multiple above min.
+func (r Resolution) side(length float64) int64 {
+	side := int64(math.Round(length/float64(r.Multiple))) * r.Multiple
+	if r.Max > 0 && side > r.Max {
+		side = r.Max / r.Multiple * r.Multiple
+	}
+	if r.Min > 0 && side < r.Min {
+		side = (r.Min + r.Multiple - 1) / r.Multiple * r.Multiple
+	}
+	return max(side, r.Multiple)
+}
+
+// sizeArguments turns --ar or --size into values for the workflow's width and height parameters, nil
+// when neither is given
+func sizeArguments(irc state.State, metaData *AibirdMeta) (map[string]string, error) {
+	aspect, _ := irc.GetStringArg(AspectArgument, "")
+	size, _ := irc.GetStringArg(SizeArgument, "")
+	if aspect == "" && size == "" {
+		return nil, nil
+	}
+	if aspect != "" && size != "" {
+		return nil, fmt.Errorf("⚠️ Give --%s or --%s, not both", AspectArgument, SizeArgument)
+	}
+	argument := AspectArgument
+	if size != "" {
+		argument = SizeArgument
+	}
+
+	r, ok := metaData.resolution()
+	if !ok {
+		return nil, fmt.Errorf("⚠️ --%s can't be used here: %w", argument, errNoResolution)
+	}
+	for _, name := range []string{r.Width, r.Height} {
+		if given, _ := irc.GetStringArg(name, ""); given != "" {
+			return nil, fmt.Errorf("⚠️ --%s sets --%s and --%s, give one or the other", argument, r.Width, r.Height)
+		}
+	}
+
+	var ratio float64
+	if size != "" {
+		ratio, ok = sizeRatios[strings.ToLower(size)]
+		if !ok {
+			return nil, fmt.Errorf("⚠️ Invalid value for --%s. Choose one of: %s", SizeArgument, strings.Join(Sizes, ", "))
+		}
+	} else {
+		var err error
+		if ratio, err = parseAspect(aspect); err != nil {
+			return nil, err
+		}
+	}
+
+	width, height := r.size(ratio)
+	return map[string]string{
+		r.Width:  strconv.FormatInt(width, 10),
+		r.Height: strconv.FormatInt(height, 10),
+	}, nil
+}
+
+// stageSizeArguments is sizeArguments for a workflow run on its own, or as a stage of a pipeline when
+// prefix is set. A stage with no width and height leaves the size to the other stages. process and
+// the result cache both use it so they can't disagree on the values or the errors.
+func stageSizeArguments(irc state.State, metaData *AibirdMeta, prefix string) (map[string]string, error) {
+	sized, err := sizeArguments(irc, metaData)
+	if errors.Is(err, errNoResolution) && prefix != "" {
+		return nil, nil
+	}
+	return sized, err
+}
+
+// parseAspect reads an aspect ratio written like 16:9 or 16x9 as width over height
+func parseAspect(aspect string) (float64, error) {
+	invalid := fmt.Errorf("⚠️ Invalid value for --%s. Expected a ratio like 16:9, but got '%s'.", AspectArgument, aspect)
+	w, h, ok := strings.Cut(strings.ToLower(aspect), ":")
+	if !ok {
+		w, h, ok = strings.Cut(strings.ToLower(aspect), "x")
+	}
+	if !ok {
+		return 0, invalid
+	}
+	width, err := strconv.ParseFloat(strings.TrimSpace(w), 64)
+	if err != nil || width <= 0 || math.IsInf(width, 0) {
+		return 0, invalid
+	}
+	height, err := strconv.ParseFloat(strings.TrimSpace(h), 64)
+	if err != nil || height <= 0 || math.IsInf(height, 0) {
+		return 0, invalid
+	}
+	ratio := width / height
+	if ratio > maxAspect || ratio < 1.0/maxAspect {
+		return 0, fmt.Errorf("⚠️ --%s must be between 1:%d and %d:1", AspectArgument, maxAspect, maxAspect)
+	}
+	return ratio, nil
+}
+
+// TakesSize reports whether --ar and --size can set the workflow's width and height, or a stage's
+func (s *Snapshot) TakesSize(w *Workflow) bool {
+	if w.Meta == nil {
+		return false
+	}
+	if _, ok := w.Meta.resolution(); ok {
+		return true
+	}
+	for _, stage := range w.Meta.Pipeline {
+		if stageWorkflow, ok := s.Get(stage.Workflow); ok && stageWorkflow.Meta != nil {
+			if _, ok := stageWorkflow.Meta.resolution(); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateResolution checks a declared resolution names int parameters and has sensible limits
+func validateResolution(m *AibirdMeta) []string {
+	if m.Resolution == nil {
+		return nil
+	}
+	var problems []string
+	r := *m.Resolution
+	for _, side := range [][2]string{{"width", r.Width}, {"height", r.Height}} {
+		field, name := side[0], side[1]
+		if name == "" {
+			name = field
+		}
+		if param, ok := m.Parameters[name]; !ok || param.Type != "int" {
+			problems = append(problems, fmt.Sprintf("resolution.%s: there is no int parameter %q", field, name))
+		}
+	}
+	if r.Pixels < 0 || r.Multiple < 0 || r.Min < 0 || r.Max < 0 {
+		problems = append(problems, "resolution: pixels, multiple, min and max can't be negative")
+	}
+	if r.Min > 0 && r.Max > 0 && r.Min > r.Max {
+		problems = append(problems, fmt.Sprintf("resolution: min %d is greater than max %d", r.Min, r.Max))
+	}
+	return problems
+}
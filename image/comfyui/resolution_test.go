@@ -0,0 +1,130 @@
+package comfyui
+
+import (
+	"aibird/irc/state"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParseAspect(t *testing.T) {
+	tests := []struct {
+		aspect string
+		ratio  float64
+		ok     bool
+	}{
+		{"16:9", 16.0 / 9, true},
+		{"16x9", 16.0 / 9, true},
+		{" 3 : 2 ", 1.5, true},
+		{"1:1", 1, true},
+		{"1:8", 1.0 / 8, true},
+		{"8:1", 8, true},
+		{"2.39:1", 2.39, true},
+		{"1:9", 0, false},
+		{"9:1", 0, false},
+		{"0:1", 0, false},
+		{"-16:9", 0, false},
+		{"16:", 0, false},
+		{"16", 0, false},
+		{"wide", 0, false},
+		{"inf:1", 0, false},
+	}
+	for _, tt := range tests {
+		ratio, err := parseAspect(tt.aspect)
+		if (err == nil) != tt.ok || math.Abs(ratio-tt.ratio) > 1e-9 {
+			t.Errorf("parseAspect(%q) = %v, %v, want %v, ok %v", tt.aspect, ratio, err, tt.ratio, tt.ok)
+		}
+	}
+}
+
+func TestResolutionSize(t *testing.T) {
+	megapixel := int64(1024 * 1024)
+	tests := []struct {
+		name          string
+		resolution    Resolution
+		ratio         float64
+		width, height int64
+	}{
+		{"square", Resolution{Pixels: megapixel, Multiple: 8}, 1, 1024, 1024},
+		{"16:9", Resolution{Pixels: megapixel, Multiple: 8}, 16.0 / 9, 1368, 768},
+		{"9:16", Resolution{Pixels: megapixel, Multiple: 8}, 9.0 / 16, 768, 1368},
+		{"16:9 by 64", Resolution{Pixels: megapixel, Multiple: 64}, 16.0 / 9, 1344, 768},
+		{"1:8", Resolution{Pixels: megapixel, Multiple: 8}, 1.0 / 8, 360, 2896},
+		{"1:8 within max", Resolution{Pixels: megapixel, Multiple: 8, Max: 2048}, 1.0 / 8, 256, 2048},
+		{"1:8 within min and max", Resolution{Pixels: megapixel, Multiple: 8, Min: 512, Max: 2048}, 1.0 / 8, 512, 2048},
+		{"small budget raised to min", Resolution{Pixels: 256 * 256, Multiple: 8, Min: 512}, 1, 512, 512},
+		{"limits narrower than the multiple", Resolution{Pixels: megapixel, Multiple: 64, Min: 100, Max: 120}, 1, 128, 128},
+		{"max below the multiple", Resolution{Pixels: megapixel, Multiple: 64, Max: 50}, 1, 64, 64},
+	}
+	for _, tt := range tests {
+		width, height := tt.resolution.size(tt.ratio)
+		if width != tt.width || height != tt.height {
+			t.Errorf("%s: got %dx%d, want %dx%d", tt.name, width, height, tt.width, tt.height)
+		}
+		if width%tt.resolution.Multiple != 0 || height%tt.resolution.Multiple != 0 {
+			t.Errorf("%s: %dx%d is not a multiple of %d", tt.name, width, height, tt.resolution.Multiple)
+		}
+	}
+}
+
+func TestResolutionDefaults(t *testing.T) {
+	bound := func(v float64) *float64 { return &v }
+	meta := func(width, height interface{}) *AibirdMeta {
+		return &AibirdMeta{Parameters: map[string]ParameterDef{
+			"width":  {Type: "int", Default: width, Min: bound(64), Max: bound(4096)},
+			"height": {Type: "int", Default: height, Min: bound(128), Max: bound(2048)},
+		}}
+	}
+	tests := []struct {
+		name   string
+		meta   *AibirdMeta
+		pixels int64
+	}{
+		{"int64", meta(int64(832), int64(1216)), 832 * 1216},
+		{"int", meta(832, 1216), 832 * 1216},
+		{"float64", meta(832.0, 1216.0), 832 * 1216},
+		{"mixed", meta(int64(832), 1216.0), 832 * 1216},
+		{"string", meta("832", "1216"), defaultPixels},
+		{"unset", meta(nil, nil), defaultPixels},
+		{"zero", meta(0, 1216), defaultPixels},
+	}
+	for _, tt := range tests {
+		r, ok := tt.meta.resolution()
+		if !ok {
+			t.Errorf("%s: expected a resolution", tt.name)
+			continue
+		}
+		if r.Pixels != tt.pixels || r.Multiple != defaultMultiple || r.Min != 128 || r.Max != 2048 {
+			t.Errorf("%s: got %+v, want %d pixels by %d within 128 and 2048", tt.name, r, tt.pixels, defaultMultiple)
+		}
+	}
+
+	if _, ok := (&AibirdMeta{Parameters: map[string]ParameterDef{"width": {Type: "int"}}}).resolution(); ok {
+		t.Error("a workflow without a height should have no resolution")
+	}
+}
+
+func TestStageSizeArguments(t *testing.T) {
+	sized := &AibirdMeta{Parameters: map[string]ParameterDef{
+		"width":  {Type: "int", Default: int64(1024)},
+		"height": {Type: "int", Default: int64(1024)},
+	}}
+	unsized := &AibirdMeta{Parameters: map[string]ParameterDef{"steps": {Type: "int"}}}
+	irc := state.State{Arguments: []state.Argument{{Key: AspectArgument, Value: "16:9"}}}
+
+	values, err := stageSizeArguments(irc, sized, "")
+	if err != nil || values["width"] != "1368" || values["height"] != "768" {
+		t.Errorf("expected 1368x768, got %v, %v", values, err)
+	}
+	if _, err := stageSizeArguments(irc, unsized, ""); !errors.Is(err, errNoResolution) {
+		t.Errorf("expected a workflow without a resolution to refuse --ar, got %v", err)
+	}
+	if values, err := stageSizeArguments(irc, unsized, "upscale."); err != nil || values != nil {
+		t.Errorf("expected a stage without a resolution to leave it to the others, got %v, %v", values, err)
+	}
+
+	irc.Arguments = append(irc.Arguments, state.Argument{Key: SizeArgument, Value: "square"})
+	if _, err := stageSizeArguments(irc, unsized, "upscale."); err == nil {
+		t.Error("expected --ar and --size together to fail in a stage too")
+	}
+}
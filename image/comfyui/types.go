@@ -24,18 +24,34 @@ type AibirdMeta struct {
 	AccessLevel  int                       `toml:"accessLevel"`
 	Type         string                    `toml:"type"`
 	BigModel     bool                      `toml:"bigModel"`
+	ModelFamily  string                    `toml:"modelFamily"`  // Workflows of a family load the same models, a backend may keep them between jobs
+	Timeout      int                       `toml:"timeout"`      // Seconds the workflow may go without progress, 0 uses comfyui.timeout
+	FilterPolicy string                    `toml:"filterPolicy"` // Prompt filter policy, wins over the channel's and network's
 	PromptTarget PromptTarget              `toml:"promptTarget"`
 	Parameters   map[string]ParameterDef   `toml:"parameters"`
 	Hardcoded    map[string]HardcodedValue `toml:"hardcoded"`
+	Resolution   *Resolution               `toml:"resolution"` // How --ar and --size set the width and height
+	Pipeline     []PipelineStage           `toml:"pipeline"`   // Workflows run in turn instead of a graph of its own
+}
+
+// PipelineStage is one workflow of a pipeline. Every stage after the first is given a file the stage
+// before it output, the first image or audio file as its Input parameter is an image or audio one.
+// The prompt and arguments of the command go to every stage that has a parameter by that name.
+type PipelineStage struct {
+	Workflow  string                 `toml:"workflow"`
+	Input     string                 `toml:"input"`     // Parameter that takes the previous stage's output
+	Arguments map[string]interface{} `toml:"arguments"` // Arguments for this stage only, the user's win
 }
 
 // PromptTarget defines where the main prompt text should go.
 type PromptTarget struct {
 	Node        string `toml:"node"`
 	WidgetIndex int    `toml:"widget_index"`
+	Input       string `toml:"input"`
 }
 
-// ParameterDef defines the structure for a user-configurable parameter.
+// ParameterDef defines the structure for a user-configurable parameter. Type is one of string, int,
+// float, lyrics, enum, bool, image, audio or comfy_list.
 type ParameterDef struct {
 	Type        string      `toml:"type"`
 	Default     interface{} `toml:"default"`
@@ -43,6 +59,15 @@ type ParameterDef struct {
 	Targets     []Target    `toml:"targets"`
 	Min         *float64    `toml:"min"`
 	Max         *float64    `toml:"max"`
+	Values      []string    `toml:"values"` // Allowed values of an enum
+	Source      ListSource  `toml:"source"` // Where a comfy_list gets its values
+}
+
+// ListSource is the node input whose choices a comfy_list parameter offers, read live from the
+// backend's /object_info, e.g. node = "KSampler" and input = "sampler_name".
+type ListSource struct {
+	Node  string `toml:"node"`
+	Input string `toml:"input"`
 }
 
 // HardcodedValue defines a value to be set directly in the workflow.
@@ -51,8 +76,10 @@ type HardcodedValue struct {
 	Targets []Target    `toml:"targets"`
 }
 
-// Target defines a specific widget in a ComfyUI workflow to update.
+// Target defines a specific widget in a ComfyUI workflow to update. Graph workflows address it by
+// node type or title and widget_index, API format workflows by node id or title and input name.
 type Target struct {
 	Node        string `toml:"node"`
 	WidgetIndex int    `toml:"widget_index"`
+	Input       string `toml:"input"`
 }
@@ -0,0 +1,235 @@
+package comfyui
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/richinsley/comfy2go/graphapi"
+)
+
+// ParameterTypes are the parameter types Process knows how to read from the user
+var ParameterTypes = []string{"string", "int", "float", "lyrics", "enum", "bool", "image", "audio", "comfy_list"}
+
+// Validate checks a workflow's aibird_meta against its graph and returns every problem found. Process
+// skips targets it can't match without saying so, this is how a typo in a node name gets noticed.
+// The stages of a pipeline are looked up in s.
+func (w *Workflow) Validate(s *Snapshot) []string {
+	if w.Err != nil {
+		return []string{fmt.Sprintf("aibird_meta: %v", w.Err)}
+	}
+	if len(w.Meta.Pipeline) > 0 {
+		return w.validatePipeline(s)
+	}
+
+	var problems []string
+	var check func(field string, target Target)
+	if w.Format == FormatAPI {
+		var prompt apiPrompt
+		if err := json.Unmarshal(w.Data, &prompt); err != nil {
+			return []string{fmt.Sprintf("prompt: %v", err)}
+		}
+		if _, err := prompt.graph(); err != nil {
+			return []string{fmt.Sprintf("prompt: %v", err)}
+		}
+		check = func(field string, target Target) {
+			problems = append(problems, checkInput(prompt, field, target)...)
+		}
+	} else {
+		// The node objects only come from a running ComfyUI, the widget values are all that's needed here
+		var graph graphapi.Graph
+		if err := json.Unmarshal(w.Data, &graph); err != nil {
+			return []string{fmt.Sprintf("graph: %v", err)}
+		}
+		group := graph.GetGroupWithTitle("API")
+		if group == nil {
+			return []string{`graph: there is no "API" group`}
+		}
+		apiNodes := graph.GetNodesInGroup(group)
+		check = func(field string, target Target) {
+			problems = append(problems, checkTarget(apiNodes, field, target)...)
+		}
+	}
+
+	if w.Meta.PromptTarget.Node != "" {
+		check("promptTarget", Target(w.Meta.PromptTarget))
+	}
+
+	for _, name := range sortedKeys(w.Meta.Parameters) {
+		param := w.Meta.Parameters[name]
+		field := "parameters." + name
+		if !isParameterType(param.Type) {
+			problems = append(problems, fmt.Sprintf("%s: unknown type %q", field, param.Type))
+		} else if param.Default != nil && !defaultMatchesType(param.Default, param.Type, param.Values) {
+			problems = append(problems, fmt.Sprintf("%s: default %v is not of type %s", field, param.Default, param.Type))
+		}
+		if param.Type == "enum" && len(param.Values) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: enum has no values", field))
+		}
+		if param.Type == "comfy_list" && (param.Source.Node == "" || param.Source.Input == "") {
+			problems = append(problems, fmt.Sprintf("%s: comfy_list needs a source node and input", field))
+		}
+		if param.Min != nil && param.Max != nil && *param.Min > *param.Max {
+			problems = append(problems, fmt.Sprintf("%s: min %g is greater than max %g", field, *param.Min, *param.Max))
+		}
+		for i, target := range param.Targets {
+			check(fmt.Sprintf("%s.targets[%d]", field, i), target)
+		}
+	}
+
+	problems = append(problems, validateResolution(w.Meta)...)
+
+	for _, name := range sortedKeys(w.Meta.Hardcoded) {
+		for i, target := range w.Meta.Hardcoded[name].Targets {
+			check(fmt.Sprintf("hardcoded.%s.targets[%d]", name, i), target)
+		}
+	}
+
+	return problems
+}
+
+// validatePipeline checks every stage is a workflow of its own and is given what the stage before
+// it outputs
+func (w *Workflow) validatePipeline(s *Snapshot) []string {
+	var problems []string
+	if w.Format != FormatPipeline {
+		problems = append(problems, "pipeline: the graph is not run, a pipeline is best declared in a "+SidecarSuffix+" of its own")
+	}
+
+	for i, stage := range w.Meta.Pipeline {
+		field := fmt.Sprintf("pipeline[%d]", i)
+		stageWorkflow, ok := s.Get(stage.Workflow)
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: there is no workflow %q", field, stage.Workflow))
+			continue
+		case stageWorkflow.Err != nil:
+			problems = append(problems, fmt.Sprintf("%s: workflow %q has no usable aibird_meta", field, stage.Workflow))
+			continue
+		case len(stageWorkflow.Meta.Pipeline) > 0:
+			problems = append(problems, fmt.Sprintf("%s: workflow %q is a pipeline itself", field, stage.Workflow))
+			continue
+		}
+
+		if stageWorkflow.Meta.BigModel && !w.Meta.BigModel {
+			problems = append(problems, fmt.Sprintf("%s: workflow %q needs a big model backend, set bigModel on the pipeline", field, stage.Workflow))
+		}
+		if stageWorkflow.Meta.AccessLevel > w.Meta.AccessLevel {
+			problems = append(problems, fmt.Sprintf("%s: workflow %q needs access level %d, more than the pipeline's %d", field, stage.Workflow, stageWorkflow.Meta.AccessLevel, w.Meta.AccessLevel))
+		}
+
+		if i == 0 {
+			if stage.Input != "" {
+				problems = append(problems, fmt.Sprintf("%s: the first stage has no stage before it to take input from", field))
+			}
+			continue
+		}
+		param, ok := stageWorkflow.Meta.Parameters[stage.Input]
+		switch {
+		case stage.Input == "":
+			problems = append(problems, fmt.Sprintf("%s: needs the input parameter that takes the previous stage's output", field))
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: workflow %q has no parameter %q", field, stage.Workflow, stage.Input))
+		case param.Type != "image" && param.Type != "audio":
+			problems = append(problems, fmt.Sprintf("%s: parameter %q is of type %s, only image and audio parameters take a file", field, stage.Input, param.Type))
+		}
+	}
+	return problems
+}
+
+// checkTarget finds the nodes Process would write a target to, matched by type or title, and
+// checks they have the widget
+func checkTarget(apiNodes []*graphapi.GraphNode, field string, target Target) []string {
+	var problems []string
+	found := false
+	for _, node := range apiNodes {
+		if node.Type != target.Node && node.Title != target.Node {
+			continue
+		}
+		found = true
+
+		values, ok := node.WidgetValues.([]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: node %q (id %d) has no list of widget values", field, target.Node, node.ID))
+			continue
+		}
+		if target.WidgetIndex < 0 || target.WidgetIndex >= len(values) {
+			problems = append(problems, fmt.Sprintf("%s: widget_index %d is out of range, node %q (id %d) has %d widgets", field, target.WidgetIndex, target.Node, node.ID, len(values)))
+		}
+	}
+
+	if !found {
+		problems = append(problems, fmt.Sprintf("%s: there is no node %q in the API group", field, target.Node))
+	}
+	return problems
+}
+
+// checkInput finds the nodes Process would write an API format target to, by id or title, and checks
+// they have the input and that it holds a value rather than a link to another node
+func checkInput(prompt apiPrompt, field string, target Target) []string {
+	if target.Input == "" {
+		return []string{fmt.Sprintf("%s: API format targets need an input name", field)}
+	}
+
+	nodes := prompt.find(target.Node)
+	if len(nodes) == 0 {
+		return []string{fmt.Sprintf("%s: there is no node with id or title %q", field, target.Node)}
+	}
+
+	var problems []string
+	for _, node := range nodes {
+		value, ok := node.Inputs[target.Input]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: node %q (%s) has no input %q", field, target.Node, node.ClassType, target.Input))
+		} else if _, linked := value.([]interface{}); linked {
+			problems = append(problems, fmt.Sprintf("%s: input %q of node %q is linked to another node", field, target.Input, target.Node))
+		}
+	}
+	return problems
+}
+
+func isParameterType(paramType string) bool {
+	for _, t := range ParameterTypes {
+		if t == paramType {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultMatchesType reports whether a default decoded from TOML suits the parameter type
+func defaultMatchesType(value interface{}, paramType string, values []string) bool {
+	switch paramType {
+	case "int":
+		_, ok := value.(int64)
+		return ok
+	case "float":
+		switch value.(type) {
+		case int64, float64:
+			return true
+		}
+		return false
+	case "bool":
+		_, ok := value.(bool)
+		return ok
+	case "enum":
+		text, ok := value.(string)
+		if !ok {
+			return false
+		}
+		_, ok = matchValue(text, values)
+		return ok
+	default:
+		_, ok := value.(string)
+		return ok
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
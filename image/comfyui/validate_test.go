@@ -0,0 +1,191 @@
+package comfyui
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+// testGraph has a sampler and a prompt in its API group and a loader outside it
+const testGraph = `{
+	"groups": [{"title": "API", "bounding": [0, 0, 1000, 1000]}],
+	"nodes": [
+		{"id": 3, "type": "KSampler", "pos": [10, 10], "size": [100, 100], "widgets_values": [1, "fixed", 20, 7.5]},
+		{"id": 6, "type": "CLIPTextEncode", "title": "Prompt", "pos": [200, 10], "size": [100, 100], "widgets_values": ["masterpiece,"]},
+		{"id": 4, "type": "CheckpointLoaderSimple", "pos": [5000, 5000], "size": [100, 100], "widgets_values": ["model.safetensors"]}
+	],
+	"links": []
+}`
+
+// testMeta is aibird_meta every fixture starts from, it has no problems of its own
+const testMeta = `
+accessLevel = 1
+[promptTarget]
+node = "Prompt"
+widget_index = 0
+`
+
+func parseMeta(t *testing.T, data string) *AibirdMeta {
+	t.Helper()
+	var meta AibirdMeta
+	if _, err := toml.Decode(data, &meta); err != nil {
+		t.Fatalf("fixture doesn't decode: %v", err)
+	}
+	return &meta
+}
+
+// expectProblems checks each wanted problem is reported and nothing else is
+func expectProblems(t *testing.T, name string, problems []string, want ...string) {
+	t.Helper()
+	if len(problems) != len(want) {
+		t.Errorf("%s: got problems %q, want %d", name, problems, len(want))
+		return
+	}
+	for i, w := range want {
+		if !strings.Contains(problems[i], w) {
+			t.Errorf("%s: got problem %q, want one about %q", name, problems[i], w)
+		}
+	}
+}
+
+func TestValidateGraph(t *testing.T) {
+	tests := []struct {
+		name string
+		meta string
+		want []string
+	}{
+		{"valid", `
+[parameters.steps]
+type = "int"
+default = 20
+min = 1
+max = 50
+targets = [{node = "KSampler", widget_index = 2}]
+[parameters.sampler]
+type = "enum"
+values = ["euler", "dpmpp_2m"]
+default = "Euler"
+targets = [{node = "KSampler", widget_index = 1}]
+`, nil},
+		{"missing node", `
+[parameters.model]
+type = "string"
+targets = [{node = "CheckpointLoaderSimple", widget_index = 0}]
+`, []string{`parameters.model.targets[0]: there is no node "CheckpointLoaderSimple"`}},
+		{"widget out of range", `
+[parameters.cfg]
+type = "float"
+targets = [{node = "KSampler", widget_index = 4}]
+[hardcoded.seed]
+value = 1
+targets = [{node = "KSampler", widget_index = -1}]
+`, []string{"parameters.cfg.targets[0]: widget_index 4 is out of range", "hardcoded.seed.targets[0]: widget_index -1 is out of range"}},
+		{"enum default", `
+[parameters.sampler]
+type = "enum"
+values = ["euler", "dpmpp_2m"]
+default = "ddim"
+`, []string{"default ddim is not of type enum"}},
+		{"empty enum", `
+[parameters.sampler]
+type = "enum"
+`, []string{"enum has no values"}},
+		{"min over max", `
+[parameters.steps]
+type = "int"
+min = 50
+max = 1
+`, []string{"min 50 is greater than max 1"}},
+		{"default of the wrong type", `
+[parameters.steps]
+type = "int"
+default = 2.5
+[parameters.strength]
+type = "float"
+default = 1
+[parameters.mood]
+type = "feeling"
+`, []string{"parameters.mood: unknown type", "parameters.steps: default 2.5 is not of type int"}},
+	}
+	for _, tt := range tests {
+		workflow := &Workflow{Name: tt.name, Format: FormatGraph, Data: []byte(testGraph), Meta: parseMeta(t, testMeta+tt.meta)}
+		expectProblems(t, tt.name, workflow.Validate(nil), tt.want...)
+	}
+
+	noGroup := &Workflow{Format: FormatGraph, Data: []byte(`{"nodes": []}`), Meta: parseMeta(t, testMeta)}
+	expectProblems(t, "no API group", noGroup.Validate(nil), `there is no "API" group`)
+}
+
+func TestValidateAPI(t *testing.T) {
+	tests := []struct {
+		name   string
+		prompt string
+		meta   string
+		want   []string
+	}{
+		{"valid", testPrompt, `
+[parameters.steps]
+type = "int"
+targets = [{node = "3", input = "steps"}, {node = "Sampler", input = "seed"}]
+`, nil},
+		{"missing node", testPrompt, `
+[parameters.steps]
+type = "int"
+targets = [{node = "9", input = "steps"}]
+`, []string{`there is no node with id or title "9"`}},
+		{"missing input", testPrompt, `
+[parameters.cfg]
+type = "float"
+targets = [{node = "3", input = "cfg"}, {node = "3"}]
+`, []string{`node "3" (KSampler) has no input "cfg"`, "API format targets need an input name"}},
+		{"linked input", testPrompt, `
+[parameters.model]
+type = "string"
+targets = [{node = "Sampler", input = "model"}]
+`, []string{`input "model" of node "Sampler" is linked to another node`}},
+		{"node id", `{"sampler": {"class_type": "KSampler", "inputs": {}}}`, "", []string{`node id "sampler" is not a number`}},
+	}
+	for _, tt := range tests {
+		meta := parseMeta(t, "[promptTarget]\nnode = \"Prompt\"\ninput = \"text\"\n"+tt.meta)
+		workflow := &Workflow{Name: tt.name, Format: FormatAPI, Data: []byte(tt.prompt), Meta: meta}
+		expectProblems(t, tt.name, workflow.Validate(nil), tt.want...)
+	}
+}
+
+func TestValidatePipeline(t *testing.T) {
+	stage := func(name, meta string) *Workflow {
+		return &Workflow{Name: name, Format: FormatGraph, Data: []byte(testGraph), Meta: parseMeta(t, meta)}
+	}
+	snapshot := &Snapshot{byName: map[string]*Workflow{}}
+	snapshot.add(stage("sdxl", "accessLevel = 1"))
+	snapshot.add(stage("upscale", "accessLevel = 1\n[parameters.image]\ntype = \"image\"\n[parameters.scale]\ntype = \"float\""))
+	snapshot.add(stage("secret", "accessLevel = 3\n[parameters.image]\ntype = \"image\""))
+	snapshot.add(stage("huge", "accessLevel = 1\nbigModel = true\n[parameters.image]\ntype = \"image\""))
+	snapshot.add(&Workflow{Name: "broken", Err: toml.ParseError{Message: "bad"}})
+
+	tests := []struct {
+		name     string
+		pipeline string
+		want     []string
+	}{
+		{"valid", `[{workflow = "sdxl"}, {workflow = "upscale", input = "image"}]`, nil},
+		{"input type", `[{workflow = "sdxl"}, {workflow = "upscale", input = "scale"}]`, []string{`parameter "scale" is of type float, only image and audio`}},
+		{"no input", `[{workflow = "sdxl"}, {workflow = "upscale"}, {workflow = "upscale", input = "mask"}]`,
+			[]string{"pipeline[1]: needs the input parameter", `pipeline[2]: workflow "upscale" has no parameter "mask"`}},
+		{"first stage input", `[{workflow = "upscale", input = "image"}]`, []string{"the first stage has no stage before it"}},
+		{"access level", `[{workflow = "sdxl"}, {workflow = "secret", input = "image"}]`, []string{`workflow "secret" needs access level 3, more than the pipeline's 1`}},
+		{"big model", `[{workflow = "sdxl"}, {workflow = "huge", input = "image"}]`, []string{`workflow "huge" needs a big model backend`}},
+		{"missing stages", `[{workflow = "sdxl"}, {workflow = "nothing"}, {workflow = "broken"}]`,
+			[]string{`there is no workflow "nothing"`, `workflow "broken" has no usable aibird_meta`}},
+	}
+	for _, tt := range tests {
+		pipeline := &Workflow{Name: tt.name, Format: FormatPipeline, Meta: parseMeta(t, "accessLevel = 1\npipeline = "+tt.pipeline)}
+		expectProblems(t, tt.name, pipeline.Validate(snapshot), tt.want...)
+	}
+
+	pipeline := stage("nested", "accessLevel = 1\npipeline = [{workflow = \"sdxl\"}]")
+	snapshot.add(pipeline)
+	graphPipeline := &Workflow{Format: FormatGraph, Meta: parseMeta(t, `pipeline = [{workflow = "nested"}]`)}
+	expectProblems(t, "pipeline in a graph", graphPipeline.Validate(snapshot), "the graph is not run", `workflow "nested" is a pipeline itself`)
+}
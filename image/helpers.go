@@ -1,8 +1,10 @@
 package image
 
 import (
+	"aibird/http/fetch"
 	"aibird/logger"
 	"bytes"
+	"context"
 	"fmt"
 	"image/jpeg"
 	"image/png"
@@ -10,6 +12,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 )
 
 func ToJpeg(imageBytes []byte) ([]byte, error) {
@@ -87,20 +90,12 @@ func ExtractURLs(input string) ([]string, error) {
 	return urls, nil
 }
 
+// IsImageURL reports whether a URL is a public one the server says is an image
 func IsImageURL(rawURL string) bool {
-	// Validate URL to prevent SSRF attacks
-	if !strings.HasPrefix(rawURL, "http://") && !strings.HasPrefix(rawURL, "https://") {
-		logger.Error("Invalid URL scheme", "url", rawURL)
-		return false
-	}
-
-	resp, err := http.Head(rawURL)
+	info, err := fetch.Head(context.Background(), rawURL, 10*time.Second)
 	if err != nil {
 		logger.Error("Error checking image URL", "url", rawURL, "error", err)
 		return false
 	}
-	defer resp.Body.Close()
-
-	contentType := resp.Header.Get("Content-Type")
-	return strings.HasPrefix(contentType, "image/")
+	return strings.HasPrefix(info.ContentType, "image/")
 }
@@ -12,7 +12,7 @@ import (
 )
 
 func (c *Channel) String() string {
-	return girc.Fmt(fmt.Sprintf("{b}Name{b}: %s {b}Users{b}: %d {b}PreserveModes{b}: %s {b}Ai{b}: %s {b}Sd{b}: %s {b}ImageDescribe{b}: %s {b}Sound{b}: %s {b}ActionTrigger{b}: %s {b}TrimOutput{b}: %s",
+	return girc.Fmt(fmt.Sprintf("{b}Name{b}: %s {b}Users{b}: %d {b}PreserveModes{b}: %s {b}Ai{b}: %s {b}Sd{b}: %s {b}ImageDescribe{b}: %s {b}Sound{b}: %s {b}ActionTrigger{b}: %s {b}TrimOutput{b}: %s {b}Progress{b}: %s",
 		c.Name,
 		len(c.Users),
 		helpers.StringToStatusIndicator(strconv.FormatBool(c.PreserveModes)),
@@ -21,7 +21,8 @@ func (c *Channel) String() string {
 		helpers.StringToStatusIndicator(strconv.FormatBool(c.ImageDescribe)),
 		helpers.StringToStatusIndicator(strconv.FormatBool(c.Sound)),
 		c.ActionTrigger,
-		helpers.StringToStatusIndicator(strconv.FormatBool(c.TrimOutput))))
+		helpers.StringToStatusIndicator(strconv.FormatBool(c.TrimOutput)),
+		helpers.StringToStatusIndicator(strconv.FormatBool(c.Progress))))
 }
 
 func (c *Channel) GetUserWithNick(nick string) (*users.User, error) {
@@ -18,6 +18,8 @@ type (
 		DenyCommands  []string `toml:"denyCommands"`
 		Users         []*users.User
 		TrimOutput    bool
+		Progress      bool        // Relay generation progress of everyone's requests to the channel
+		FilterPolicy  string      // Prompt filter policy, empty uses the network's
 		ActivityTimer *time.Timer // Used in DelayedWhoTimer to prevent multiple who requests
 	}
 )
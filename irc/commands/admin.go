@@ -7,6 +7,7 @@ import (
 	"aibird/irc/users"
 	"aibird/logger"
 	"aibird/queue"
+	"fmt"
 	"strings"
 
 	meta "aibird/shared/meta"
@@ -20,11 +21,11 @@ func ParseAdmin(irc state.State) {
 	parseAdminCommands(irc, nil)
 }
 
-func ParseAdminWithQueue(irc state.State, q *queue.DualQueue) {
+func ParseAdminWithQueue(irc state.State, q *queue.Scheduler) {
 	parseAdminCommands(irc, q)
 }
 
-func parseAdminCommands(irc state.State, q *queue.DualQueue) {
+func parseAdminCommands(irc state.State, q *queue.Scheduler) {
 	if irc.User.IsAdmin {
 		switch irc.Command.Action {
 
@@ -167,22 +168,19 @@ func parseAdminCommands(irc state.State, q *queue.DualQueue) {
 				return
 			}
 
-			target := irc.FindArgument("4090", "all").(string)
-			switch target {
-			case "4090":
-				irc.Send("🔄 Clearing 4090 queue...")
-				q.ClearQueue(meta.GPU4090)
-				irc.Send("✅ 4090 queue cleared")
-			case "2070":
-				irc.Send("🔄 Clearing 2070 queue...")
-				q.ClearQueue(meta.GPU2070)
-				irc.Send("✅ 2070 queue cleared")
-			case "all":
+			target := defaultIfEmpty(strings.TrimSpace(irc.Message()), "all")
+			if target == "all" {
 				irc.Send("🔄 Clearing all queues...")
 				q.ClearAllQueues()
 				irc.Send("✅ All queues cleared")
-			default:
-				irc.SendError("Invalid target. Use: 4090, 2070, or all")
+				return
+			}
+
+			irc.Send(fmt.Sprintf("🔄 Clearing %s queue...", target))
+			if q.ClearQueue(meta.Backend(target)) {
+				irc.Send(fmt.Sprintf("✅ %s queue cleared", target))
+			} else {
+				irc.SendError("Invalid target. Use: " + strings.Join(q.BackendNames(), ", ") + ", or all")
 			}
 			return
 		case "removecurrent":
@@ -191,13 +189,16 @@ func parseAdminCommands(irc state.State, q *queue.DualQueue) {
 				return
 			}
 
-			irc.Send("🔄 Removing current processing item...")
+			irc.Send("🔄 Cancelling current processing item...")
 			if q.RemoveCurrentItem() {
-				irc.Send("✅ Current processing item removed")
+				irc.Send("✅ Current processing item cancelled")
 			} else {
 				irc.Send("ℹ️ No items currently processing")
 			}
 			return
+		case "filtertest":
+			ParseFilterTest(irc)
+			return
 
 		}
 	}
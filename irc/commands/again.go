@@ -0,0 +1,61 @@
+package commands
+
+import (
+	"aibird/image/comfyui"
+	"aibird/irc/commands/help"
+	"aibird/irc/state"
+	"aibird/queue"
+	"fmt"
+	"strings"
+)
+
+// ParseAgain handles !again and !reroll, which queue a stored generation again as the user asking,
+// with the recorded seed or a new one. Arguments given with the ID replace the recorded ones.
+func ParseAgain(irc state.State, q *queue.Scheduler, newSeed bool) {
+	if q == nil {
+		irc.SendError("Queue system not available")
+		return
+	}
+
+	id := strings.TrimSpace(irc.Message())
+	if id == "" || strings.ContainsAny(id, " \t") {
+		irc.SendError(fmt.Sprintf("Usage: %s%s <id> [--arg=value ...]", irc.GetActionTrigger(), irc.Action()))
+		return
+	}
+
+	generation, err := comfyui.LoadGeneration(id)
+	if err != nil {
+		irc.SendError(err.Error())
+		return
+	}
+
+	// The rerun is held to the same rules as typing the command here
+	if !comfyui.WorkflowExists(generation.Workflow) {
+		irc.SendError(fmt.Sprintf("The %s workflow is no longer available", generation.Workflow))
+		return
+	}
+	if (irc.ValidateCommand != nil && !irc.ValidateCommand(generation.Workflow)) || help.IsCommandDenied(generation.Workflow, irc) {
+		irc.SendError(fmt.Sprintf("%s%s can't be used here", irc.GetActionTrigger(), generation.Workflow))
+		return
+	}
+
+	rerun := irc
+	rerun.Command = state.Command{Action: generation.Workflow, Message: generation.Prompt}
+	rerun.Arguments = generation.RerunArguments(irc.Arguments, newSeed)
+	if !newSeed && ReplyFromCache(rerun) {
+		return
+	}
+
+	msg, err := q.Enqueue(queue.QueueItem{
+		Item:  queue.Item{State: rerun},
+		Model: generation.Workflow,
+		User:  irc.User,
+	})
+	if err != nil {
+		irc.SendError(err.Error())
+		return
+	}
+	if msg != "" {
+		irc.Send(msg)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"aibird/logger"
 	"aibird/settings"
 	"aibird/shared/meta"
+	"context"
 	"strings"
 )
 
@@ -34,12 +35,9 @@ func IsQueueableFromHelp(action string, config settings.AiBird) bool {
 
 	// If not found in help system, check if it's a ComfyUI workflow
 	// All ComfyUI workflows are assumed to be queueable
-	workflows := comfyui.GetWorkFlowsSlice()
-	for _, workflow := range workflows {
-		if strings.EqualFold(action, workflow) {
-			logger.Debug("Found ComfyUI workflow", "action", action, "queueable", true)
-			return true // All ComfyUI workflows are queueable
-		}
+	if comfyui.WorkflowExists(action) {
+		logger.Debug("Found ComfyUI workflow", "action", action, "queueable", true)
+		return true // All ComfyUI workflows are queueable
 	}
 
 	logger.Debug("Command not found in help system or workflows", "action", action, "queueable", false)
@@ -66,8 +64,10 @@ func IsQueueableCommand(s state.State) bool {
 
 // RunQueueableCommand runs a command that has been taken from the queue.
 // It routes to the existing handlers that already have upload functionality.
-func RunQueueableCommand(s state.State, gpu meta.GPUType) {
+// Cancelling ctx aborts the generation on the backend. The returned error has already been sent to the user.
+func RunQueueableCommand(ctx context.Context, s state.State, backend meta.Backend) error {
 	actionLower := strings.ToLower(s.Action())
+	ctx = withProgressRelay(ctx, s)
 
 	logger.Debug("Routing queue command", "action", s.Action(), "actionLower", actionLower)
 
@@ -78,22 +78,23 @@ func RunQueueableCommand(s state.State, gpu meta.GPUType) {
 		logger.Debug("Command categorized as text", "action", s.Action())
 		// Use existing ParseAiText which already has upload functionality
 		ParseAiText(s)
+		return nil
 	case isImageCommand(actionLower, s.Config.AiBird):
 		logger.Debug("Command categorized as image", "action", s.Action())
 		// Use existing ParseAiImageWithGPU which accepts GPU parameter
-		ParseAiImageWithGPU(s, gpu)
+		return ParseAiImageWithGPU(ctx, s, backend)
 	case isVideoCommand(actionLower, s.Config.AiBird):
 		logger.Debug("Command categorized as video", "action", s.Action())
 		// Use existing ParseAiVideoWithGPU which accepts GPU parameter
-		ParseAiVideoWithGPU(s, gpu)
+		return ParseAiVideoWithGPU(ctx, s, backend)
 	case isSoundCommand(actionLower, s.Config.AiBird):
 		logger.Debug("Command categorized as sound", "action", s.Action())
 		// Use existing ParseAiSoundWithGPU which accepts GPU parameter
-		ParseAiSoundWithGPU(s, gpu)
+		return ParseAiSoundWithGPU(ctx, s, backend)
 	default:
 		logger.Debug("Command categorized as default (image)", "action", s.Action())
 		// Fallback for custom workflows - use image handler with GPU
-		ParseAiImageWithGPU(s, gpu)
+		return ParseAiImageWithGPU(ctx, s, backend)
 	}
 }
 
@@ -108,15 +109,9 @@ func isImageCommand(action string, config settings.AiBird) bool {
 	}
 
 	// Only then check if it's a ComfyUI workflow with image/video type
-	workflows := comfyui.GetWorkFlowsSlice()
-	for _, workflow := range workflows {
-		if strings.EqualFold(action, workflow) {
-			workflowFile := "comfyuijson/" + workflow + ".json"
-			meta, err := comfyui.GetAibirdMeta(workflowFile)
-			if err == nil && meta != nil {
-				return meta.Type == "image"
-			}
-		}
+	meta, err := comfyui.Workflows.Meta(action)
+	if err == nil && meta != nil {
+		return meta.Type == "image"
 	}
 	return false
 }
@@ -131,15 +126,9 @@ func isVideoCommand(action string, config settings.AiBird) bool {
 	}
 
 	// Only then check if it's a ComfyUI workflow with image/video type
-	workflows := comfyui.GetWorkFlowsSlice()
-	for _, workflow := range workflows {
-		if strings.EqualFold(action, workflow) {
-			workflowFile := "comfyuijson/" + workflow + ".json"
-			meta, err := comfyui.GetAibirdMeta(workflowFile)
-			if err == nil && meta != nil {
-				return meta.Type == "video"
-			}
-		}
+	meta, err := comfyui.Workflows.Meta(action)
+	if err == nil && meta != nil {
+		return meta.Type == "video"
 	}
 	return false
 }
@@ -154,15 +143,9 @@ func isSoundCommand(action string, config settings.AiBird) bool {
 	}
 
 	// Only then check if it's a ComfyUI workflow with sound type
-	workflows := comfyui.GetWorkFlowsSlice()
-	for _, workflow := range workflows {
-		if strings.EqualFold(action, workflow) {
-			workflowFile := "comfyuijson/" + workflow + ".json"
-			meta, err := comfyui.GetAibirdMeta(workflowFile)
-			if err == nil && meta != nil {
-				return meta.Type == "sound"
-			}
-		}
+	meta, err := comfyui.Workflows.Meta(action)
+	if err == nil && meta != nil {
+		return meta.Type == "sound"
 	}
 	return false
 }
\ No newline at end of file
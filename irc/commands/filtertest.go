@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"aibird/filter"
+	"aibird/image/comfyui"
+	"aibird/irc/state"
+	"aibird/settings"
+	"fmt"
+	"strings"
+)
+
+// LoadFilters compiles the prompt filter policies in comfyui.filterDir
+func LoadFilters(config settings.ComfyUiConfig) error {
+	return filter.Load(defaultIfEmpty(config.FilterDir, filter.DefaultDir), config.BadWords, config.BadWordsPrompt)
+}
+
+// ParseFilterTest handles !filtertest, which shows what the filter makes of a prompt without running it
+func ParseFilterTest(irc state.State) {
+	if irc.GetBoolArg("reload") {
+		if err := LoadFilters(irc.Config.ComfyUi); err != nil {
+			irc.SendWarning(fmt.Sprintf("Some policies failed to load: %v", err))
+		} else {
+			irc.Send("🧹 Filter policies reloaded: " + strings.Join(filter.Names(), ", "))
+		}
+	}
+
+	prompt := strings.TrimSpace(irc.Message())
+	if prompt == "" {
+		if !irc.GetBoolArg("reload") {
+			irc.SendError(fmt.Sprintf("Usage: %sfiltertest <prompt> [--policy=name] [--workflow=name] [--reload]", irc.GetActionTrigger()))
+		}
+		return
+	}
+
+	policy, _ := irc.GetStringArg("policy", "")
+	if policy == "" {
+		subject := irc
+		if workflow, _ := irc.GetStringArg("workflow", ""); workflow != "" {
+			subject.Command.Action = workflow
+		}
+		policy = comfyui.PromptPolicy(subject)
+	}
+	if _, ok := filter.Get(policy); !ok {
+		irc.SendError(fmt.Sprintf("No filter policy named %s, there is %s", policy, strings.Join(filter.Names(), ", ")))
+		return
+	}
+
+	result := filter.Check(policy, prompt)
+	irc.Send(formatFilterResult(result))
+}
+
+func formatFilterResult(result filter.Result) string {
+	mode := ""
+	if result.Audit {
+		mode = " (audit, nothing is changed)"
+	}
+
+	if len(result.Hits) == 0 {
+		return fmt.Sprintf("🧹 %s%s: no rule fired", result.Policy, mode)
+	}
+
+	hits := make([]string, len(result.Hits))
+	for i, hit := range result.Hits {
+		hits[i] = fmt.Sprintf("%s %s on '%s'", hit.Rule, hit.Action, hit.Match)
+	}
+	outcome := fmt.Sprintf("'%s'", result.Prompt)
+	if result.Blocked {
+		outcome = "blocked"
+	}
+	return fmt.Sprintf("🧹 %s%s: %s → %s", result.Policy, mode, strings.Join(hits, ", "), outcome)
+}
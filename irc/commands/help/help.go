@@ -87,6 +87,51 @@ func StandardHelp() []Help {
 			Arguments: []Arguments{},
 			Queueable: false,
 		},
+		{
+			Name:      "cancel",
+			Type:      "standard",
+			Help:      "Cancels your running generation and removes your requests from the queue.",
+			Arguments: []Arguments{},
+			Queueable: false,
+		},
+		{
+			Name: "queue",
+			Type: "standard",
+			Help: "Lists running and queued requests with their IDs.",
+			Arguments: []Arguments{
+				{Argument: "cancel <id>", Help: "Cancel one of your requests, admins can cancel any request.", Values: ""},
+				{Argument: "move <id> <position>", Help: "Admin only, move a queued request to a position in its queue.", Values: ""},
+			},
+			Queueable: false,
+		},
+		{
+			Name: "progress",
+			Type: "standard",
+			Help: "Get notices as your generations progress, or check whether they are on.",
+			Arguments: []Arguments{
+				{Argument: "on", Help: "Turn progress notices on.", Values: ""},
+				{Argument: "off", Help: "Turn progress notices off.", Values: ""},
+			},
+			Queueable: false,
+		},
+		{
+			Name: "again",
+			Type: "standard",
+			Help: "Run a generation again by the ID in its reply, with the same seed. Any --arg given replaces the one it was made with.",
+			Arguments: []Arguments{
+				{Argument: "id", Help: "The ID of the generation, e.g. !again 1a2b3c4d --steps=40", Values: ""},
+			},
+			Queueable: false,
+		},
+		{
+			Name: "reroll",
+			Type: "standard",
+			Help: "Run a generation again by the ID in its reply, with a new seed. Any --arg given replaces the one it was made with.",
+			Arguments: []Arguments{
+				{Argument: "id", Help: "The ID of the generation, e.g. !reroll 1a2b3c4d", Values: ""},
+			},
+			Queueable: false,
+		},
 	}
 }
 
@@ -365,17 +410,29 @@ func AdminHelp() []Help {
 			Type: "admin",
 			Help: "Clear specified queue(s) or all queues.",
 			Arguments: []Arguments{
-				{Argument: "[4090|2070|all]", Help: "Specify which queue(s) to clear. Use 'all' to clear both queues.", Values: "4090, 2070, all"},
+				{Argument: "[<backend>|all]", Help: "Specify which backend queue to clear by its [[comfyui.ports]] name. Use 'all' to clear every queue.", Values: "all"},
 			},
 			Queueable: false,
 		},
 		{
 			Name:      "removecurrent",
 			Type:      "admin",
-			Help:      "Remove the currently processing item from both queues.",
+			Help:      "Remove the currently processing item from every queue.",
 			Arguments: []Arguments{},
 			Queueable: false,
 		},
+		{
+			Name: "filtertest",
+			Type: "admin",
+			Help: "Show what the prompt filter makes of a prompt and which rules fired, under this channel's policy unless another is given.",
+			Arguments: []Arguments{
+				{Argument: "<prompt>", Help: "The prompt to check.", Values: ""},
+				{Argument: "--policy", Help: "Check against this policy.", Values: "policy name"},
+				{Argument: "--workflow", Help: "Check against the policy this workflow uses here.", Values: "workflow name"},
+				{Argument: "--reload", Help: "Reload the policy files first.", Values: ""},
+			},
+			Queueable: false,
+		},
 	}
 }
 
@@ -482,25 +539,13 @@ func Format(helpItems []Help) string {
 func getHelpForWorkflowType(workflowType string, config settings.AiBird) []Help {
 	var helpItems []Help
 
-	workflows := comfyui.GetWorkFlowsSlice()
-	for _, workflowName := range workflows {
-		workflowFile := "comfyuijson/" + workflowName + ".json"
-		meta, err := comfyui.GetAibirdMeta(workflowFile)
-		if err != nil {
-			logger.Warn("Skipping workflow for help generation due to error", "workflow", workflowName, "error", err)
-			continue // Skip workflows that cause errors
-		}
-
-		if meta == nil {
-			continue // Skip workflows without metadata
-		}
-
-		if meta.Type != workflowType {
-			continue
-		}
+	// Workflows whose metadata failed to load are logged by the registry and left out of ByType
+	snapshot := comfyui.Workflows.Snapshot()
+	for _, workflow := range snapshot.ByType(workflowType) {
+		workflowName, meta := workflow.Name, workflow.Meta
 
 		arguments := []Arguments{}
-		if meta.PromptTarget.Node != "" {
+		if snapshot.TakesPrompt(workflow) {
 			arguments = append(arguments, Arguments{
 				Argument: "<message>",
 				Help:     "The main prompt for the generation.",
@@ -508,7 +553,7 @@ func getHelpForWorkflowType(workflowType string, config settings.AiBird) []Help
 			})
 		}
 
-		for paramName, paramDef := range meta.Parameters {
+		for paramName, paramDef := range snapshot.Parameters(workflow) {
 			var valuesString string
 
 			// Special handling for dynamic voice list
@@ -523,7 +568,15 @@ func getHelpForWorkflowType(workflowType string, config settings.AiBird) []Help
 				}
 			} else {
 				var valueParts []string
-				if paramDef.Type != "" {
+				switch paramDef.Type {
+				case "":
+				case "enum":
+					valueParts = append(valueParts, "one of: "+strings.Join(paramDef.Values, ", "))
+				case "comfy_list":
+					valueParts = append(valueParts, fmt.Sprintf("a %s %s available on the server", paramDef.Source.Node, paramDef.Source.Input))
+				case "image", "audio":
+					valueParts = append(valueParts, paramDef.Type+" URL")
+				default:
 					valueParts = append(valueParts, paramDef.Type)
 				}
 				if paramDef.Default != nil {
@@ -545,6 +598,22 @@ func getHelpForWorkflowType(workflowType string, config settings.AiBird) []Help
 				Values:   valuesString,
 			})
 		}
+		if snapshot.TakesSize(workflow) {
+			arguments = append(arguments, Arguments{
+				Argument: "--" + comfyui.AspectArgument,
+				Help:     "Aspect ratio, sets the width and height to suit the model.",
+				Values:   "a ratio like 16:9",
+			}, Arguments{
+				Argument: "--" + comfyui.SizeArgument,
+				Help:     "Named aspect ratio, sets the width and height to suit the model.",
+				Values:   "one of: " + strings.Join(comfyui.Sizes, ", "),
+			})
+		}
+		arguments = append(arguments, Arguments{
+			Argument: "--" + comfyui.FreshArgument,
+			Help:     "Generate anew rather than reuse the result of the same request made earlier.",
+			Values:   "",
+		})
 
 		description := meta.Description
 		if meta.URL != "" {
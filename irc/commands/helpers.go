@@ -1,8 +1,146 @@
 package commands
 
+import (
+	"aibird/http/request"
+	"aibird/http/uploaders/birdhole"
+	"aibird/image/comfyui"
+	"aibird/irc/state"
+	"aibird/logger"
+	"aibird/metrics"
+	"aibird/shared/meta"
+	"aibird/text/ollama"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
 func defaultIfEmpty(value, defaultValue string) string {
 	if value == "" {
 		return defaultValue
 	}
 	return value
 }
+
+// processingMessage is sent when a queued generation starts, naming the backend for supporters
+func processingMessage(irc state.State, backend meta.Backend, message string) string {
+	if irc.User.CanSkipQueue() && backend != "" {
+		return fmt.Sprintf("%s: Birdnest pal! Enjoy the 🔥%s🔥 processing '%s'... please wait.", irc.User.NickName, backend, message)
+	}
+	return fmt.Sprintf("%s: Queued item '%s' has started processing... please wait.", irc.User.NickName, message)
+}
+
+// sendError tells the user what went wrong and returns it, so queued commands are recorded as failed
+func sendError(irc state.State, message string) error {
+	irc.SendError(message)
+	return errors.New(message)
+}
+
+// pluralS returns "s" unless count is exactly one
+func pluralS(count int) string {
+	if count == 1 {
+		return ""
+	}
+	return "s"
+}
+
+// sendJobError tells the user why a queued job failed, unless its backend failed and the queue will
+// retry it elsewhere, in which case the queue tells them once the job has really failed
+func sendJobError(ctx context.Context, irc state.State, err error) {
+	if comfyui.IsTransient(err) && meta.WillRetry(ctx) {
+		return
+	}
+	irc.SendError(err.Error())
+}
+
+// uploadOutputs uploads every file a generation produced to birdhole and returns the links joined for
+// one reply, the preview first. Files that fail are logged and left out, it only fails if they all do.
+// The files are removed once it is done with them.
+func uploadOutputs(irc state.State, outputs []string, message string, fields []request.Fields) (string, error) {
+	defer removeFiles(outputs)
+
+	var links []string
+	var lastErr error
+	for _, file := range comfyui.PreviewFirst(outputs) {
+		link, err := birdhole.BirdHole(file, message, fields, irc.Config.Birdhole)
+		if err != nil {
+			logger.Error("Birdhole error", "file", file, "error", err)
+			lastErr = err
+			continue
+		}
+		links = append(links, link)
+	}
+
+	if len(links) == 0 {
+		return "", lastErr
+	}
+	return strings.Join(links, " "), nil
+}
+
+// ExpandPrompt picks from the {a|b} options and __name__ wildcards of a workflow command's prompt and
+// puts the result in its place, reporting whether the command can go ahead
+func ExpandPrompt(irc *state.State) bool {
+	if !comfyui.WorkflowExists(irc.Action()) {
+		return true
+	}
+	expanded, err := comfyui.ExpandPrompt(*irc, irc.Message())
+	if err != nil {
+		irc.SendError(err.Error())
+		return false
+	}
+	if expanded != irc.Message() {
+		logger.Debug("Expanded dynamic prompt", "workflow", irc.Action(), "prompt", irc.Message(), "expanded", expanded)
+		irc.SetMessage(expanded)
+	}
+	return true
+}
+
+// ReplyFromCache answers a generation command with the upload of the same generation made earlier,
+// reporting whether it could so the command needn't be queued
+func ReplyFromCache(irc state.State) bool {
+	result, ok := comfyui.CachedResultFor(irc)
+	if !ok {
+		return false
+	}
+	message, _ := comfyui.FilterPrompt(irc, irc.Message())
+
+	logger.Info("Answered from the result cache", "workflow", irc.Action(), "generation", result.Generation)
+	metrics.CacheHits.Inc(irc.Action())
+	irc.ReplyTo(result.Links + " - " + irc.GetActionTrigger() + irc.Action() + " " + message + " (" + result.Summary() + ")")
+	return true
+}
+
+// cacheResult keeps the upload for the next command asking for the same generation
+func cacheResult(irc state.State, links string, generation *comfyui.Generation) {
+	if err := comfyui.CacheResult(irc, links, generation); err != nil {
+		logger.Error("Failed to cache result", "generation", generation.ID, "error", err)
+	}
+}
+
+// enhancePrompt asks the AI to improve the prompt, unless the command reruns a generation of the same
+// prompt, then its enhanced prompt is used again
+func enhancePrompt(irc state.State, message string) string {
+	if enhanced, ok := comfyui.EnhancedPromptFor(irc); ok {
+		return enhanced
+	}
+	irc.Send("✨ Enhancing prompt with ai! ✨")
+	enhanced, _ := ollama.EnhancePrompt(message, irc.Config.Ollama)
+	return enhanced
+}
+
+// generationFields records the generation in the birdhole metadata
+func generationFields(generation *comfyui.Generation) []request.Fields {
+	fields := []request.Fields{
+		{Key: "meta_generation", Value: generation.ID},
+		{Key: "meta_workflow", Value: generation.Workflow},
+		{Key: "meta_backend", Value: string(generation.Backend)},
+	}
+	if generation.Seed != nil {
+		fields = append(fields, request.Fields{Key: "meta_seed", Value: fmt.Sprint(*generation.Seed)})
+	}
+	if parameters, err := json.Marshal(generation.Parameters); err == nil {
+		fields = append(fields, request.Fields{Key: "meta_parameters", Value: string(parameters)})
+	}
+	return fields
+}
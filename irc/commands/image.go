@@ -2,13 +2,12 @@ package commands
 
 import (
 	"aibird/http/request"
-	"aibird/http/uploaders/birdhole"
 	"aibird/image"
 	"aibird/image/comfyui"
 	"aibird/irc/commands/help"
 	"aibird/irc/state"
 	"aibird/logger"
-	"aibird/text/ollama"
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
@@ -38,7 +37,11 @@ func ParseAiImage(irc state.State) bool {
 			return true
 		}
 		var aiEnhancedPrompt string
-		message := comfyui.CleanPrompt(irc.Message())
+		message, err := comfyui.FilterPrompt(irc, irc.Message())
+		if err != nil {
+			irc.SendError(err.Error())
+			return true
+		}
 
 		imgArg, _ := irc.GetStringArg("img", "")
 
@@ -71,21 +74,16 @@ func ParseAiImage(irc state.State) bool {
 
 		aiEnhancedPrompt = ""
 		if (irc.IsAction("ltx") || irc.IsAction("img2ltx")) || irc.GetBoolArg("pe") {
-			irc.Send("✨ Enhancing prompt with ai! ✨")
-			aiEnhancedPrompt, _ = ollama.EnhancePrompt(message, irc.Config.Ollama)
+			aiEnhancedPrompt = enhancePrompt(irc, message)
 		}
 
 		//if (irc.IsAction("sdxxxl") || irc.IsAction("sd") || irc.IsAction("porn") || irc.IsAction("ponyrealism") || irc.IsAction("pony") || irc.IsAction("photon")) && irc.GetBoolArg("pe") {
 		//	aiEnhancedPrompt, _ = ollama.SdPrompt(message)
 		//}
 
-		if irc.User.CanUse4090() {
-			irc.Send(fmt.Sprintf("%s: Birdnest pal! Enjoy the 🔥rtx 4090🔥 processing '%s'... please wait.", irc.User.NickName, message))
-		} else {
-			irc.Send(fmt.Sprintf("%s: Queued item '%s' has started processing... please wait.", irc.User.NickName, message))
-		}
+		irc.Send(processingMessage(irc, "", message))
 
-		response, err := comfyui.Process(irc, aiEnhancedPrompt, meta.GPU4090)
+		outputs, generation, err := comfyui.Process(context.Background(), irc, aiEnhancedPrompt, "")
 		if err != nil {
 			logger.Error("ComfyUI request failed", "error", err)
 			irc.SendError(err.Error())
@@ -104,13 +102,15 @@ func ParseAiImage(irc state.State) bool {
 			if aiEnhancedPrompt != "" {
 				fields = append(fields, request.Fields{Key: "message", Value: aiEnhancedPrompt})
 			}
+			fields = append(fields, generationFields(generation)...)
 
-			upload, err := birdhole.BirdHole(response, message, fields, irc.Config.Birdhole)
+			upload, err := uploadOutputs(irc, outputs, message, fields)
 
 			if err != nil {
 				logger.Error("Birdhole error", "error", err)
 			} else {
-				irc.ReplyTo(upload + " - " + irc.GetActionTrigger() + irc.Action() + " " + message)
+				irc.ReplyTo(upload + " - " + irc.GetActionTrigger() + irc.Action() + " " + message + " (" + generation.Summary() + ")")
+				cacheResult(irc, upload, generation)
 
 				return true
 			}
@@ -138,74 +138,68 @@ func ParseAiImage(irc state.State) bool {
 }
 
 // ParseAiImageWithGPU handles image commands with explicit GPU selection
-func ParseAiImageWithGPU(irc state.State, gpu meta.GPUType) bool {
+func ParseAiImageWithGPU(ctx context.Context, irc state.State, backend meta.Backend) error {
 	if irc.IsAction("sd") {
 		if irc.GetBoolArg("help") {
 			irc.Send(girc.Fmt(help.FindHelp(irc)))
-			return true
+			return nil
 		}
 
 		if irc.GetBoolArg("models") {
 			irc.Send(girc.Fmt("📸 The following sd models are available: " + comfyui.GetWorkFlows(true)))
-			return true
+			return nil
 		}
 	}
 
 	if comfyui.WorkflowExists(irc.Action()) {
 		if irc.GetBoolArg("help") || irc.IsEmptyMessage() {
 			irc.Send(girc.Fmt(help.FindHelp(irc)))
-			return true
+			return nil
 		}
 		var aiEnhancedPrompt string
-		message := comfyui.CleanPrompt(irc.Message())
+		message, err := comfyui.FilterPrompt(irc, irc.Message())
+		if err != nil {
+			return sendError(irc, err.Error())
+		}
 
 		imgArg, _ := irc.GetStringArg("img", "")
 
 		if irc.IsAction("flux-img2img") && imgArg == "" {
-			irc.SendError("--img argument is required for flux-img2img")
-			return true
+			return sendError(irc, "--img argument is required for flux-img2img")
 		}
 
 		if imgArg != "" {
 			if !image.IsImageURL(imgArg) {
-				irc.SendError("Invalid image URL")
-				return true
+				return sendError(irc, "Invalid image URL")
 			}
 
 			if !strings.Contains(irc.Command.Action, "img") && !irc.IsAction("kontext") {
-				irc.SendError("Cannot use image for this model")
-				return true
+				return sendError(irc, "Cannot use image for this model")
 			}
 		}
 
 		if (strings.Contains(irc.Command.Action, "img") || irc.IsAction("img2ltx")) && imgArg == "" {
-			irc.SendError("Image URL required for this model")
-			return true
+			return sendError(irc, "Image URL required for this model")
 		}
 
 		if irc.IsAction("img2ltx") && message == "" {
-			irc.SendError("Prompt required for ltx model")
-			return true
+			return sendError(irc, "Prompt required for ltx model")
 		}
 
 		aiEnhancedPrompt = ""
 		if (irc.IsAction("ltx") || irc.IsAction("img2ltx")) || irc.GetBoolArg("pe") {
-			irc.Send("✨ Enhancing prompt with ai! ✨")
-			aiEnhancedPrompt, _ = ollama.EnhancePrompt(message, irc.Config.Ollama)
+			aiEnhancedPrompt = enhancePrompt(irc, message)
 		}
 
 		// Send processing message before starting the actual processing
-		if irc.User.CanUse4090() {
-			irc.Send(fmt.Sprintf("%s: Birdnest pal! Enjoy the 🔥rtx 4090🔥 processing '%s'... please wait.", irc.User.NickName, message))
-		} else {
-			irc.Send(fmt.Sprintf("%s: Queued item '%s' has started processing... please wait.", irc.User.NickName, message))
-		}
+		irc.Send(processingMessage(irc, backend, message))
 
-		// Use the provided GPU parameter instead of hardcoded GPU4090
-		response, err := comfyui.Process(irc, aiEnhancedPrompt, gpu)
+		// Use the backend the scheduler routed this job to
+		outputs, generation, err := comfyui.Process(ctx, irc, aiEnhancedPrompt, backend)
 		if err != nil {
 			logger.Error("ComfyUI request failed", "error", err)
-			irc.SendError(err.Error())
+			sendJobError(ctx, irc, err)
+			return err
 		} else {
 			fields := []request.Fields{
 				{Key: "panorama", Value: strconv.FormatBool(irc.IsAction("panorama"))},
@@ -220,17 +214,20 @@ func ParseAiImageWithGPU(irc state.State, gpu meta.GPUType) bool {
 			if aiEnhancedPrompt != "" {
 				fields = append(fields, request.Fields{Key: "message", Value: aiEnhancedPrompt})
 			}
+			fields = append(fields, generationFields(generation)...)
 
-			upload, err := birdhole.BirdHole(response, message, fields, irc.Config.Birdhole)
+			upload, err := uploadOutputs(irc, outputs, message, fields)
 
 			if err != nil {
 				logger.Error("Birdhole error", "error", err)
+				return err
 			} else {
-				irc.ReplyTo(upload + " - " + irc.GetActionTrigger() + irc.Action() + " " + message)
-				return true
+				irc.ReplyTo(upload + " - " + irc.GetActionTrigger() + irc.Action() + " " + message + " (" + generation.Summary() + ")")
+				cacheResult(irc, upload, generation)
+				return nil
 			}
 		}
 	}
 
-	return false
+	return fmt.Errorf("no workflow found for %s", irc.Action())
 }
@@ -0,0 +1,148 @@
+package commands
+
+import (
+	"aibird/irc/state"
+	"aibird/shared/meta"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressNoticeGap is the least time between two progress notices to the same channel or nick,
+// so several long generations at once can't get the bot throttled by the network
+const progressNoticeGap = 10 * time.Second
+
+// defaultProgressMilestones are used when neither milestones nor an interval are configured
+var defaultProgressMilestones = []int{25, 50, 75}
+
+var (
+	progressMutex sync.Mutex
+	progressSent  = make(map[string]time.Time) // last notice by network and target
+)
+
+// allowProgressNotice reports whether a notice may go to the target now and, if so, counts it as sent
+func allowProgressNotice(network, target string, now time.Time) bool {
+	key := network + "/" + strings.ToLower(target)
+
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	if now.Sub(progressSent[key]) < progressNoticeGap {
+		return false
+	}
+	progressSent[key] = now
+	return true
+}
+
+// progressRelay sends the progress of one generation to IRC as notices
+type progressRelay struct {
+	irc        state.State
+	target     string
+	milestones []int
+	interval   time.Duration
+
+	mutex    sync.Mutex
+	node     string
+	next     int // index of the next milestone to announce for node
+	lastSent time.Time
+}
+
+// progressTarget is where progress notices go: the channel if it relays everyone's progress, otherwise
+// the user if they turned it on with !progress, otherwise nowhere
+func progressTarget(irc state.State) string {
+	if irc.Channel != nil && irc.Channel.Progress {
+		return irc.Channel.Name
+	}
+	if irc.User != nil && irc.User.Progress {
+		return irc.User.NickName
+	}
+	return ""
+}
+
+// withProgressRelay returns a context that relays the generation's progress to IRC when the channel
+// or the user asked for it
+func withProgressRelay(ctx context.Context, irc state.State) context.Context {
+	target := progressTarget(irc)
+	if target == "" || irc.Client == nil {
+		return ctx
+	}
+
+	config := irc.Config.AiBird
+	milestones := slices.Clone(config.ProgressMilestones)
+	if len(milestones) == 0 && config.ProgressInterval == 0 {
+		milestones = slices.Clone(defaultProgressMilestones)
+	}
+	slices.Sort(milestones)
+
+	relay := &progressRelay{
+		irc:        irc,
+		target:     target,
+		milestones: milestones,
+		interval:   time.Duration(config.ProgressInterval) * time.Second,
+		lastSent:   time.Now(),
+	}
+	return meta.WithProgress(ctx, relay.report)
+}
+
+// report announces a milestone once the node passes it, or the progress so far once the interval is
+// up. Milestones start over for every node, a video may well sample more than once.
+func (r *progressRelay) report(node string, value, max int) {
+	if max <= 0 {
+		return
+	}
+	percent := min(value*100/max, 100)
+	now := time.Now()
+
+	r.mutex.Lock()
+	if node != r.node {
+		r.node, r.next = node, 0
+	}
+	due := false
+	for r.next < len(r.milestones) && percent >= r.milestones[r.next] {
+		r.next++
+		due = true
+	}
+	if r.interval > 0 && now.Sub(r.lastSent) >= r.interval {
+		due = true
+	}
+	if !due || !allowProgressNotice(r.irc.Network.NetworkName, r.target, now) {
+		r.mutex.Unlock()
+		return
+	}
+	r.lastSent = now
+	r.mutex.Unlock()
+
+	r.irc.Client.Cmd.Notice(r.target, formatProgress(r.irc, node, percent))
+}
+
+func formatProgress(irc state.State, node string, percent int) string {
+	if node == "" {
+		return fmt.Sprintf("⏳ %s: %s%s is %d%% done", irc.User.NickName, irc.GetActionTrigger(), irc.Action(), percent)
+	}
+	return fmt.Sprintf("⏳ %s: %s%s is %d%% through %s", irc.User.NickName, irc.GetActionTrigger(), irc.Action(), percent, node)
+}
+
+// ParseProgress handles !progress on|off, which turns notices about the user's own generations on or off
+func ParseProgress(irc state.State) {
+	switch strings.ToLower(strings.TrimSpace(irc.Message())) {
+	case "on":
+		irc.User.Progress = true
+		irc.Send(fmt.Sprintf("⏳ %s: you will get notices as your generations progress", irc.User.NickName))
+	case "off":
+		irc.User.Progress = false
+		irc.Send(fmt.Sprintf("⏳ %s: progress notices are off", irc.User.NickName))
+	case "":
+		setting := "off"
+		if irc.User.Progress {
+			setting = "on"
+		}
+		if irc.Channel != nil && irc.Channel.Progress {
+			setting += ", this channel shows everyone's progress"
+		}
+		irc.Send(fmt.Sprintf("⏳ %s: progress notices are %s", irc.User.NickName, setting))
+	default:
+		irc.SendError("Usage: !progress on or !progress off")
+	}
+}
@@ -3,46 +3,155 @@ package commands
 import (
 	"aibird/irc/state"
 	"aibird/queue"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func ShowQueueStatus(s state.State, q *queue.DualQueue) string {
-	status := q.GetDetailedStatus()
+// maxQueueLines caps how many lines !queue sends so a busy queue doesn't flood the channel, the
+// count of jobs left out included
+const maxQueueLines = 5
 
-	// Get currently processing actions
-	processing4090 := q.Queue4090.GetProcessingAction()
-	processing2070 := q.Queue2070.GetProcessingAction()
+// ParseQueue handles !queue, !queue cancel <id> and, for admins, !queue move <id> <position>
+func ParseQueue(irc state.State, q *queue.Scheduler) {
+	args := strings.Fields(irc.Message())
+	if len(args) == 0 {
+		for _, line := range formatJobs(q.Jobs()) {
+			irc.Send(line)
+		}
+		return
+	}
 
-	var messages []string
+	admin := irc.User.IsAdmin || irc.User.IsOwner
+	switch {
+	case args[0] == "cancel" && len(args) == 2:
+		owner := queue.OwnerKey(irc.Network.NetworkName, irc.Event.Source.Ident, irc.Event.Source.Host)
+		if admin {
+			owner = ""
+		}
 
-	// 4090 Queue Status
-	if processing4090 != "" {
-		if status.Queue4090Length > 0 {
-			messages = append(messages, fmt.Sprintf("🟢 4090: Processing (%s) | 🟡 %d queued (%s)", processing4090, status.Queue4090Length, strings.Join(status.Queue4090Items, ", ")))
+		item, err := q.CancelJob(args[1], owner)
+		if err != nil {
+			irc.SendError(err.Error())
+			return
+		}
+		if item.Status == queue.StatusRunning {
+			irc.Send(fmt.Sprintf("🛑 Cancelling %s's running %s request %s", item.Nick(), item.State.Action(), item.ID))
 		} else {
-			messages = append(messages, fmt.Sprintf("🟢 4090: Processing (%s)", processing4090))
+			irc.Send(fmt.Sprintf("🛑 Removed %s's %s request %s from the queue", item.Nick(), item.State.Action(), item.ID))
+		}
+	case args[0] == "move" && len(args) == 3:
+		if !admin {
+			irc.SendError("⛔️ Only admins can move requests around the queue")
+			return
+		}
+
+		position, err := strconv.Atoi(args[2])
+		if err != nil || position < 1 {
+			irc.SendError("The position has to be a number from 1")
+			return
 		}
-	} else if status.Queue4090Length > 0 {
-		messages = append(messages, fmt.Sprintf("🟡 4090: %d queued (%s)", status.Queue4090Length, strings.Join(status.Queue4090Items, ", ")))
-	} else {
-		messages = append(messages, "⚪ 4090: Empty")
+
+		item, err := q.MoveJob(args[1], position)
+		if errors.Is(err, queue.ErrJobRunning) {
+			irc.SendError("That request is already running, it can't be moved")
+			return
+		} else if err != nil {
+			irc.SendError(err.Error())
+			return
+		}
+		irc.Send(fmt.Sprintf("↕️ Moved %s's %s request %s to position %d on the %s", item.Nick(), item.State.Action(), item.ID, position, item.Backend))
+	default:
+		irc.SendError("Usage: !queue, !queue cancel <id> or !queue move <id> <position>")
+	}
+}
+
+// formatJobs returns one line per job, running jobs first, at most maxQueueLines of them with the
+// last saying how many more there are
+func formatJobs(jobs []queue.ItemRecord) []string {
+	if len(jobs) == 0 {
+		return []string{"ℹ️ Nothing is queued or running"}
 	}
 
-	// 2070 Queue Status
-	if processing2070 != "" {
-		if status.Queue2070Length > 0 {
-			messages = append(messages, fmt.Sprintf("🟢 2070: Processing (%s) | 🟡 %d queued (%s)", processing2070, status.Queue2070Length, strings.Join(status.Queue2070Items, ", ")))
+	var lines []string
+	for i, job := range jobs {
+		if i == maxQueueLines-1 && len(jobs) > maxQueueLines {
+			lines = append(lines, fmt.Sprintf("… and %d more", len(jobs)-i))
+			break
+		}
+
+		where := "🟢 running"
+		if job.Progress > 0 {
+			where += " " + formatJobProgress(job.Progress, job.Node)
+		}
+		if job.Position > 0 {
+			where = fmt.Sprintf("🟡 #%d", job.Position)
+		}
+		line := fmt.Sprintf("%s [%s] %s on the %s by %s (%s), queued %s ago", where, job.ID, job.Action, job.Backend, job.Nick, job.Network, time.Since(job.EnqueuedAt).Round(time.Second))
+		if job.Preview != "" {
+			line += ": " + job.Preview
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// formatJobProgress shows how far a running job's current node is, such as "45% on KSampler"
+func formatJobProgress(progress float64, node string) string {
+	if node == "" {
+		return fmt.Sprintf("%d%%", int(progress*100))
+	}
+	return fmt.Sprintf("%d%% on %s", int(progress*100), node)
+}
+
+func ShowQueueStatus(s state.State, q *queue.Scheduler) string {
+	status := q.GetDetailedStatus()
+
+	var messages []string
+	idle := true
+
+	for _, backend := range status.Backends {
+		name := backend.Name
+		if backend.Suspect {
+			name += " ⚠️"
+		}
+		if backend.External > 0 {
+			name += fmt.Sprintf(" (+%d from elsewhere)", backend.External)
+		}
+		processing := backend.Current
+		if len(backend.Running) > 0 {
+			var running []string
+			for _, item := range backend.Running {
+				if item.Progress > 0 {
+					running = append(running, fmt.Sprintf("%s %s, %s left", item.Action, formatJobProgress(item.Progress, item.Node), queue.FormatEstimate(item.Remaining)))
+				} else {
+					running = append(running, fmt.Sprintf("%s, %s left", item.Action, queue.FormatEstimate(item.Remaining)))
+				}
+			}
+			processing = strings.Join(running, "; ")
+		}
+
+		if processing != "" {
+			idle = false
+			if backend.Length > 0 {
+				messages = append(messages, fmt.Sprintf("🟢 %s: Processing (%s) | 🟡 %d queued (%s)", name, processing, backend.Length, strings.Join(backend.Items, ", ")))
+			} else {
+				messages = append(messages, fmt.Sprintf("🟢 %s: Processing (%s)", name, processing))
+			}
+		} else if backend.Length > 0 {
+			idle = false
+			messages = append(messages, fmt.Sprintf("🟡 %s: %d queued (%s)", name, backend.Length, strings.Join(backend.Items, ", ")))
+		} else if backend.Offline {
+			idle = false
+			messages = append(messages, fmt.Sprintf("🔴 %s: Offline", name))
 		} else {
-			messages = append(messages, fmt.Sprintf("🟢 2070: Processing (%s)", processing2070))
+			messages = append(messages, fmt.Sprintf("⚪ %s: Empty", name))
 		}
-	} else if status.Queue2070Length > 0 {
-		messages = append(messages, fmt.Sprintf("🟡 2070: %d queued (%s)", status.Queue2070Length, strings.Join(status.Queue2070Items, ", ")))
-	} else {
-		messages = append(messages, "⚪ 2070: Empty")
 	}
 
-	if status.Queue4090Length == 0 && status.Queue2070Length == 0 && processing4090 == "" && processing2070 == "" {
+	if idle {
 		return "Queue Status: All queues are empty"
 	}
 
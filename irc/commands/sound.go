@@ -1,18 +1,20 @@
 package commands
 
 import (
+	"aibird/http/fetch"
 	"aibird/http/request"
-	"aibird/http/uploaders/birdhole"
 	"aibird/image/comfyui"
 	"aibird/irc/commands/help"
 	"aibird/irc/state"
 	"aibird/logger"
 	"aibird/status"
 	"aibird/text"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -35,27 +37,50 @@ func convertAudioToMp3AndAmplify(inputFile string) (string, error) {
 	return outputFile, nil
 }
 
+// audioExtensions are the outputs that are converted to mp3 before uploading
+var audioExtensions = []string{".wav", ".flac", ".ogg", ".opus", ".m4a"}
+
+// convertAudioOutputs converts the audio outputs of a generation to mp3 and leaves the rest as they are.
+// The files it returns are the ones to upload, the originals of converted files are left to the caller.
+func convertAudioOutputs(outputs []string) ([]string, error) {
+	files := make([]string, 0, len(outputs))
+	for _, file := range outputs {
+		if !slices.Contains(audioExtensions, strings.ToLower(filepath.Ext(file))) {
+			files = append(files, file)
+			continue
+		}
+
+		convertedFile, err := convertAudioToMp3AndAmplify(file)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, convertedFile)
+	}
+	return files, nil
+}
+
+// removeFiles deletes generated files once they are uploaded, or no longer wanted
+func removeFiles(files []string) {
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
 func ProcessAndUploadAudio(irc state.State, message, response string) {
-	audioFile, err := comfyui.Process(irc, "", meta.GPU4090)
+	outputs, generation, err := comfyui.Process(context.Background(), irc, "", "")
 	if err != nil {
 		logger.Error("Failed to process comfyui request", "error", err)
 		irc.SendError(err.Error())
 		return
 	}
-	defer os.Remove(audioFile)
+	defer removeFiles(outputs)
 
-	var finalFile string
-	if filepath.Ext(audioFile) == ".mp3" {
-		finalFile = audioFile
-	} else {
-		convertedFile, err := convertAudioToMp3AndAmplify(audioFile)
-		if err != nil {
-			logger.Error("Failed to convert audio file", "error", err)
-			irc.SendError("Failed to process audio file.")
-			return
-		}
-		finalFile = convertedFile
-		defer os.Remove(finalFile)
+	finalFiles, err := convertAudioOutputs(outputs)
+	defer removeFiles(finalFiles)
+	if err != nil {
+		logger.Error("Failed to convert audio file", "error", err)
+		irc.SendError("Failed to process audio file.")
+		return
 	}
 
 	fields := []request.Fields{
@@ -66,13 +91,15 @@ func ProcessAndUploadAudio(irc state.State, message, response string) {
 		{Key: "meta_ident", Value: irc.User.Ident},
 		{Key: "meta_host", Value: irc.User.Host},
 	}
+	fields = append(fields, generationFields(generation)...)
 
-	upload, err := birdhole.BirdHole(finalFile, message, fields, irc.Config.Birdhole)
+	upload, err := uploadOutputs(irc, finalFiles, message, fields)
 	if err != nil {
 		logger.Error("Failed to upload to birdhole", "error", err)
 		irc.SendError(err.Error())
 	} else {
-		irc.ReplyTo(upload + " - " + response)
+		irc.ReplyTo(upload + " - " + response + " (" + generation.Summary() + ")")
+		cacheResult(irc, upload, generation)
 	}
 }
 
@@ -128,6 +155,12 @@ func ParseAiSound(irc state.State) bool {
 			return true
 		}
 
+		// The status service downloads the voice, it is only given URLs we would fetch ourselves
+		if err := fetch.CheckURL(context.Background(), url); err != nil {
+			irc.SendError(fmt.Sprintf("Can't add a voice from %s: %s", url, err.Error()))
+			return true
+		}
+
 		irc.ReplyTo(fmt.Sprintf("Adding new voice '%s' from %s. Please wait...", name, url))
 
 		statusClient := status.NewClient(irc.Config.AiBird)
@@ -193,27 +226,21 @@ func ParseAiSound(irc state.State) bool {
 }
 
 // ProcessAndUploadAudioWithGPU handles audio processing with explicit GPU selection
-func ProcessAndUploadAudioWithGPU(irc state.State, message, response string, gpu meta.GPUType) {
-	audioFile, err := comfyui.Process(irc, "", gpu)
+func ProcessAndUploadAudioWithGPU(ctx context.Context, irc state.State, message, response string, backend meta.Backend) error {
+	outputs, generation, err := comfyui.Process(ctx, irc, "", backend)
 	if err != nil {
 		logger.Error("Failed to process comfyui request", "error", err)
-		irc.SendError(err.Error())
-		return
+		sendJobError(ctx, irc, err)
+		return err
 	}
-	defer os.Remove(audioFile)
+	defer removeFiles(outputs)
 
-	var finalFile string
-	if filepath.Ext(audioFile) == ".mp3" {
-		finalFile = audioFile
-	} else {
-		convertedFile, err := convertAudioToMp3AndAmplify(audioFile)
-		if err != nil {
-			logger.Error("Failed to convert audio file", "error", err)
-			irc.SendError("Failed to process audio file.")
-			return
-		}
-		finalFile = convertedFile
-		defer os.Remove(finalFile)
+	finalFiles, err := convertAudioOutputs(outputs)
+	defer removeFiles(finalFiles)
+	if err != nil {
+		logger.Error("Failed to convert audio file", "error", err)
+		irc.SendError("Failed to process audio file.")
+		return err
 	}
 
 	fields := []request.Fields{
@@ -224,30 +251,33 @@ func ProcessAndUploadAudioWithGPU(irc state.State, message, response string, gpu
 		{Key: "meta_ident", Value: irc.User.Ident},
 		{Key: "meta_host", Value: irc.User.Host},
 	}
+	fields = append(fields, generationFields(generation)...)
 
-	upload, err := birdhole.BirdHole(finalFile, message, fields, irc.Config.Birdhole)
+	upload, err := uploadOutputs(irc, finalFiles, message, fields)
 	if err != nil {
 		logger.Error("Failed to upload to birdhole", "error", err)
-		irc.SendError(err.Error())
-	} else {
-		irc.ReplyTo(upload + " - " + response)
+		sendJobError(ctx, irc, err)
+		return err
 	}
+
+	irc.ReplyTo(upload + " - " + response + " (" + generation.Summary() + ")")
+	cacheResult(irc, upload, generation)
+	return nil
 }
 
 // ParseAiSoundWithGPU handles sound commands with explicit GPU selection
-func ParseAiSoundWithGPU(irc state.State, gpu meta.GPUType) bool {
+func ParseAiSoundWithGPU(ctx context.Context, irc state.State, backend meta.Backend) error {
 	if irc.IsAction("tts") {
 		if irc.GetBoolArg("help") || irc.IsEmptyMessage() {
 			irc.Send(girc.Fmt(help.FindHelp(irc)))
-			return true
+			return nil
 		}
 
 		systemStatus := status.NewClient(irc.Config.AiBird)
 		voice, _ := irc.GetStringArg("voice", "woman")
 		validVoices, err := systemStatus.GetWavs()
 		if err != nil {
-			irc.SendError("could not fetch voice list from api")
-			return true
+			return sendError(irc, "could not fetch voice list from api")
 		}
 
 		isValid := false
@@ -259,20 +289,16 @@ func ParseAiSoundWithGPU(irc state.State, gpu meta.GPUType) bool {
 		}
 
 		if !isValid {
-			irc.SendError(fmt.Sprintf("invalid voice '%s'. Valid voices are: %s", voice, strings.Join(validVoices, ", ")))
-			return true
+			return sendError(irc, fmt.Sprintf("invalid voice '%s'. Valid voices are: %s", voice, strings.Join(validVoices, ", ")))
 		}
 
 		irc.ReplyTo("🔊 Processing TTS request, please wait...")
-		ProcessAndUploadAudioWithGPU(irc, irc.Message(), irc.Message(), gpu)
-
-		return true
+		return ProcessAndUploadAudioWithGPU(ctx, irc, irc.Message(), irc.Message(), backend)
 	}
 
 	if irc.IsAction("tts-add") {
 		if !irc.User.IsAdmin && irc.User.AccessLevel < 4 {
-			irc.SendError("⛔️ Sorry pal you must at least be Golden Toucans tier on Patreon to use this, check out !support for more info.")
-			return true
+			return sendError(irc, "⛔️ Sorry pal you must at least be Golden Toucans tier on Patreon to use this, check out !support for more info.")
 		}
 
 		url, _ := irc.GetStringArg("url", "")
@@ -282,7 +308,12 @@ func ParseAiSoundWithGPU(irc state.State, gpu meta.GPUType) bool {
 
 		if irc.GetBoolArg("help") || url == "" || name == "" {
 			irc.Send(girc.Fmt(help.FindHelp(irc)))
-			return true
+			return nil
+		}
+
+		// The status service downloads the voice, it is only given URLs we would fetch ourselves
+		if err := fetch.CheckURL(ctx, url); err != nil {
+			return sendError(irc, fmt.Sprintf("Can't add a voice from %s: %s", url, err.Error()))
 		}
 
 		irc.ReplyTo(fmt.Sprintf("Adding new voice '%s' from %s. Please wait...", name, url))
@@ -290,61 +321,52 @@ func ParseAiSoundWithGPU(irc state.State, gpu meta.GPUType) bool {
 		statusClient := status.NewClient(irc.Config.AiBird)
 		message, err := statusClient.AddVoice(url, name, start, duration)
 		if err != nil {
-			irc.SendError(fmt.Sprintf("Failed to add voice: %s", err.Error()))
-			return true
+			return sendError(irc, fmt.Sprintf("Failed to add voice: %s", err.Error()))
 		}
 
 		irc.ReplyTo(message)
-		return true
+		return nil
 	}
 
 	if irc.IsAction("music") {
 		if irc.GetBoolArg("help") || irc.IsEmptyMessage() {
 			irc.Send(girc.Fmt(help.FindHelp(irc)))
-			return true
+			return nil
 		}
 
 		if steps, ok := irc.GetIntArg("steps", 30); ok {
 			if steps < 15 || steps > 45 {
-				irc.SendError("steps must be between 15 and 45")
-				return true
+				return sendError(irc, "steps must be between 15 and 45")
 			}
 		}
 
 		if cfgStr, _ := irc.GetStringArg("cfg", "4.0"); cfgStr != "" {
 			if cfg, err := strconv.ParseFloat(cfgStr, 64); err == nil {
 				if cfg < 1.0 || cfg > 8.0 {
-					irc.SendError("cfg must be between 1.0 and 8.0")
-					return true
+					return sendError(irc, "cfg must be between 1.0 and 8.0")
 				}
 			} else {
-				irc.SendError("Invalid value for cfg, must be a number.")
-				return true
+				return sendError(irc, "Invalid value for cfg, must be a number.")
 			}
 		}
 
 		if genType, _ := irc.GetStringArg("type", "quality"); genType != "quality" && genType != "speed" {
-			irc.SendError("type must be 'quality' or 'speed'")
-			return true
+			return sendError(irc, "type must be 'quality' or 'speed'")
 		}
 
 		irc.ReplyTo("🎵 Processing music request, please wait...")
-		ProcessAndUploadAudioWithGPU(irc, irc.Message(), irc.Message(), gpu)
-
-		return true
+		return ProcessAndUploadAudioWithGPU(ctx, irc, irc.Message(), irc.Message(), backend)
 	}
 
 	if irc.IsAction("sound") {
 		if irc.GetBoolArg("help") || irc.IsEmptyMessage() {
 			irc.Send(girc.Fmt(help.FindHelp(irc)))
-			return true
+			return nil
 		}
 
 		irc.ReplyTo("🔊 Processing sound request, please wait...")
-		ProcessAndUploadAudioWithGPU(irc, irc.Message(), irc.Message(), gpu)
-
-		return true
+		return ProcessAndUploadAudioWithGPU(ctx, irc, irc.Message(), irc.Message(), backend)
 	}
 
-	return false
+	return fmt.Errorf("unknown sound command %s", irc.Action())
 }
@@ -6,6 +6,7 @@ import (
 	"aibird/irc/state"
 	"aibird/queue"
 	"aibird/status"
+	"fmt"
 	"strings"
 
 	"github.com/lrstanley/girc"
@@ -34,7 +35,7 @@ func filterHelp(commands []help.Help, irc state.State) []help.Help {
 	return filtered
 }
 
-func ParseStandardWithQueue(irc state.State, q *queue.DualQueue) {
+func ParseStandardWithQueue(irc state.State, q *queue.Scheduler) {
 	switch irc.Command.Action {
 	case "help":
 		irc.Send("Type  <command> --help for more information on a command.")
@@ -112,6 +113,41 @@ func ParseStandardWithQueue(irc state.State, q *queue.DualQueue) {
 			irc.Send(girc.Fmt("❌ Image generation is disabled in this channel."))
 		}
 		return
+	case "cancel":
+		if q == nil {
+			irc.SendError("Queue system not available")
+			return
+		}
+
+		cancelled, removed := q.CancelUser(irc.Network.NetworkName, irc.Event.Source.Ident, irc.Event.Source.Host)
+		switch {
+		case cancelled && removed > 0:
+			irc.Send(fmt.Sprintf("🛑 Cancelling your running request and removed %d queued request%s", removed, pluralS(removed)))
+		case cancelled:
+			irc.Send("🛑 Cancelling your running request")
+		case removed > 0:
+			irc.Send(fmt.Sprintf("🛑 Removed %d queued request%s", removed, pluralS(removed)))
+		default:
+			irc.Send("ℹ️ You have nothing running or queued")
+		}
+		return
+	case "queue":
+		if q == nil {
+			irc.SendError("Queue system not available")
+			return
+		}
+
+		ParseQueue(irc, q)
+		return
+	case "progress":
+		ParseProgress(irc)
+		return
+	case "again":
+		ParseAgain(irc, q, false)
+		return
+	case "reroll":
+		ParseAgain(irc, q, true)
+		return
 	case "headlies":
 		ParseHeadlines(irc)
 	case "ircnews":
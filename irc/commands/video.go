@@ -2,11 +2,10 @@ package commands
 
 import (
 	"aibird/http/request"
-	"aibird/http/uploaders/birdhole"
 	"aibird/image/comfyui"
 	"aibird/irc/state"
 	"aibird/logger"
-	"aibird/text/ollama"
+	"context"
 	"fmt"
 	"strconv"
 
@@ -16,21 +15,20 @@ import (
 func ParseAiVideo(irc state.State) bool {
 	if comfyui.WorkflowExists(irc.Action()) {
 		var aiEnhancedPrompt string
-		message := comfyui.CleanPrompt(irc.Message())
+		message, err := comfyui.FilterPrompt(irc, irc.Message())
+		if err != nil {
+			irc.SendError(err.Error())
+			return true
+		}
 
 		aiEnhancedPrompt = ""
 		if irc.GetBoolArg("pe") {
-			irc.Send("✨ Enhancing prompt with ai! ✨")
-			aiEnhancedPrompt, _ = ollama.EnhancePrompt(message, irc.Config.Ollama)
+			aiEnhancedPrompt = enhancePrompt(irc, message)
 		}
 
-		if irc.User.CanUse4090() {
-			irc.Send(fmt.Sprintf("%s: Birdnest pal! Enjoy the 🔥rtx 4090🔥 processing '%s'... please wait.", irc.User.NickName, message))
-		} else {
-			irc.Send(fmt.Sprintf("%s: Queued item '%s' has started processing... please wait.", irc.User.NickName, message))
-		}
+		irc.Send(processingMessage(irc, "", message))
 
-		response, err := comfyui.Process(irc, aiEnhancedPrompt, meta.GPU4090)
+		outputs, generation, err := comfyui.Process(context.Background(), irc, aiEnhancedPrompt, "")
 		if err != nil {
 			logger.Error("ComfyUI request failed", "error", err)
 			irc.SendError(err.Error())
@@ -49,13 +47,15 @@ func ParseAiVideo(irc state.State) bool {
 			if aiEnhancedPrompt != "" {
 				fields = append(fields, request.Fields{Key: "message", Value: aiEnhancedPrompt})
 			}
+			fields = append(fields, generationFields(generation)...)
 
-			upload, err := birdhole.BirdHole(response, message, fields, irc.Config.Birdhole)
+			upload, err := uploadOutputs(irc, outputs, message, fields)
 
 			if err != nil {
 				logger.Error("Birdhole error", "error", err)
 			} else {
-				irc.ReplyTo(upload + " - " + irc.GetActionTrigger() + irc.Action() + " " + message)
+				irc.ReplyTo(upload + " - " + irc.GetActionTrigger() + irc.Action() + " " + message + " (" + generation.Summary() + ")")
+				cacheResult(irc, upload, generation)
 
 				return true
 			}
@@ -65,29 +65,28 @@ func ParseAiVideo(irc state.State) bool {
 }
 
 // ParseAiVideoWithGPU handles video commands with explicit GPU selection
-func ParseAiVideoWithGPU(irc state.State, gpu meta.GPUType) bool {
+func ParseAiVideoWithGPU(ctx context.Context, irc state.State, backend meta.Backend) error {
 	if comfyui.WorkflowExists(irc.Action()) {
 		var aiEnhancedPrompt string
-		message := comfyui.CleanPrompt(irc.Message())
+		message, err := comfyui.FilterPrompt(irc, irc.Message())
+		if err != nil {
+			return sendError(irc, err.Error())
+		}
 
 		aiEnhancedPrompt = ""
 		if irc.GetBoolArg("pe") {
-			irc.Send("✨ Enhancing prompt with ai! ✨")
-			aiEnhancedPrompt, _ = ollama.EnhancePrompt(message, irc.Config.Ollama)
+			aiEnhancedPrompt = enhancePrompt(irc, message)
 		}
 
 		// Send processing message before starting the actual processing
-		if irc.User.CanUse4090() {
-			irc.Send(fmt.Sprintf("%s: Birdnest pal! Enjoy the 🔥rtx 4090🔥 processing '%s'... please wait.", irc.User.NickName, message))
-		} else {
-			irc.Send(fmt.Sprintf("%s: Queued item '%s' has started processing... please wait.", irc.User.NickName, message))
-		}
+		irc.Send(processingMessage(irc, backend, message))
 
-		// Use the provided GPU parameter instead of hardcoded GPU4090
-		response, err := comfyui.Process(irc, aiEnhancedPrompt, gpu)
+		// Use the backend the scheduler routed this job to
+		outputs, generation, err := comfyui.Process(ctx, irc, aiEnhancedPrompt, backend)
 		if err != nil {
 			logger.Error("ComfyUI request failed", "error", err)
-			irc.SendError(err.Error())
+			sendJobError(ctx, irc, err)
+			return err
 		} else {
 			fields := []request.Fields{
 				{Key: "panorama", Value: strconv.FormatBool(irc.IsAction("panorama"))},
@@ -102,17 +101,20 @@ func ParseAiVideoWithGPU(irc state.State, gpu meta.GPUType) bool {
 			if aiEnhancedPrompt != "" {
 				fields = append(fields, request.Fields{Key: "message", Value: aiEnhancedPrompt})
 			}
+			fields = append(fields, generationFields(generation)...)
 
-			upload, err := birdhole.BirdHole(response, message, fields, irc.Config.Birdhole)
+			upload, err := uploadOutputs(irc, outputs, message, fields)
 
 			if err != nil {
 				logger.Error("Birdhole error", "error", err)
+				return err
 			} else {
-				irc.ReplyTo(upload + " - " + irc.GetActionTrigger() + irc.Action() + " " + message)
-				return true
+				irc.ReplyTo(upload + " - " + irc.GetActionTrigger() + irc.Action() + " " + message + " (" + generation.Summary() + ")")
+				cacheResult(irc, upload, generation)
+				return nil
 			}
 		}
 	}
 
-	return false
+	return fmt.Errorf("no workflow found for %s", irc.Action())
 }
@@ -30,6 +30,7 @@ type (
 		Burst         int
 		ActionTrigger string
 		DenyCommands  []string `toml:"denyCommands"`
+		FilterPolicy  string   // Prompt filter policy, empty uses comfyui.filterPolicy
 		ModesAtOnce   int
 		Users         []users.User
 		Servers       []servers.Server
@@ -241,17 +241,7 @@ func (s *State) Send(message string) {
 func (s *State) Verify() error {
 	// User already verified to use the bot in PM
 	if s.Event.IsFromUser() {
-		channelUser := s.Network.GetUserWithIdentAndHost(s.Event.Source.Ident, s.Event.Source.Host)
-
-		newChannel := &channels.Channel{
-			Name:  s.Event.Source.Name,
-			Users: []*users.User{channelUser},
-			Ai:    true,
-			Sd:    true,
-		}
-
-		s.Channel = newChannel
-		s.User = channelUser
+		s.usePrivateChannel()
 	}
 
 	if s.Network.NetworkName == "soyjak" && !s.User.HasAnyMode() {
@@ -323,6 +313,49 @@ func (s *State) ShouldPreserveModes() bool {
 	return s.Network.PreserveModes
 }
 
+// usePrivateChannel treats a private message as a channel of its own with the sender as the only user
+func (s *State) usePrivateChannel() {
+	channelUser := s.Network.GetUserWithIdentAndHost(s.Event.Source.Ident, s.Event.Source.Host)
+
+	s.Channel = &channels.Channel{
+		Name:  s.Event.Source.Name,
+		Users: []*users.User{channelUser},
+		Ai:    true,
+		Sd:    true,
+	}
+	s.User = channelUser
+}
+
+// Rehydrate rebuilds the state of an already verified command, used to replay queued jobs after a restart.
+// A channel that isn't a valid channel name is treated as a private message from source.
+func Rehydrate(c *girc.Client, network *networks.Network, config *settings.Config, source *girc.Source, channel string, command Command, arguments []Argument) (State, error) {
+	target := channel
+	if !girc.IsValidChannel(channel) {
+		target = network.Nick
+	}
+
+	s := Init(c, girc.Event{Source: source, Command: girc.PRIVMSG, Params: []string{target, ""}}, network, config)
+	if s.Event.IsFromUser() {
+		s.usePrivateChannel()
+	}
+
+	if s.Channel == nil || s.User == nil {
+		return s, fmt.Errorf("could not find %s in %s on %s", source.Name, channel, network.NetworkName)
+	}
+
+	// Rebuild the original line so anything reading the raw event still sees the command
+	text := s.GetActionTrigger() + command.Action
+	if command.Message != "" {
+		text += " " + command.Message
+	}
+	s.Event.Params[1] = text
+
+	s.Command = command
+	s.Arguments = arguments
+
+	return s, nil
+}
+
 func Init(c *girc.Client, e girc.Event, network *networks.Network, config *settings.Config) State {
 	s := State{
 		Client:  c,
@@ -27,5 +27,8 @@ type (
 		AiModel       string
 		AiBasePrompt  string
 		AiPersonality string
+
+		// Progress notices for the user's own generations, set with !progress
+		Progress bool
 	}
 )
@@ -95,10 +95,10 @@ func (u *User) GetAccessLevelString() string {
 	}
 }
 
-func (u *User) CanUse4090() bool {
-	// Perform a strict check to prevent false positives
-	accessLevel := u.GetAccessLevel()
-	return accessLevel >= 2 || u.IsAdmin || u.IsOwner
+// HasAccessLevel reports whether the user is at or above the given access level.
+// Admins and owners always pass.
+func (u *User) HasAccessLevel(level int) bool {
+	return u.GetAccessLevel() >= level || u.IsAdmin || u.IsOwner
 }
 
 func (u *User) IsIgnored() bool {
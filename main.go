@@ -3,11 +3,14 @@ package main
 import (
 	"aibird/birdbase"
 	"aibird/helpers"
+	"aibird/http/fetch"
+	"aibird/image/comfyui"
 	"aibird/irc/commands"
 	"aibird/irc/commands/help"
 	"aibird/irc/networks"
 	"aibird/irc/state"
 	"aibird/logger"
+	"aibird/metrics"
 	"aibird/queue"
 	"aibird/settings"
 	"context"
@@ -30,6 +33,10 @@ import (
 var shutdown = make(chan struct{})
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	// Load configuration
 	config, err := settings.LoadConfig()
 	if err != nil {
@@ -55,9 +62,36 @@ func main() {
 		close(shutdown)
 	}()
 
-	// Init and start the dual queue process
-	q := queue.NewDualQueue()
-	go q.ProcessQueues()
+	if config.AiBird.FetchViaProxy {
+		if err := fetch.UseProxy(config.AiBird.Proxy); err != nil {
+			logger.Error("Not fetching user URLs through the proxy", "error", err)
+		}
+	}
+
+	// Compile the prompt filters once, a broken policy file is logged and the rest still load
+	if err := commands.LoadFilters(config.ComfyUi); err != nil {
+		logger.Error("Some filter policies failed to load", "error", err)
+	}
+
+	// Load the workflows now rather than on the first command, then pick up edits as they are made
+	comfyui.Workflows.Reload()
+	comfyui.Workflows.Watch(ctx, comfyui.WatchInterval)
+
+	// Ask every backend which nodes and models it has, so workflows only go where they can run
+	comfyui.Backends.Watch(ctx, config.ComfyUi, comfyui.ProbeInterval)
+
+	// Init and start one queue per configured ComfyUI backend
+	q := queue.NewScheduler(config.ComfyUi)
+	q.Runner = runQueueableCommand
+	q.FreeVram = func(backend meta.Backend) error { return comfyui.FreeVram(config.ComfyUi, backend) }
+	// Jobs left over from the last run are replayed as their channels are joined
+	q.Restore(config.ComfyUi.JobRetries)
+	q.ProcessQueues(ctx)
+
+	if config.AiBird.MetricsListen != "" {
+		metrics.OnScrape(q.CollectMetrics)
+		metrics.Serve(ctx, config.AiBird.MetricsListen)
+	}
 
 	var wg sync.WaitGroup
 
@@ -75,7 +109,7 @@ func main() {
 	logger.Info("All IRC connections terminated, shutting down")
 }
 
-func ircClient(ctx context.Context, network *networks.Network, config *settings.Config, q *queue.DualQueue, wg *sync.WaitGroup) {
+func ircClient(ctx context.Context, network *networks.Network, config *settings.Config, q *queue.Scheduler, wg *sync.WaitGroup) {
 	defer wg.Done()
 	network.Load()
 	logger.Info("Connecting to network", "network", network.Name)
@@ -109,10 +143,10 @@ func ircClient(ctx context.Context, network *networks.Network, config *settings.
 	client := girc.New(ircConfig)
 
 	// Register handlers
-	client.Handlers.Add(girc.RPL_WELCOME, func(c *girc.Client, e girc.Event) { handleWelcome(c, e, network) })
+	client.Handlers.Add(girc.RPL_WELCOME, func(c *girc.Client, e girc.Event) { handleWelcome(c, e, network, config, q) })
 	client.Handlers.Add(girc.NICK, func(c *girc.Client, e girc.Event) { handleNick(c, e, network) })
 	client.Handlers.Add(girc.RPL_WHOREPLY, func(c *girc.Client, e girc.Event) { handleWhoReply(c, e, network, config) })
-	client.Handlers.Add(girc.JOIN, func(c *girc.Client, e girc.Event) { handleJoin(c, e, network, config) })
+	client.Handlers.Add(girc.JOIN, func(c *girc.Client, e girc.Event) { handleJoin(c, e, network, config, q) })
 	client.Handlers.Add(girc.MODE, func(c *girc.Client, e girc.Event) { handleMode(c, e, network) })
 	client.Handlers.Add(girc.KICK, func(c *girc.Client, e girc.Event) { handleKick(c, e, config) })
 	client.Handlers.Add(girc.PRIVMSG, func(c *girc.Client, e girc.Event) { handlePrivMsg(c, e, network, config, q) })
@@ -129,7 +163,7 @@ func ircClient(ctx context.Context, network *networks.Network, config *settings.
 	const maxBackoff = 300 * time.Second
 	backoff := minBackoff
 
-	for {
+	for attempt := 0; ; attempt++ {
 		select {
 		case <-ctx.Done():
 			logger.Info("Disconnecting from network", "network", network.Name)
@@ -137,7 +171,12 @@ func ircClient(ctx context.Context, network *networks.Network, config *settings.
 			return
 		default:
 			logger.Info("Attempting to connect to IRC", "network", network.Name, "server", client.Server())
-			if err := client.Connect(); err != nil {
+			if attempt > 0 {
+				metrics.IrcReconnects.Inc(network.Name)
+			}
+			err := client.Connect()
+			metrics.IrcConnected.Set(0, network.Name)
+			if err != nil {
 				logger.Error("Error connecting to IRC", "network", network.Name, "error", err)
 				logger.Info("Reconnecting...", "delay", backoff)
 				time.Sleep(backoff)
@@ -156,7 +195,10 @@ func ircClient(ctx context.Context, network *networks.Network, config *settings.
 	}
 }
 
-func handleWelcome(c *girc.Client, e girc.Event, network *networks.Network) {
+func handleWelcome(c *girc.Client, e girc.Event, network *networks.Network, config *settings.Config, q *queue.Scheduler) {
+	metrics.IrcConnects.Inc(network.Name)
+	metrics.IrcConnected.Set(1, network.Name)
+
 	if network.NickServPass != "" {
 		if err := c.Cmd.SendRaw("PRIVMSG NickServ :IDENTIFY " + network.Nick + " " + network.NickServPass); err != nil {
 			logger.Warn("Error sending NickServ identify", "network", network.Name, "error", err)
@@ -168,6 +210,7 @@ func handleWelcome(c *girc.Client, e girc.Event, network *networks.Network) {
 			logger.Warn("Error sending WHO command", "channel", channel.Name, "network", network.Name, "error", err)
 		}
 	}
+	q.Resume(c, network, config, "")
 }
 
 func handleNick(c *girc.Client, e girc.Event, network *networks.Network) {
@@ -187,8 +230,9 @@ func handleWhoReply(c *girc.Client, e girc.Event, network *networks.Network, con
 	}
 }
 
-func handleJoin(c *girc.Client, e girc.Event, network *networks.Network, config *settings.Config) {
+func handleJoin(c *girc.Client, e girc.Event, network *networks.Network, config *settings.Config, q *queue.Scheduler) {
 	if e.Source.Name == network.Nick {
+		q.Resume(c, network, config, helpers.FindChannelNameInEventParams(e))
 		return
 	}
 	if existingUser := network.GetUserWithNick(e.Source.Name); existingUser != nil {
@@ -249,7 +293,7 @@ func handleKick(c *girc.Client, e girc.Event, config *settings.Config) {
 	}
 }
 
-func handlePrivMsg(c *girc.Client, e girc.Event, network *networks.Network, config *settings.Config, q *queue.DualQueue) {
+func handlePrivMsg(c *girc.Client, e girc.Event, network *networks.Network, config *settings.Config, q *queue.Scheduler) {
 	// Lightweight check for command trigger before initializing state. If it's not a command, do nothing.
 	if !strings.HasPrefix(e.Last(), config.AiBird.ActionTrigger) {
 		return
@@ -342,7 +386,7 @@ func checkFlood(irc state.State) {
 	}
 }
 
-func dispatchCommand(irc state.State, q *queue.DualQueue) {
+func dispatchCommand(irc state.State, q *queue.Scheduler) {
 	// Check if the command is denied at any level
 	action := irc.Action()
 	if irc.Channel != nil {
@@ -371,14 +415,25 @@ func dispatchCommand(irc state.State, q *queue.DualQueue) {
 		return
 	}
 
+	metrics.CommandsTotal.Inc(strings.ToLower(action))
+
 	if commands.IsQueueableCommand(irc) {
+		// Dynamic prompt syntax is expanded here, once, so the filter, the cache, the reply and the
+		// saved generation all see the same prompt
+		if !commands.ExpandPrompt(&irc) {
+			return
+		}
+
+		// The same generation made earlier is answered at once, without taking a place in the queue
+		if commands.ReplyFromCache(irc) {
+			return
+		}
+
 		// Create QueueItem with model information
 		queueItem := queue.QueueItem{
 			Item: queue.Item{
-				State: irc,
-				Function: func(s state.State, gpu meta.GPUType) {
-					commands.RunQueueableCommand(s, gpu)
-				},
+				State:    irc,
+				Function: runQueueableCommand,
 			},
 			Model: irc.Action(), // Use the command as the model identifier
 			User:  irc.User,     // User implements UserAccess interface
@@ -412,3 +467,8 @@ func dispatchCommand(irc state.State, q *queue.DualQueue) {
 		}
 	}
 }
+
+// runQueueableCommand runs a queued command on the backend it was scheduled to
+func runQueueableCommand(ctx context.Context, s state.State, backend meta.Backend) error {
+	return commands.RunQueueableCommand(ctx, s, backend)
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import "time"
+
+var (
+	jobBuckets  = []float64{5, 10, 30, 60, 120, 300, 600, 1200}
+	textBuckets = []float64{0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// Queue, set from the scheduler on every scrape
+var (
+	QueueDepth     = NewGaugeVec("aibird_queue_depth", "Requests waiting in each backend queue.", "backend")
+	QueueRunning   = NewGaugeVec("aibird_queue_running", "Requests being processed on each backend.", "backend")
+	BackendSuspect = NewGaugeVec("aibird_backend_suspect", "1 when the last job on the backend timed out.", "backend")
+)
+
+// Jobs
+var (
+	JobDuration = NewHistogramVec("aibird_job_duration_seconds", "Wall clock time of jobs that finished, by workflow.", jobBuckets, "workflow", "backend")
+	JobsTotal   = NewCounterVec("aibird_jobs_total", "Jobs taken from a queue by how they ended: done, failed, cancelled or retried.", "backend", "outcome")
+)
+
+// Text providers, provider is ollama, openrouter or gemini
+var (
+	TextRequestDuration = NewHistogramVec("aibird_text_request_duration_seconds", "Latency of text provider requests.", textBuckets, "provider")
+	TextErrors          = NewCounterVec("aibird_text_errors_total", "Failed text provider requests.", "provider")
+)
+
+// Uploads and commands
+var (
+	BirdholeUploadFailures = NewCounterVec("aibird_birdhole_upload_failures_total", "Uploads to birdhole that failed.")
+	CommandsTotal          = NewCounterVec("aibird_commands_total", "Commands dispatched, by name.", "command")
+	CacheHits              = NewCounterVec("aibird_cache_hits_total", "Generations answered from the result cache, by workflow.", "workflow")
+)
+
+// IRC
+var (
+	IrcConnects   = NewCounterVec("aibird_irc_connects_total", "Successful IRC registrations, by network.", "network")
+	IrcReconnects = NewCounterVec("aibird_irc_reconnects_total", "IRC connection attempts after the first, by network.", "network")
+	IrcConnected  = NewGaugeVec("aibird_irc_connected", "1 while connected to the network.", "network")
+)
+
+// ObserveTextRequest records how long a text provider request took and counts it when it failed
+func ObserveTextRequest(provider string, start time.Time, err error) {
+	TextRequestDuration.ObserveSince(start, provider)
+	if err != nil {
+		TextErrors.Inc(provider)
+	}
+}
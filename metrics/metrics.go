@@ -0,0 +1,255 @@
+package metrics
+
+import (
+	"aibird/logger"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The registry is package level, metrics are defined once in definitions.go and shared by every package
+var (
+	registryMutex sync.Mutex
+	families      []*family
+	collectors    []func()
+)
+
+// family is one metric name with a series for every combination of label values
+type family struct {
+	name    string
+	help    string
+	kind    string // counter, gauge or histogram
+	labels  []string
+	buckets []float64 // upper bounds, histograms only
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // counters and gauges
+	counts      []uint64 // per bucket, histograms only
+	sum         float64
+	count       uint64
+}
+
+func register(name, help, kind string, buckets []float64, labels []string) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	registryMutex.Lock()
+	families = append(families, f)
+	registryMutex.Unlock()
+	return f
+}
+
+// get returns the series for the label values, creating it on first use. It should only be called with mutex locked.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...), counts: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+	return s
+}
+
+// CounterVec is a count that only goes up, such as jobs finished
+type CounterVec struct{ f *family }
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{register(name, help, "counter", nil, labels)}
+}
+
+// Inc adds one to the series with the label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series with the label values
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	c.f.mutex.Lock()
+	defer c.f.mutex.Unlock()
+	c.f.get(labelValues).value += v
+}
+
+// GaugeVec is a value that goes up and down, such as queue depth
+type GaugeVec struct{ f *family }
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{register(name, help, "gauge", nil, labels)}
+}
+
+// Set sets the series with the label values to v
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.f.mutex.Lock()
+	defer g.f.mutex.Unlock()
+	g.f.get(labelValues).value = v
+}
+
+// Reset drops every series, so collectors that set the gauge on each scrape don't leave stale ones behind
+func (g *GaugeVec) Reset() {
+	g.f.mutex.Lock()
+	defer g.f.mutex.Unlock()
+	g.f.series = make(map[string]*series)
+}
+
+// HistogramVec counts observations into buckets, such as request durations
+type HistogramVec struct{ f *family }
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &HistogramVec{register(name, help, "histogram", sorted, labels)}
+}
+
+// Observe records v in the series with the label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.f.mutex.Lock()
+	defer h.f.mutex.Unlock()
+
+	s := h.f.get(labelValues)
+	for i, bound := range h.f.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// ObserveSince records the seconds since start
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// OnScrape registers a function that is run before every scrape, for gauges read from elsewhere
+func OnScrape(collect func()) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	collectors = append(collectors, collect)
+}
+
+// Write renders every metric in the Prometheus text exposition format
+func Write(w io.Writer) error {
+	registryMutex.Lock()
+	collect := append([]func(){}, collectors...)
+	registered := append([]*family{}, families...)
+	registryMutex.Unlock()
+
+	for _, c := range collect {
+		c()
+	}
+
+	var b strings.Builder
+	for _, f := range registered {
+		f.write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *family) write(b *strings.Builder) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, f.labelSet(s.labelValues, ""), formatValue(s.value))
+			continue
+		}
+
+		for i, bound := range f.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelSet(s.labelValues, formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelSet(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, f.labelSet(s.labelValues, ""), formatValue(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, f.labelSet(s.labelValues, ""), s.count)
+	}
+}
+
+// labelSet renders {name="value",...}, le is added for histogram buckets when set
+func (f *family) labelSet(values []string, le string) string {
+	var pairs []string
+	for i, label := range f.labels {
+		pairs = append(pairs, label+`="`+escapeLabel(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// Handler serves the metrics to Prometheus
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := Write(w); err != nil {
+			logger.Error("Error writing metrics", "error", err)
+		}
+	})
+}
+
+// Serve exposes /metrics on addr until ctx is cancelled
+func Serve(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		logger.Info("Serving metrics", "address", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Metrics listener stopped", "address", addr, "error", err)
+		}
+	}()
+}
@@ -0,0 +1,46 @@
+package queue
+
+import (
+	"aibird/image/comfyui"
+	"aibird/shared/meta"
+	"errors"
+	"strings"
+)
+
+// capable keeps the candidates check finds nothing missing on, or says what each one lacks
+func capable(candidates []*Backend, check func(meta.Backend) error) ([]*Backend, error) {
+	var kept []*Backend
+	var reasons []string
+	for _, b := range candidates {
+		if err := check(b.Name()); err != nil {
+			reasons = append(reasons, err.Error())
+			continue
+		}
+		kept = append(kept, b)
+	}
+	if len(kept) == 0 {
+		return nil, errors.New("none of the GPUs can run this right now: " + strings.Join(reasons, "; "))
+	}
+	return kept, nil
+}
+
+// probed reports whether any backend has been probed, after which the probes say which are online
+func (s *Scheduler) probed() bool {
+	for _, b := range s.Backends {
+		if _, ok := comfyui.Backends.Get(b.Name()); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// external is the number of prompts ComfyUI reported running or pending that aibird didn't queue,
+// from someone using the backend directly or another bot. The counts are dropped as each of our jobs
+// finishes, so a probe taken while one ran doesn't outlive it.
+func (b *Backend) external() int {
+	c, ok := comfyui.Backends.Get(b.Name())
+	if !ok || c.Err != nil {
+		return 0
+	}
+	return max(0, c.Running+c.Pending-b.Queue.Running())
+}
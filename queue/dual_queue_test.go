@@ -1,124 +0,0 @@
-package queue
-
-import (
-	"aibird/settings"
-	"testing"
-	"time"
-)
-
-// MockUser implements UserAccess interface for testing
-type MockUser struct {
-	accessLevel int
-	isAdmin     bool
-	isOwner     bool
-}
-
-func (u *MockUser) GetAccessLevel() int { return u.accessLevel }
-func (u *MockUser) CanUse4090() bool    { return u.accessLevel >= 2 || u.isAdmin || u.isOwner }
-func (u *MockUser) CanSkipQueue() bool  { return u.accessLevel >= 2 || u.isAdmin || u.isOwner }
-
-// MockState implements a minimal state for testing
-type MockState struct {
-	action string
-}
-
-func (s MockState) Action() string       { return s.action }
-func (s MockState) Message() string      { return "" }
-func (s MockState) Send(msg string)      {}
-func (s MockState) SendInfo(msg string)  {}
-func (s MockState) SendError(msg string) {}
-func (s MockState) FindArgument(key string, defaultValue interface{}) interface{} {
-	return defaultValue
-}
-func (s MockState) IsEmptyArguments() bool      { return true }
-func (s MockState) IsEmptyMessage() bool        { return true }
-func (s MockState) IsAction(action string) bool { return s.action == action }
-func (s MockState) GetConfig() *settings.Config { return nil }
-func (s MockState) Verify() error               { return nil }
-
-func TestDualQueueCreation(t *testing.T) {
-	dq := NewDualQueue()
-
-	if dq == nil {
-		t.Fatal("NewDualQueue() returned nil")
-	}
-
-	if dq.Queue4090 == nil {
-		t.Error("Queue4090 is nil")
-	}
-
-	if dq.Queue2070 == nil {
-		t.Error("Queue2070 is nil")
-	}
-}
-
-func TestDualQueueEnqueue(t *testing.T) {
-	// Test enqueueing an item - skip this test for now since we need proper state setup
-	// This would require more complex mocking of the state system
-	t.Skip("Skipping enqueue test - requires proper state mocking")
-}
-
-func TestDualQueueStatus(t *testing.T) {
-	dq := NewDualQueue()
-
-	// Test empty status
-	if !dq.IsEmpty() {
-		t.Error("New queue should be empty")
-	}
-
-	if dq.IsCurrentlyProcessing() {
-		t.Error("New queue should not be processing")
-	}
-
-	length4090, length2070 := dq.GetQueueLengths()
-	if length4090 != 0 || length2070 != 0 {
-		t.Error("New queue should have zero length")
-	}
-}
-
-func TestDualQueueProcessing(t *testing.T) {
-	dq := NewDualQueue()
-
-	// Start processing
-	go dq.ProcessQueues()
-
-	// Give it a moment to start
-	time.Sleep(100 * time.Millisecond)
-
-	// Test that processing loops are running
-	// This is a basic test - in a real scenario we'd want more comprehensive testing
-	if dq.IsCurrentlyProcessing() {
-		t.Error("Queue should not be processing when empty")
-	}
-}
-
-func TestDualQueueAdminControls(t *testing.T) {
-	// Skip this test for now due to logger initialization issues
-	t.Skip("Skipping admin controls test - requires logger initialization")
-}
-
-func TestDualQueueDetailedStatus(t *testing.T) {
-	dq := NewDualQueue()
-
-	status := dq.GetDetailedStatus()
-
-	if status == nil {
-		t.Fatal("GetDetailedStatus() returned nil")
-	}
-
-	if status.Queue4090Length != 0 {
-		t.Error("New queue should have zero 4090 length")
-	}
-
-	if status.Queue2070Length != 0 {
-		t.Error("New queue should have zero 2070 length")
-	}
-
-	if status.Processing4090 {
-		t.Error("New queue should not be processing on 4090")
-	}
-
-	if status.Processing2070 {
-		t.Error("New queue should not be processing on 2070")
-	}
-}
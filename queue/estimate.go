@@ -0,0 +1,167 @@
+package queue
+
+import (
+	"aibird/birdbase"
+	"aibird/logger"
+	"aibird/metrics"
+	"aibird/shared/meta"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	runtimeKeyPrefix = "queue_runtime_"
+	defaultRuntime   = time.Minute // expected run time of a model that has never finished on a backend
+	runtimeWindow    = 10          // number of recent runs the rolling average roughly covers
+)
+
+// runtimeStats is the rolling average run time of a model on a backend
+type runtimeStats struct {
+	Average time.Duration `json:"average"`
+	Runs    int           `json:"runs"`
+}
+
+// add folds a run into the average, a plain mean for the first runs and then a moving average
+func (r *runtimeStats) add(d time.Duration) {
+	r.Runs++
+	r.Average += (d - r.Average) / time.Duration(min(r.Runs, runtimeWindow))
+}
+
+// Estimate is where a waiting item is in its backend's queue and how long until it starts and finishes
+type Estimate struct {
+	Position int // 1 is next in line
+	Start    time.Duration
+	Finish   time.Duration
+}
+
+func runtimeKey(model string, backend meta.Backend) string {
+	return runtimeKeyPrefix + string(backend) + "_" + model
+}
+
+func (s *Scheduler) isPersistent() bool {
+	s.persistMutex.Lock()
+	defer s.persistMutex.Unlock()
+	return s.persistent
+}
+
+// runtimeUnsafe returns the stats for a key, loading them from birdbase the first time.
+// It should only be called with runtimeMutex locked.
+func (s *Scheduler) runtimeUnsafe(key string) *runtimeStats {
+	if stats, ok := s.runtimes[key]; ok {
+		return stats
+	}
+
+	stats := &runtimeStats{}
+	if s.isPersistent() && birdbase.Has(key) {
+		statsJson, err := birdbase.Get(key)
+		if err != nil {
+			logger.Error("Error loading run times from birdbase", "key", key, "error", err)
+		} else if err := json.Unmarshal(statsJson, stats); err != nil {
+			logger.Error("Error unmarshalling run times", "key", key, "error", err)
+		}
+	}
+
+	if s.runtimes == nil {
+		s.runtimes = make(map[string]*runtimeStats)
+	}
+	s.runtimes[key] = stats
+	return stats
+}
+
+// recordRuntime adds the wall clock time of a finished item to its model's stats on its backend
+func (s *Scheduler) recordRuntime(item QueueItem) {
+	if item.Status != StatusDone || item.StartedAt.IsZero() {
+		return
+	}
+
+	duration := item.FinishedAt.Sub(item.StartedAt)
+	metrics.JobDuration.Observe(duration.Seconds(), item.Model, string(item.Backend))
+
+	key := runtimeKey(item.Model, item.Backend)
+	s.runtimeMutex.Lock()
+	defer s.runtimeMutex.Unlock()
+
+	stats := s.runtimeUnsafe(key)
+	stats.add(duration)
+
+	if !s.isPersistent() {
+		return
+	}
+	statsJson, err := json.Marshal(stats)
+	if err != nil {
+		logger.Error("Error marshalling run times", "key", key, "error", err)
+		return
+	}
+	if err := birdbase.PutBytes(key, statsJson); err != nil {
+		logger.Error("Error saving run times to birdbase", "key", key, "error", err)
+	}
+}
+
+// expectedRuntime is the average run time of a model on a backend, or defaultRuntime without history
+func (s *Scheduler) expectedRuntime(model string, backend meta.Backend) time.Duration {
+	s.runtimeMutex.Lock()
+	defer s.runtimeMutex.Unlock()
+
+	stats := s.runtimeUnsafe(runtimeKey(model, backend))
+	if stats.Runs == 0 {
+		return defaultRuntime
+	}
+	return stats.Average
+}
+
+// remaining is how much longer a running item should take. Once ComfyUI reports progress it is
+// extrapolated from the time spent so far, until then it comes from the average run time.
+func (s *Scheduler) remaining(item QueueItem, now time.Time) time.Duration {
+	elapsed := now.Sub(item.StartedAt)
+	remaining := s.expectedRuntime(item.Model, item.Backend) - elapsed
+	if item.Progress > 0 {
+		remaining = time.Duration(float64(elapsed)/item.Progress) - elapsed
+	}
+	return max(remaining, 0)
+}
+
+// Estimate works out when the waiting item with the given ID should start and finish
+func (s *Scheduler) Estimate(id string) (Estimate, bool) {
+	for _, b := range s.Backends {
+		if estimate, ok := s.estimate(b, id); ok {
+			return estimate, true
+		}
+	}
+	return Estimate{}, false
+}
+
+// estimate plays the backend's queue forward, handing every item ahead to whichever worker frees up first
+func (s *Scheduler) estimate(b *Backend, id string) (Estimate, bool) {
+	running, items := b.Queue.order()
+	now := time.Now()
+
+	// free holds how long until each worker can take another item
+	free := make([]time.Duration, b.concurrency())
+	for i, item := range running {
+		if i < len(free) {
+			free[i] = s.remaining(item, now)
+		}
+	}
+
+	for i, item := range items {
+		worker := 0
+		for w := range free {
+			if free[w] < free[worker] {
+				worker = w
+			}
+		}
+
+		start := free[worker]
+		free[worker] += s.expectedRuntime(item.Model, b.Name())
+		if item.ID == id {
+			return Estimate{Position: i + 1, Start: start, Finish: free[worker]}, true
+		}
+	}
+	return Estimate{}, false
+}
+
+// FormatEstimate rounds a duration to whole seconds for IRC, never showing less than a second
+func FormatEstimate(d time.Duration) string {
+	return fmt.Sprintf("~%s", max(d.Round(time.Second), time.Second))
+}
@@ -0,0 +1,159 @@
+package queue
+
+import (
+	"aibird/birdbase"
+	"aibird/irc/networks"
+	"aibird/irc/state"
+	"aibird/logger"
+	"aibird/settings"
+	"encoding/json"
+	"fmt"
+
+	"github.com/lrstanley/girc"
+)
+
+const jobsKey = "queue_jobs"
+
+// Restore loads the jobs saved by a previous run and turns on persistence.
+// The jobs are replayed by Resume once their network and channel are back.
+func (s *Scheduler) Restore(jobRetries int) {
+	s.persistMutex.Lock()
+	s.jobRetries = jobRetries
+	s.persistent = true
+
+	if birdbase.Has(jobsKey) {
+		jobsJson, err := birdbase.Get(jobsKey)
+		if err != nil {
+			logger.Error("Error loading queued jobs from birdbase", "key", jobsKey, "error", err)
+		} else if err := json.Unmarshal(jobsJson, &s.pending); err != nil {
+			logger.Error("Error unmarshalling queued jobs", "key", jobsKey, "error", err)
+		}
+	}
+	restored := len(s.pending)
+	s.persistMutex.Unlock()
+
+	if restored > 0 {
+		logger.Info("Restored queued jobs", "jobs", restored)
+	}
+	s.persist()
+}
+
+// Resume replays the restored jobs for a channel once the bot has joined it. An empty channel
+// resumes the jobs that were sent in private messages.
+func (s *Scheduler) Resume(c *girc.Client, network *networks.Network, config *settings.Config, channel string) {
+	s.persistMutex.Lock()
+	var jobs, remaining []Job
+	for _, job := range s.pending {
+		private := !girc.IsValidChannel(job.Channel)
+		if job.Network == network.NetworkName && (job.Channel == channel || (channel == "" && private)) {
+			jobs = append(jobs, job)
+		} else {
+			remaining = append(remaining, job)
+		}
+	}
+	s.pending = remaining
+	s.persistMutex.Unlock()
+
+	if len(jobs) == 0 {
+		return
+	}
+
+	for _, job := range jobs {
+		irc, err := state.Rehydrate(c, network, config, &girc.Source{Name: job.Nick, Ident: job.Ident, Host: job.Host}, job.Channel, state.Command{Action: job.Action, Message: job.Message}, job.Arguments)
+		if err != nil {
+			logger.Warn("Dropping queued job that could not be restored", "id", job.ID, "action", job.Action, "error", err)
+			continue
+		}
+
+		// Attempts only counts runs that were started, so anything over the retry limit died mid-run too often
+		if job.Attempts > s.jobRetries {
+			logger.Warn("Dropping queued job after too many interrupted attempts", "id", job.ID, "action", job.Action, "attempts", job.Attempts)
+			irc.SendError(fmt.Sprintf("%s: your %s request was interrupted %d times, giving up on it", job.Nick, job.Action, job.Attempts))
+			continue
+		}
+
+		b := s.GetBackend(job.Backend)
+		if b == nil {
+			b = s.fallbackBackend()
+		}
+
+		item := QueueItem{
+			Item: Item{
+				State:    irc,
+				Function: s.Runner,
+			},
+			ID:         job.ID,
+			Model:      job.Model,
+			Family:     modelFamily(job.Model),
+			User:       irc.User,
+			Backend:    b.Name(),
+			Attempts:   job.Attempts,
+			Retries:    job.Retries,
+			FailedOn:   job.FailedOn,
+			EnqueuedAt: job.EnqueuedAt,
+		}
+		b.Queue.push(item)
+
+		logger.Info("Resumed queued job", "id", job.ID, "action", job.Action, "backend", b.Name())
+		irc.SendInfo(fmt.Sprintf("%s: the bot restarted, your %s request has resumed", job.Nick, job.Action))
+	}
+
+	s.persist()
+}
+
+// persist saves every queued, running and not yet resumed job to birdbase
+func (s *Scheduler) persist() {
+	s.persistMutex.Lock()
+	defer s.persistMutex.Unlock()
+
+	if !s.persistent || s.stopped {
+		return
+	}
+
+	jobs := append([]Job{}, s.pending...)
+	for _, b := range s.Backends {
+		running, items := b.Queue.snapshot()
+		for _, item := range append(running, items...) {
+			jobs = append(jobs, newJob(item))
+		}
+	}
+
+	jobsJson, err := json.Marshal(jobs)
+	if err != nil {
+		logger.Error("Error marshalling queued jobs", "error", err)
+		return
+	}
+
+	if err := birdbase.PutBytes(jobsKey, jobsJson); err != nil {
+		logger.Error("Error saving queued jobs to birdbase", "key", jobsKey, "error", err)
+	}
+}
+
+func newJob(item QueueItem) Job {
+	job := Job{
+		ID:         item.ID,
+		Action:     item.State.Action(),
+		Message:    item.State.Message(),
+		Arguments:  item.State.Arguments,
+		Model:      item.Model,
+		Backend:    item.Backend,
+		Attempts:   item.Attempts,
+		Retries:    item.Retries,
+		FailedOn:   item.FailedOn,
+		EnqueuedAt: item.EnqueuedAt,
+	}
+
+	if item.State.Network != nil {
+		job.Network = item.State.Network.NetworkName
+	}
+	if item.State.Channel != nil {
+		job.Channel = item.State.Channel.Name
+	}
+	if source := item.State.Event.Source; source != nil {
+		job.Nick = source.Name
+		job.Ident = source.Ident
+		job.Host = source.Host
+	}
+
+	return job
+}
@@ -0,0 +1,188 @@
+package queue
+
+import (
+	"fmt"
+	"math"
+)
+
+// Scheduling policy names as used by comfyui.schedulingPolicy
+const (
+	PolicyRoundRobin = "round-robin"
+	PolicyWeighted   = "weighted"
+	PolicyPriority   = "priority"
+)
+
+// Policy decides which waiting item of a queue runs next
+type Policy interface {
+	// Next returns the index of the item to run next. items is never empty and is in arrival order.
+	// Next must not change the policy, so it can also be used to work out queue positions.
+	Next(items []QueueItem) int
+	// Served records that items[next] was taken from the queue, items is the queue before removing it
+	Served(items []QueueItem, next int)
+	// Clone returns an independent copy, used to play the queue forward without touching the real one
+	Clone() Policy
+}
+
+// forgetter is a policy that remembers users, told who has items queued or running as each item finishes
+type forgetter interface {
+	forget(active map[string]bool)
+}
+
+// NewPolicy returns the policy with the given name, an empty name is round-robin
+func NewPolicy(name string) (Policy, error) {
+	switch name {
+	case "", PolicyRoundRobin:
+		return &RoundRobinPolicy{lastServed: make(map[string]uint64)}, nil
+	case PolicyWeighted:
+		return &WeightedPolicy{finish: make(map[string]float64)}, nil
+	case PolicyPriority:
+		return PriorityPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown scheduling policy %q", name)
+	}
+}
+
+// OwnerKey identifies who queued an item, ident@host on a network so nick changes don't matter
+func OwnerKey(network, ident, host string) string {
+	return network + "/" + ident + "@" + host
+}
+
+func ownerKey(item QueueItem) string {
+	ident, host := "", ""
+	if source := item.State.Event.Source; source != nil {
+		ident, host = source.Ident, source.Host
+	}
+	return OwnerKey(item.NetworkName(), ident, host)
+}
+
+func accessLevel(item QueueItem) int {
+	if item.User == nil {
+		return 0
+	}
+	return item.User.GetAccessLevel()
+}
+
+// RoundRobinPolicy takes turns between users, whoever was served longest ago goes next
+type RoundRobinPolicy struct {
+	turn       uint64
+	lastServed map[string]uint64
+}
+
+func (p *RoundRobinPolicy) Next(items []QueueItem) int {
+	next := 0
+	nextServed := p.lastServed[ownerKey(items[0])]
+	for i, item := range items[1:] {
+		if served := p.lastServed[ownerKey(item)]; served < nextServed {
+			next = i + 1
+			nextServed = served
+		}
+	}
+	return next
+}
+
+func (p *RoundRobinPolicy) Served(items []QueueItem, next int) {
+	p.turn++
+	p.lastServed[ownerKey(items[next])] = p.turn
+}
+
+// forget drops the turns of users with nothing queued or running, once the last was before that of
+// every user who has. They would go first anyway, as a user never served does, so it changes no
+// order and keeps the map to the users that matter.
+func (p *RoundRobinPolicy) forget(active map[string]bool) {
+	oldest := uint64(math.MaxUint64)
+	for owner := range active {
+		oldest = min(oldest, p.lastServed[owner])
+	}
+	for owner, served := range p.lastServed {
+		if !active[owner] && served < oldest {
+			delete(p.lastServed, owner)
+		}
+	}
+}
+
+func (p *RoundRobinPolicy) Clone() Policy {
+	clone := &RoundRobinPolicy{turn: p.turn, lastServed: make(map[string]uint64, len(p.lastServed))}
+	for owner, served := range p.lastServed {
+		clone.lastServed[owner] = served
+	}
+	return clone
+}
+
+// WeightedPolicy is self-clocked weighted fair queuing, a user with access level n gets n+1 turns
+// for every turn of a free user
+type WeightedPolicy struct {
+	now    float64            // virtual time, the finish tag of the last served item
+	finish map[string]float64 // finish tag of the last served item of every user with items waiting
+}
+
+// tag is the virtual finish time the user's next item would get. Users that just started waiting
+// start from the current virtual time, so they can't bank turns while away.
+func (p *WeightedPolicy) tag(item QueueItem) float64 {
+	start, waiting := p.finish[ownerKey(item)]
+	if !waiting {
+		start = p.now
+	}
+	return start + 1/float64(accessLevel(item)+1)
+}
+
+func (p *WeightedPolicy) Next(items []QueueItem) int {
+	next := 0
+	nextTag := p.tag(items[0])
+	for i, item := range items[1:] {
+		if tag := p.tag(item); tag < nextTag {
+			next = i + 1
+			nextTag = tag
+		}
+	}
+	return next
+}
+
+func (p *WeightedPolicy) Served(items []QueueItem, next int) {
+	tag := p.tag(items[next])
+
+	// Pin the start of users that began waiting since the last turn, and forget users
+	// that have nothing left once this item is gone
+	remaining := make(map[string]bool)
+	for i, item := range items {
+		owner := ownerKey(item)
+		if i != next {
+			remaining[owner] = true
+		}
+		if _, waiting := p.finish[owner]; !waiting {
+			p.finish[owner] = p.now
+		}
+	}
+
+	p.finish[ownerKey(items[next])] = tag
+	p.now = tag
+
+	for owner := range p.finish {
+		if !remaining[owner] {
+			delete(p.finish, owner)
+		}
+	}
+}
+
+func (p *WeightedPolicy) Clone() Policy {
+	clone := &WeightedPolicy{now: p.now, finish: make(map[string]float64, len(p.finish))}
+	for owner, finish := range p.finish {
+		clone.finish[owner] = finish
+	}
+	return clone
+}
+
+// PriorityPolicy runs items from users who can skip the queue first, first come first served within each group
+type PriorityPolicy struct{}
+
+func (PriorityPolicy) Next(items []QueueItem) int {
+	for i, item := range items {
+		if item.User != nil && item.User.CanSkipQueue() {
+			return i
+		}
+	}
+	return 0
+}
+
+func (PriorityPolicy) Served([]QueueItem, int) {}
+
+func (p PriorityPolicy) Clone() Policy { return p }
@@ -2,21 +2,46 @@ package queue
 
 import (
 	"aibird/logger"
-	"errors"
+	"aibird/shared/meta"
+	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 )
 
 // Queue represents a queue data structure
-// Now stores QueueItem instead of Item
-
+// Workers block in take until an item is added or the queue is closed, so there is no polling.
+// Everything below is guarded by mutex, which makes taking an item and marking it running one step.
 type Queue struct {
-	elements        []QueueItem
-	mutex           sync.Mutex
-	processing      bool
-	processingMutex sync.Mutex
-	processingItem  *QueueItem // currently processing item
+	elements []QueueItem
+	policy   Policy // picks the next item, nil is first in first out
+	limit    int    // most items Enqueue lets wait, see NewQueue
+	running  []*runningItem
+	closed   bool
+	mutex    sync.Mutex
+	cond     *sync.Cond // signalled when an item is added or the queue is closed
+}
+
+// runningItem is an item a worker is processing and the function that cancels it
+type runningItem struct {
+	item   *QueueItem
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// defaultQueueSize is how many items may wait in a queue when comfyui.maxQueueSize isn't set
+const defaultQueueSize = 10
+
+// NewQueue creates a queue that takes items in the order the policy picks them and lets up to limit
+// wait, 0 is defaultQueueSize
+func NewQueue(policy Policy, limit int) *Queue {
+	if limit <= 0 {
+		limit = defaultQueueSize
+	}
+	q := &Queue{policy: policy, limit: limit}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
 }
 
 // Enqueue adds an element to the end of the queue
@@ -24,12 +49,12 @@ func (q *Queue) Enqueue(element QueueItem) (string, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
-	if q.hasElementsUnsafe(11) {
-		return "", errors.New("the queue is currently full (limit is 10), please try again in a few minutes")
+	if q.hasElementsUnsafe(q.limit) {
+		return "", fmt.Errorf("the queue is currently full (limit is %d), please try again in a few minutes", q.limit)
 	}
 
 	queueLen := len(q.elements) // queue length before adding
-	q.elements = append(q.elements, element)
+	q.pushUnsafe(element)
 
 	// Only return a queue message if there are items in the queue
 	// If queue is empty, return empty string so no message is sent
@@ -46,38 +71,140 @@ func (q *Queue) Enqueue(element QueueItem) (string, error) {
 	}()), nil
 }
 
-// EnqueueFront adds an element to the start of the queue and returns a message if not empty.
-// If msg is empty, uses the default VIP message.
-func (q *Queue) EnqueueFront(element QueueItem, msg string) (string, error) {
+// push adds an element without checking the queue limit, used for replayed jobs
+func (q *Queue) push(element QueueItem) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
+	q.pushUnsafe(element)
+}
 
-	wasEmpty := len(q.elements) == 0
-	q.elements = append([]QueueItem{element}, q.elements...)
-
-	if wasEmpty {
-		return "", nil
-	}
-
-	if msg == "" {
-		msg = "Your elite patreon status has put you at the front of the queue!"
+func (q *Queue) pushUnsafe(element QueueItem) {
+	element.Status = StatusQueued
+	element.pinned = false
+	if element.EnqueuedAt.IsZero() {
+		element.EnqueuedAt = time.Now()
 	}
-	return msg, nil
+	q.elements = append(q.elements, element)
+	q.cond.Signal()
 }
 
-// Dequeue removes and returns the first element of the queue
+// Dequeue removes and returns the element the policy picks, or the first one without a policy
 func (q *Queue) Dequeue() *QueueItem {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
+	return q.dequeueUnsafe()
+}
 
+func (q *Queue) dequeueUnsafe() *QueueItem {
 	if len(q.elements) == 0 {
 		return nil
 	}
-	element := q.elements[0]
-	q.elements = q.elements[1:]
+
+	next := nextIndex(q.policy, q.elements)
+	if q.policy != nil {
+		q.policy.Served(q.elements, next)
+	}
+
+	element := q.elements[next]
+	q.elements = append(q.elements[:next], q.elements[next+1:]...)
 	return &element
 }
 
+// nextIndex returns the item to take next. Items pinned by Move are always at the front and go first,
+// the policy is still told about them so it keeps count of who was served.
+func nextIndex(policy Policy, items []QueueItem) int {
+	if policy == nil || items[0].pinned {
+		return 0
+	}
+	return policy.Next(items)
+}
+
+// take blocks until there is an item to run or the queue is closed. The item is marked running
+// and gets a context derived from ctx that CancelCurrent cancels. ok is false once the queue is closed.
+func (q *Queue) take(ctx context.Context) (item *QueueItem, itemCtx context.Context, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.elements) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, nil, false
+	}
+
+	item = q.dequeueUnsafe()
+	if err := item.transition(StatusRunning); err != nil {
+		logger.Error("Queue: invalid item transition", "action", item.State.Action(), "error", err)
+	}
+	item.Attempts++
+	item.StartedAt = time.Now()
+
+	itemCtx, cancel := context.WithCancel(ctx)
+	itemCtx = meta.WithProgress(itemCtx, func(node string, value, max int) {
+		if max <= 0 {
+			return
+		}
+		q.mutex.Lock()
+		item.Progress = float64(value) / float64(max)
+		item.Node = node
+		q.mutex.Unlock()
+	})
+	q.running = append(q.running, &runningItem{item: item, ctx: itemCtx, cancel: cancel})
+	return item, itemCtx, true
+}
+
+// finish marks a running item as done, failed or cancelled depending on how its function returned
+func (q *Queue) finish(item *QueueItem, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	status := StatusDone
+	for i, r := range q.running {
+		if r.item != item {
+			continue
+		}
+		switch {
+		case r.ctx.Err() != nil:
+			status = StatusCancelled
+		case err != nil:
+			status = StatusFailed
+		}
+		r.cancel()
+		q.running = append(q.running[:i], q.running[i+1:]...)
+		break
+	}
+
+	if transitionErr := item.transition(status); transitionErr != nil {
+		logger.Error("Queue: invalid item transition", "action", item.State.Action(), "error", transitionErr)
+	}
+	item.Err = err
+	item.FinishedAt = time.Now()
+
+	if f, ok := q.policy.(forgetter); ok {
+		f.forget(q.activeOwnersUnsafe())
+	}
+}
+
+// activeOwnersUnsafe returns the users with items queued or running, the mutex must be held
+func (q *Queue) activeOwnersUnsafe() map[string]bool {
+	active := make(map[string]bool, len(q.elements)+len(q.running))
+	for _, item := range q.elements {
+		active[ownerKey(item)] = true
+	}
+	for _, r := range q.running {
+		active[ownerKey(*r.item)] = true
+	}
+	return active
+}
+
+// Close wakes every worker blocked in take and makes them return
+func (q *Queue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
 // IsEmpty checks if the queue is empty
 func (q *Queue) IsEmpty() bool {
 	q.mutex.Lock()
@@ -107,7 +234,14 @@ func (q *Queue) GetQueueLength() int {
 
 // IsCurrentlyProcessing returns whether an item is actively being processed
 func (q *Queue) IsCurrentlyProcessing() bool {
-	return q.isProcessing()
+	return q.Running() > 0
+}
+
+// Running returns the number of items being processed
+func (q *Queue) Running() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.running)
 }
 
 // hasElementsUnsafe is an internal function that checks queue size without locking
@@ -116,62 +250,6 @@ func (q *Queue) hasElementsUnsafe(amount int) bool {
 	return len(q.elements) >= amount
 }
 
-// setProcessing sets the processing flag to indicate a task is being processed
-func (q *Queue) setProcessing(value bool) {
-	q.processingMutex.Lock()
-	defer q.processingMutex.Unlock()
-	q.processing = value
-}
-
-// isProcessing checks if a task is currently being processed
-func (q *Queue) isProcessing() bool {
-	q.processingMutex.Lock()
-	defer q.processingMutex.Unlock()
-	return q.processing
-}
-
-// ProcessQueue continuously processes elements in the queue
-func (q *Queue) ProcessQueue() {
-	for {
-		// Only process if we're not already processing and there are items in the queue
-		if !q.isProcessing() && !q.IsEmpty() {
-			logger.Debug("Queue: Starting to process next item", "queue_length", q.Len())
-
-			// Mark as processing before dequeuing to prevent race conditions
-			q.setProcessing(true)
-
-			// Get the next item from the queue
-			element := q.Dequeue()
-
-			// Set the currently processing item
-			q.setProcessingItem(element)
-
-			// Process the item if it's a valid function
-			if element != nil {
-				// Execute the function in a goroutine but maintain processing flag
-				go func() {
-					logger.Debug("Queue: Executing function")
-					// Execute the function
-					element.Function(element.State, element.GPU)
-
-					// Mark as not processing when done
-					q.setProcessing(false)
-					q.setProcessingItem(nil)
-					logger.Debug("Queue: Function completed", "queue_length", q.Len())
-				}()
-			} else {
-				// If not a valid function, reset processing flag
-				q.setProcessing(false)
-				q.setProcessingItem(nil)
-				logger.Debug("Queue: Dequeued item was not a function")
-			}
-		}
-
-		// Sleep to prevent CPU hogging
-		time.Sleep(100 * time.Millisecond)
-	}
-}
-
 // Len returns the current number of items in the queue
 func (q *Queue) Len() int {
 	q.mutex.Lock()
@@ -179,14 +257,14 @@ func (q *Queue) Len() int {
 	return len(q.elements)
 }
 
-// Peek returns the first element of the queue without removing it
+// Peek returns the element Dequeue would return next without removing it
 func (q *Queue) Peek() *QueueItem {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 	if len(q.elements) == 0 {
 		return nil
 	}
-	return &q.elements[0]
+	return &q.elements[nextIndex(q.policy, q.elements)]
 }
 
 // GetActionList returns a slice of the action strings for each item in the queue
@@ -201,6 +279,98 @@ func (q *Queue) GetActionList() []string {
 	return actions
 }
 
+// snapshot returns copies of the running items and of the waiting items
+func (q *Queue) snapshot() ([]QueueItem, []QueueItem) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.snapshotUnsafe()
+}
+
+func (q *Queue) snapshotUnsafe() ([]QueueItem, []QueueItem) {
+	running := make([]QueueItem, 0, len(q.running))
+	for _, r := range q.running {
+		running = append(running, *r.item)
+	}
+	items := make([]QueueItem, len(q.elements))
+	copy(items, q.elements)
+	return running, items
+}
+
+// order is snapshot with the waiting items in the order they will be taken, worked out on a copy of the policy
+func (q *Queue) order() ([]QueueItem, []QueueItem) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.orderUnsafe()
+}
+
+func (q *Queue) orderUnsafe() ([]QueueItem, []QueueItem) {
+	running, items := q.snapshotUnsafe()
+	if q.policy == nil {
+		return running, items
+	}
+
+	policy := q.policy.Clone()
+	ordered := make([]QueueItem, 0, len(items))
+	for len(items) > 0 {
+		next := nextIndex(policy, items)
+		policy.Served(items, next)
+		ordered = append(ordered, items[next])
+		items = append(items[:next], items[next+1:]...)
+	}
+	return running, ordered
+}
+
+// Find returns a copy of the running or waiting item with the given ID
+func (q *Queue) Find(id string) (QueueItem, bool) {
+	running, items := q.snapshot()
+	for _, item := range append(running, items...) {
+		if item.ID == id {
+			return item, true
+		}
+	}
+	return QueueItem{}, false
+}
+
+// Move puts the waiting item with the given ID at position, 1 being next. The items up to that position
+// are pinned in that order ahead of the policy, the ones after it are still up to the policy.
+// It returns false if no waiting item has the ID.
+func (q *Queue) Move(id string, position int) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	_, ordered := q.orderUnsafe()
+	from := -1
+	for i, item := range ordered {
+		if item.ID == id {
+			from = i
+			break
+		}
+	}
+	if from == -1 {
+		return false
+	}
+
+	position = min(max(position, 1), len(ordered))
+	moved := ordered[from]
+	ordered = append(ordered[:from], ordered[from+1:]...)
+	ordered = append(ordered[:position-1], append([]QueueItem{moved}, ordered[position-1:]...)...)
+
+	pinned := make(map[string]bool, position)
+	elements := make([]QueueItem, 0, len(ordered))
+	for _, item := range ordered[:position] {
+		item.pinned = true
+		pinned[item.ID] = true
+		elements = append(elements, item)
+	}
+	for _, item := range q.elements {
+		if !pinned[item.ID] {
+			elements = append(elements, item)
+		}
+	}
+	q.elements = elements
+	return true
+}
+
 // Clear removes all items from the queue
 func (q *Queue) Clear() {
 	q.mutex.Lock()
@@ -209,35 +379,65 @@ func (q *Queue) Clear() {
 	logger.Info("Queue cleared")
 }
 
-// RemoveCurrent removes the currently processing item
-func (q *Queue) RemoveCurrent() bool {
-	q.processingMutex.Lock()
-	defer q.processingMutex.Unlock()
+// Count returns how many waiting and running items match
+func (q *Queue) Count(match func(QueueItem) bool) int {
+	running, items := q.snapshot()
+
+	count := 0
+	for _, item := range append(running, items...) {
+		if match(item) {
+			count++
+		}
+	}
+	return count
+}
+
+// Remove drops every waiting item that matches and returns how many were removed
+func (q *Queue) Remove(match func(QueueItem) bool) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
 
-	if q.processing {
-		// Send cancellation message to user if we have access to the current item
-		// For now, just mark as not processing
-		q.processing = false
-		logger.Info("Current processing item removed")
-		return true
+	kept := q.elements[:0]
+	for _, item := range q.elements {
+		if !match(item) {
+			kept = append(kept, item)
+		}
 	}
+	removed := len(q.elements) - len(kept)
+	q.elements = kept
+	return removed
+}
 
-	return false
+// RemoveCurrent cancels the items being processed. They keep their worker until their function
+// has returned, so the next item can't start on the same GPU early.
+func (q *Queue) RemoveCurrent() bool {
+	return q.CancelCurrent(func(QueueItem) bool { return true })
 }
 
-// Set the currently processing item
-func (q *Queue) setProcessingItem(item *QueueItem) {
-	q.processingMutex.Lock()
-	defer q.processingMutex.Unlock()
-	q.processingItem = item
+// CancelCurrent cancels the items being processed that match
+func (q *Queue) CancelCurrent(match func(QueueItem) bool) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	cancelled := false
+	for _, r := range q.running {
+		if match(*r.item) {
+			r.cancel()
+			cancelled = true
+			logger.Info("Current processing item cancelled", "action", r.item.State.Action())
+		}
+	}
+	return cancelled
 }
 
-// Get the currently processing action (or empty string if none)
+// Get the currently processing actions (or empty string if none)
 func (q *Queue) GetProcessingAction() string {
-	q.processingMutex.Lock()
-	defer q.processingMutex.Unlock()
-	if q.processingItem != nil {
-		return q.processingItem.State.Action()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	actions := make([]string, 0, len(q.running))
+	for _, r := range q.running {
+		actions = append(actions, r.item.State.Action())
 	}
-	return ""
+	return strings.Join(actions, ", ")
 }
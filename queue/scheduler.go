@@ -0,0 +1,679 @@
+package queue
+
+import (
+	"aibird/image/comfyui"
+	"aibird/logger"
+	"aibird/metrics"
+	"aibird/settings"
+	"aibird/shared/meta"
+	"aibird/status"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNoSuchJob   = errors.New("there is no queued or running request with that ID")
+	ErrNotJobOwner = errors.New("you can only cancel your own requests")
+	ErrJobRunning  = errors.New("that request is already running")
+)
+
+// NewScheduler creates one queue for every [[comfyui.ports]] entry, in config order.
+// Each queue gets its own instance of the configured scheduling policy.
+func NewScheduler(config settings.ComfyUiConfig) *Scheduler {
+	s := &Scheduler{failoverRetries: config.FailoverRetries}
+	for _, port := range config.Ports {
+		policy, err := NewPolicy(config.SchedulingPolicy)
+		if err != nil {
+			logger.Warn("Falling back to round-robin scheduling", "backend", port.Name, "error", err)
+			policy, _ = NewPolicy(PolicyRoundRobin)
+		}
+		s.Backends = append(s.Backends, &Backend{
+			Config: port,
+			Queue:  NewQueue(policy, config.MaxQueueSize),
+		})
+	}
+	return s
+}
+
+// Name returns the backend name used for routing
+func (b *Backend) Name() meta.Backend {
+	return meta.Backend(b.Config.Name)
+}
+
+// concurrency is the number of jobs the backend runs at the same time
+func (b *Backend) concurrency() int {
+	if b.Config.Concurrency < 1 {
+		return 1
+	}
+	return b.Config.Concurrency
+}
+
+// load is the number of items queued or running on the backend, counting work ComfyUI has from
+// elsewhere
+func (b *Backend) load() int {
+	return b.Queue.GetQueueLength() + b.Queue.Running() + b.external()
+}
+
+// idle reports whether a new item would start straight away
+func (b *Backend) idle() bool {
+	return b.load() < b.concurrency()
+}
+
+// Suspect reports whether the backend's last job timed out
+func (b *Backend) Suspect() bool {
+	return b.suspect.Load()
+}
+
+// GetBackend returns the backend with the given name, or nil if there is none
+func (s *Scheduler) GetBackend(name meta.Backend) *Backend {
+	for _, b := range s.Backends {
+		if b.Name() == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// BackendNames returns the configured backend names in config order
+func (s *Scheduler) BackendNames() []string {
+	names := make([]string, 0, len(s.Backends))
+	for _, b := range s.Backends {
+		names = append(names, b.Config.Name)
+	}
+	return names
+}
+
+// newItemID returns a short ID for !queue that no queued or running item has
+func (s *Scheduler) newItemID() string {
+	for {
+		id := strings.SplitN(uuid.NewString(), "-", 2)[0]
+		if _, _, ok := s.findJob(id); !ok {
+			return id
+		}
+	}
+}
+
+// findJob returns the running or waiting item with the given ID and its backend
+func (s *Scheduler) findJob(id string) (*Backend, QueueItem, bool) {
+	for _, b := range s.Backends {
+		if item, ok := b.Queue.Find(id); ok {
+			return b, item, true
+		}
+	}
+	return nil, QueueItem{}, false
+}
+
+// fallbackBackend returns the smallest backend, used for commands that don't need a big GPU
+func (s *Scheduler) fallbackBackend() *Backend {
+	fallback := s.Backends[0]
+	for _, b := range s.Backends[1:] {
+		if b.Config.Vram < fallback.Config.Vram {
+			fallback = b
+		}
+	}
+	return fallback
+}
+
+func (s *Scheduler) Enqueue(item QueueItem) (string, error) {
+	msg, err := s.enqueue(item)
+	if err == nil {
+		s.persist()
+	}
+	return msg, err
+}
+
+func (s *Scheduler) enqueue(item QueueItem) (string, error) {
+	rig, rigErr := s.rigStatus(item)
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if len(s.Backends) == 0 {
+		return "", errors.New("no ComfyUI backends are configured")
+	}
+
+	if item.ID == "" {
+		item.ID = s.newItemID()
+	}
+	if item.Function == nil {
+		item.Function = s.Runner
+	}
+
+	if config := item.State.Config; config != nil && config.AiBird.MaxQueuedPerUser > 0 {
+		limit := config.AiBird.MaxQueuedPerUser
+		if queued := s.countOwned(ownerKey(item)); queued >= limit {
+			return "", fmt.Errorf("you already have %d queued requests (the limit is %d), wait for one to finish first", queued, limit)
+		}
+	}
+
+	candidates, err := s.compatible(item, rig, rigErr)
+	if err != nil {
+		return "", err
+	}
+	item.Family = modelFamily(item.Model)
+
+	chosen, preferred := selectBackend(candidates)
+	msg := ""
+	if chosen != preferred {
+		msg = fmt.Sprintf("%s is busy, your request is being processed on the %s instead.", preferred.Config.Name, chosen.Config.Name)
+	}
+
+	return s.enqueueOn(chosen, item, msg)
+}
+
+// enqueueOn adds the item to the backend's queue. Unless it starts straight away the reply says
+// where it is in line and when it should be ready, after msg when that is set.
+func (s *Scheduler) enqueueOn(b *Backend, item QueueItem, msg string) (string, error) {
+	item.Backend = b.Name()
+	if _, err := b.Queue.Enqueue(item); err != nil {
+		return "", err
+	}
+
+	if estimate, ok := s.estimate(b, item.ID); ok && estimate.Start > 0 {
+		eta := fmt.Sprintf("Your request is at position %d on the %s, starting in %s and ready in %s.", estimate.Position, b.Config.Name, FormatEstimate(estimate.Start), FormatEstimate(estimate.Finish))
+		msg = strings.TrimSpace(msg + " " + eta)
+	}
+	return msg, nil
+}
+
+// rigStatus asks the status service about the rig for an item that is a ComfyUI workflow. It is
+// called before the scheduler is locked, a slow status service would otherwise hold up the queue.
+// Without a backend that runs in a container or yields to Steam the rig has nothing to say, the
+// backends' probes alone decide.
+func (s *Scheduler) rigStatus(item QueueItem) (*status.StatusResponse, error) {
+	if !s.watchesRig() {
+		return nil, nil
+	}
+	if _, ok := comfyui.Workflows.Get(item.Model); !ok {
+		return nil, nil
+	}
+	if item.State.Config == nil {
+		return nil, errors.New("no status service is configured")
+	}
+	return status.NewClient(item.State.Config.AiBird).GetStatus()
+}
+
+// watchesRig reports whether any backend depends on the rig, running in a container or yielding to
+// Steam
+func (s *Scheduler) watchesRig() bool {
+	for _, b := range s.Backends {
+		if b.Config.Container != "" || b.Config.YieldToSteam {
+			return true
+		}
+	}
+	return false
+}
+
+// compatible returns the backends that can run the item: the fallback backend for commands that
+// aren't ComfyUI workflows, otherwise the running backends the user may run the workflow on that
+// have every node and model it needs. rig and rigErr are what rigStatus returned for the item.
+func (s *Scheduler) compatible(item QueueItem, rig *status.StatusResponse, rigErr error) ([]*Backend, error) {
+	workflow, ok := comfyui.Workflows.Get(item.Model)
+	if !ok {
+		// Not a ComfyUI workflow, treat as text command or other non-workflow command
+		logger.Debug("Enqueuing non-workflow command", "model", item.Model)
+		return []*Backend{s.fallbackBackend()}, nil
+	}
+
+	// Handle ComfyUI workflows
+	metaData := workflow.Meta
+	if workflow.Err != nil {
+		return nil, errors.New("could not load workflow metadata for this model")
+	}
+
+	if rigErr != nil {
+		if !s.probed() {
+			return nil, errors.New("AI rig is offline!!! Sorry pal")
+		}
+		// The backends' own probes still say which of them are up
+		logger.Warn("Status service unavailable, routing by backend probes", "error", rigErr)
+		rig = nil
+	}
+
+	candidates, err := s.candidates(metaData, item.User, rig)
+	if err != nil {
+		return nil, err
+	}
+	return capable(candidates, func(backend meta.Backend) error {
+		return comfyui.Backends.Check(backend, workflow)
+	})
+}
+
+// failover requeues an item whose backend failed under it, on a compatible backend it hasn't failed on
+// yet or, when there is none, on any compatible one. It reports whether the item was requeued.
+func (s *Scheduler) failover(from *Backend, item QueueItem) bool {
+	if item.Status != StatusFailed || !comfyui.IsTransient(item.Err) || item.Retries >= s.failoverRetries {
+		return false
+	}
+	rig, rigErr := s.rigStatus(item)
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	candidates, err := s.compatible(item, rig, rigErr)
+	if err != nil {
+		logger.Warn("No backend to retry a failed job on", "id", item.ID, "backend", from.Name(), "error", err)
+		return false
+	}
+
+	item.FailedOn = append(slices.Clone(item.FailedOn), from.Name())
+	var alternates []*Backend
+	for _, b := range candidates {
+		if !slices.Contains(item.FailedOn, b.Name()) {
+			alternates = append(alternates, b)
+		}
+	}
+	if len(alternates) == 0 {
+		alternates = candidates
+	}
+	to, _ := selectBackend(alternates)
+
+	item.Retries++
+	item.Attempts = 0 // Attempts counts runs cut short by a restart, this one ended
+	item.Err = nil
+	item.StartedAt, item.FinishedAt, item.Progress, item.Node = time.Time{}, time.Time{}, 0, ""
+	item.Backend = to.Name()
+	to.Queue.push(item)
+
+	logger.Info("Retrying failed job on another backend", "id", item.ID, "from", from.Name(), "to", to.Name(), "retry", item.Retries)
+	notify(item, fmt.Sprintf("%s: the %s failed, retrying your %s request on the %s (retry %d of %d)", item.Nick(), from.Name(), item.State.Action(), to.Name(), item.Retries, s.failoverRetries))
+	return true
+}
+
+// notify tells whoever queued the item, items built without an IRC client have nobody to tell
+func notify(item QueueItem, message string) {
+	if item.State.Client == nil {
+		return
+	}
+	item.State.SendInfo(message)
+}
+
+// notifyError tells whoever queued the item why it failed, for a job that expected to be retried and
+// found no backend to be retried on
+func notifyError(item QueueItem, err error) {
+	if item.State.Client == nil {
+		return
+	}
+	item.State.SendError(err.Error())
+}
+
+// candidates returns the backends that are running and allowed to run the workflow for the user. A
+// nil rig, when the status service is down, skips the container and Steam checks.
+func (s *Scheduler) candidates(metaData *comfyui.AibirdMeta, user UserAccess, rig *status.StatusResponse) ([]*Backend, error) {
+	var running []*Backend
+	for _, b := range s.Backends {
+		if b.Config.Container == "" || rig == nil || rig.DockerStatus[b.Config.Container] {
+			running = append(running, b)
+		}
+	}
+
+	if len(running) == 0 {
+		return nil, errors.New("AI rig seems online but the comfyui generation is not running!!! Sorry pal")
+	}
+
+	if user != nil && user.GetAccessLevel() < metaData.AccessLevel {
+		return nil, fmt.Errorf("⛔️ Sorry, you need access level %d to use this command. Check !support for more info", metaData.AccessLevel)
+	}
+
+	var candidates []*Backend
+	for _, b := range running {
+		if b.Config.YieldToSteam && rig != nil && rig.IsRunning {
+			continue
+		}
+		if metaData.BigModel {
+			// Big models go to any capable backend, the workflow access level is the only gate
+			if b.Config.BigModel {
+				candidates = append(candidates, b)
+			}
+			continue
+		}
+		if user == nil || user.HasAccessLevel(b.Config.AccessLevel) {
+			candidates = append(candidates, b)
+		}
+	}
+
+	if len(candidates) == 0 {
+		if metaData.BigModel {
+			return nil, errors.New("no GPU for these big models, sorry pal, have to wait for jewbird to stop gayming")
+		}
+		return nil, errors.New("none of the GPUs you can use are running right now, sorry pal")
+	}
+
+	return candidates, nil
+}
+
+// selectBackend picks the backend for a job. preferred is the biggest candidate, chosen is the
+// biggest idle candidate or, when every candidate is busy, the least loaded one. Suspect backends
+// are only used when no healthy candidate is left.
+func selectBackend(candidates []*Backend) (chosen *Backend, preferred *Backend) {
+	sorted := make([]*Backend, len(candidates))
+	copy(sorted, candidates)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Suspect() != sorted[j].Suspect() {
+			return !sorted[i].Suspect()
+		}
+		return sorted[i].Config.Vram > sorted[j].Config.Vram
+	})
+
+	preferred = sorted[0]
+	for _, b := range sorted {
+		if b.idle() {
+			return b, preferred
+		}
+	}
+
+	// Everything is busy, wait where the fewest jobs are ahead per worker
+	chosen = sorted[0]
+	chosenLoad := float64(chosen.load()) / float64(chosen.concurrency())
+	for _, b := range sorted[1:] {
+		if b.Suspect() && !chosen.Suspect() {
+			break
+		}
+		if load := float64(b.load()) / float64(b.concurrency()); load < chosenLoad {
+			chosen = b
+			chosenLoad = load
+		}
+	}
+
+	return chosen, preferred
+}
+
+// ProcessQueues starts Concurrency workers for every backend. Workers block until there is work and
+// stop when ctx is cancelled, running items are cancelled with it but stay persisted to be replayed.
+func (s *Scheduler) ProcessQueues(ctx context.Context) {
+	for _, b := range s.Backends {
+		for i := 0; i < b.concurrency(); i++ {
+			go s.work(ctx, b)
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.persistMutex.Lock()
+		s.stopped = true
+		s.persistMutex.Unlock()
+		for _, b := range s.Backends {
+			b.Queue.Close()
+		}
+	}()
+}
+
+// work runs items from the backend's queue until ctx is cancelled
+func (s *Scheduler) work(ctx context.Context, b *Backend) {
+	for {
+		item, itemCtx, ok := b.Queue.take(ctx)
+		if !ok {
+			return
+		}
+
+		logger.Debug("Processing queue item", "backend", item.Backend, "action", item.State.Action())
+		s.persist()
+		s.beforeJob(b, *item)
+
+		// A job that will be retried leaves telling the user about a failed backend to the queue
+		retryable := item.Retries < s.failoverRetries
+		if retryable {
+			itemCtx = meta.WithRetry(itemCtx)
+		}
+
+		var err error
+		if item.Function != nil {
+			err = item.Function(itemCtx, item.State, item.Backend)
+		} else {
+			err = errors.New("queue item has no function to run")
+		}
+		b.Queue.finish(item, err)
+		comfyui.Backends.JobFinished(b.Name())
+		s.afterJob(b, *item)
+		logger.Debug("Completed queue item", "backend", item.Backend, "status", item.Status, "error", err)
+
+		switch {
+		case errors.Is(err, comfyui.ErrTimeout), errors.Is(err, comfyui.ErrStalled):
+			if !b.suspect.Swap(true) {
+				logger.Warn("Backend marked suspect after a job timed out", "backend", item.Backend, "action", item.State.Action())
+			}
+		case item.Status == StatusDone:
+			if b.suspect.Swap(false) {
+				logger.Info("Backend is healthy again", "backend", item.Backend)
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+		if s.failover(b, *item) {
+			metrics.JobsTotal.Inc(string(b.Name()), "retried")
+			s.persist()
+			continue
+		}
+		if retryable && item.Status == StatusFailed && comfyui.IsTransient(err) {
+			notifyError(*item, err)
+		}
+		metrics.JobsTotal.Inc(string(b.Name()), item.Status.String())
+		s.persist()
+		s.recordRuntime(*item)
+
+		if s.OnFinished != nil {
+			s.OnFinished(*item)
+		}
+	}
+}
+
+// Status methods
+func (s *Scheduler) IsEmpty() bool {
+	for _, b := range s.Backends {
+		if !b.Queue.IsEmpty() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Scheduler) IsCurrentlyProcessing() bool {
+	for _, b := range s.Backends {
+		if b.Queue.IsCurrentlyProcessing() {
+			return true
+		}
+	}
+	return false
+}
+
+// Admin control methods
+func (s *Scheduler) ClearAllQueues() {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	defer s.persist()
+
+	for _, b := range s.Backends {
+		b.Queue.Clear()
+	}
+	logger.Info("All queues cleared by admin")
+}
+
+// ClearQueue clears a single backend queue, returning false if there is no such backend
+func (s *Scheduler) ClearQueue(name meta.Backend) bool {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	b := s.GetBackend(name)
+	if b == nil {
+		return false
+	}
+
+	b.Queue.Clear()
+	s.persist()
+	logger.Info("Queue cleared by admin", "backend", name)
+	return true
+}
+
+func (s *Scheduler) RemoveCurrentItem() bool {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	removed := false
+	for _, b := range s.Backends {
+		if b.Queue.RemoveCurrent() {
+			removed = true
+		}
+	}
+
+	return removed
+}
+
+// countOwned returns how many queued and running items belong to the owner
+func (s *Scheduler) countOwned(owner string) int {
+	count := 0
+	for _, b := range s.Backends {
+		count += b.Queue.Count(func(item QueueItem) bool { return ownerKey(item) == owner })
+	}
+	return count
+}
+
+// CancelUser cancels the running item and removes the queued items owned by ident@host on a network
+func (s *Scheduler) CancelUser(network, ident, host string) (cancelled bool, removed int) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	owner := OwnerKey(network, ident, host)
+	owned := func(item QueueItem) bool {
+		return ownerKey(item) == owner
+	}
+
+	for _, b := range s.Backends {
+		removed += b.Queue.Remove(owned)
+		if b.Queue.CancelCurrent(owned) {
+			cancelled = true
+		}
+	}
+
+	if removed > 0 {
+		s.persist()
+	}
+	return cancelled, removed
+}
+
+// CancelJob cancels the running or waiting item with the given ID. Unless owner is empty, which is for
+// admins, the item has to belong to that OwnerKey.
+func (s *Scheduler) CancelJob(id string, owner string) (QueueItem, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	b, item, ok := s.findJob(id)
+	if !ok {
+		return QueueItem{}, ErrNoSuchJob
+	}
+	if owner != "" && ownerKey(item) != owner {
+		return QueueItem{}, ErrNotJobOwner
+	}
+
+	match := func(i QueueItem) bool { return i.ID == id }
+	if b.Queue.Remove(match) > 0 {
+		s.persist()
+		return item, nil
+	}
+	if b.Queue.CancelCurrent(match) {
+		return item, nil
+	}
+	// It finished while we were looking
+	return QueueItem{}, ErrNoSuchJob
+}
+
+// MoveJob moves the waiting item with the given ID to position in its queue, 1 being next
+func (s *Scheduler) MoveJob(id string, position int) (QueueItem, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	b, item, ok := s.findJob(id)
+	if !ok {
+		return QueueItem{}, ErrNoSuchJob
+	}
+	if item.Status != StatusQueued || !b.Queue.Move(id, position) {
+		return QueueItem{}, ErrJobRunning
+	}
+	return item, nil
+}
+
+// Jobs returns every running and waiting item, backend by backend in config order
+func (s *Scheduler) Jobs() []ItemRecord {
+	var jobs []ItemRecord
+	for _, b := range s.Backends {
+		jobs = append(jobs, b.jobs()...)
+	}
+	return jobs
+}
+
+// jobs returns the backend's running items followed by its waiting items in the order they will run
+func (b *Backend) jobs() []ItemRecord {
+	running, items := b.Queue.order()
+	jobs := make([]ItemRecord, 0, len(running)+len(items))
+	for _, item := range running {
+		jobs = append(jobs, item.Record(0))
+	}
+	for i, item := range items {
+		jobs = append(jobs, item.Record(i+1))
+	}
+	return jobs
+}
+
+// CollectMetrics sets the queue gauges, it is registered with metrics.OnScrape
+func (s *Scheduler) CollectMetrics() {
+	metrics.QueueDepth.Reset()
+	metrics.QueueRunning.Reset()
+	metrics.BackendSuspect.Reset()
+
+	for _, b := range s.Backends {
+		suspect := 0.0
+		if b.Suspect() {
+			suspect = 1
+		}
+		metrics.QueueDepth.Set(float64(b.Queue.GetQueueLength()), b.Config.Name)
+		metrics.QueueRunning.Set(float64(b.Queue.Running()), b.Config.Name)
+		metrics.BackendSuspect.Set(suspect, b.Config.Name)
+	}
+}
+
+func (s *Scheduler) GetDetailedStatus() *QueueStatus {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	now := time.Now()
+	status := &QueueStatus{Backends: make([]BackendStatus, 0, len(s.Backends))}
+	for _, b := range s.Backends {
+		running, _ := b.Queue.snapshot()
+		runningStatus := make([]RunningStatus, 0, len(running))
+		for _, item := range running {
+			runningStatus = append(runningStatus, RunningStatus{
+				Action:    item.State.Action(),
+				Remaining: s.remaining(item, now),
+				Progress:  item.Progress,
+				Node:      item.Node,
+			})
+		}
+
+		backendStatus := BackendStatus{
+			Name:       b.Config.Name,
+			Length:     b.Queue.GetQueueLength(),
+			Processing: b.Queue.IsCurrentlyProcessing(),
+			Suspect:    b.Suspect(),
+			Loaded:     b.LoadedFamily(),
+			Current:    b.Queue.GetProcessingAction(),
+			Running:    runningStatus,
+			Items:      b.Queue.GetActionList(),
+			Jobs:       b.jobs(),
+			External:   b.external(),
+		}
+		if c, ok := comfyui.Backends.Get(b.Name()); ok {
+			backendStatus.Offline = c.Err != nil
+			backendStatus.VramFree, backendStatus.VramTotal = c.VramFree, c.VramTotal
+		}
+		status.Backends = append(status.Backends, backendStatus)
+	}
+	return status
+}
@@ -0,0 +1,1140 @@
+package queue
+
+import (
+	"aibird/image/comfyui"
+	"aibird/irc/channels"
+	"aibird/irc/networks"
+	"aibird/irc/state"
+	"aibird/logger"
+	"aibird/settings"
+	"aibird/shared/meta"
+	"aibird/status"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lrstanley/girc"
+)
+
+// MockUser implements UserAccess interface for testing
+type MockUser struct {
+	accessLevel int
+	isAdmin     bool
+	isOwner     bool
+}
+
+func (u *MockUser) GetAccessLevel() int { return u.accessLevel }
+func (u *MockUser) HasAccessLevel(level int) bool {
+	return u.accessLevel >= level || u.isAdmin || u.isOwner
+}
+func (u *MockUser) CanSkipQueue() bool { return u.accessLevel >= 2 || u.isAdmin || u.isOwner }
+
+// MockState implements a minimal state for testing
+type MockState struct {
+	action string
+}
+
+func (s MockState) Action() string       { return s.action }
+func (s MockState) Message() string      { return "" }
+func (s MockState) Send(msg string)      {}
+func (s MockState) SendInfo(msg string)  {}
+func (s MockState) SendError(msg string) {}
+func (s MockState) FindArgument(key string, defaultValue interface{}) interface{} {
+	return defaultValue
+}
+func (s MockState) IsEmptyArguments() bool      { return true }
+func (s MockState) IsEmptyMessage() bool        { return true }
+func (s MockState) IsAction(action string) bool { return s.action == action }
+func (s MockState) GetConfig() *settings.Config { return nil }
+func (s MockState) Verify() error               { return nil }
+
+func TestMain(m *testing.M) {
+	logger.Init(logger.Config{Level: logger.LevelError, Format: "text"})
+	os.Exit(m.Run())
+}
+
+func testComfyUiConfig() settings.ComfyUiConfig {
+	return settings.ComfyUiConfig{
+		Url: "localhost",
+		Ports: []settings.ComfyUiPort{
+			{Name: "4090", Port: 8188, Vram: 24, BigModel: true, AccessLevel: 2, Container: "comfyui", YieldToSteam: true},
+			{Name: "2070", Port: 8189, Vram: 8, Container: "comfyui_2070"},
+			{Name: "remote", Port: 8190, Url: "remote.host", Vram: 16},
+		},
+	}
+}
+
+func TestSchedulerCreation(t *testing.T) {
+	s := NewScheduler(testComfyUiConfig())
+
+	if s == nil {
+		t.Fatal("NewScheduler() returned nil")
+	}
+
+	if len(s.Backends) != 3 {
+		t.Fatalf("expected 3 backends, got %d", len(s.Backends))
+	}
+
+	for _, name := range []string{"4090", "2070", "remote"} {
+		b := s.GetBackend(meta.Backend(name))
+		if b == nil || b.Queue == nil {
+			t.Errorf("backend %s has no queue", name)
+		}
+	}
+
+	if s.GetBackend("missing") != nil {
+		t.Error("unknown backend should not be found")
+	}
+}
+
+func TestSchedulerEnqueue(t *testing.T) {
+	// Test enqueueing an item - skip this test for now since we need proper state setup
+	// This would require more complex mocking of the state system
+	t.Skip("Skipping enqueue test - requires proper state mocking")
+}
+
+func TestSchedulerStatus(t *testing.T) {
+	s := NewScheduler(testComfyUiConfig())
+
+	// Test empty status
+	if !s.IsEmpty() {
+		t.Error("New queue should be empty")
+	}
+
+	if s.IsCurrentlyProcessing() {
+		t.Error("New queue should not be processing")
+	}
+}
+
+func TestSchedulerProcessing(t *testing.T) {
+	s := NewScheduler(testComfyUiConfig())
+
+	// Start processing
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.ProcessQueues(ctx)
+
+	// Give it a moment to start
+	time.Sleep(100 * time.Millisecond)
+
+	// Test that processing loops are running
+	// This is a basic test - in a real scenario we'd want more comprehensive testing
+	if s.IsCurrentlyProcessing() {
+		t.Error("Queue should not be processing when empty")
+	}
+}
+
+func TestSchedulerAdminControls(t *testing.T) {
+	// Skip this test for now due to logger initialization issues
+	t.Skip("Skipping admin controls test - requires logger initialization")
+}
+
+func TestSchedulerDetailedStatus(t *testing.T) {
+	s := NewScheduler(testComfyUiConfig())
+
+	status := s.GetDetailedStatus()
+
+	if status == nil {
+		t.Fatal("GetDetailedStatus() returned nil")
+	}
+
+	if len(status.Backends) != 3 {
+		t.Fatalf("expected 3 backend statuses, got %d", len(status.Backends))
+	}
+
+	for _, backend := range status.Backends {
+		if backend.Length != 0 {
+			t.Errorf("New queue should have zero %s length", backend.Name)
+		}
+
+		if backend.Processing {
+			t.Errorf("New queue should not be processing on %s", backend.Name)
+		}
+	}
+}
+
+func TestSchedulerFallbackBackend(t *testing.T) {
+	s := NewScheduler(testComfyUiConfig())
+
+	if got := s.fallbackBackend().Config.Name; got != "2070" {
+		t.Errorf("expected the smallest backend as fallback, got %s", got)
+	}
+}
+
+func TestSchedulerCandidates(t *testing.T) {
+	s := NewScheduler(testComfyUiConfig())
+	rig := &status.StatusResponse{DockerStatus: status.DockerStatus{"comfyui": true, "comfyui_2070": true}}
+
+	free := &MockUser{accessLevel: 0}
+	patron := &MockUser{accessLevel: 2}
+
+	candidates, err := s.candidates(&comfyui.AibirdMeta{}, free, rig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := backendNames(candidates); names != "2070,remote" {
+		t.Errorf("free user should not get the 4090, got %s", names)
+	}
+
+	candidates, _ = s.candidates(&comfyui.AibirdMeta{}, patron, rig)
+	if names := backendNames(candidates); names != "4090,2070,remote" {
+		t.Errorf("patron should get every backend, got %s", names)
+	}
+
+	candidates, _ = s.candidates(&comfyui.AibirdMeta{BigModel: true}, free, rig)
+	if names := backendNames(candidates); names != "4090" {
+		t.Errorf("big models should only run on big backends, got %s", names)
+	}
+
+	if _, err := s.candidates(&comfyui.AibirdMeta{AccessLevel: 3}, patron, rig); err == nil {
+		t.Error("expected an access level error")
+	}
+
+	rig.IsRunning = true
+	if _, err := s.candidates(&comfyui.AibirdMeta{BigModel: true}, patron, rig); err == nil {
+		t.Error("expected big models to fail while the big backend yields to Steam")
+	}
+
+	rig.DockerStatus = status.DockerStatus{}
+	candidates, _ = s.candidates(&comfyui.AibirdMeta{}, patron, rig)
+	if names := backendNames(candidates); names != "remote" {
+		t.Errorf("only backends without a stopped container should remain, got %s", names)
+	}
+}
+
+func TestSelectBackend(t *testing.T) {
+	s := NewScheduler(testComfyUiConfig())
+
+	chosen, preferred := selectBackend(s.Backends)
+	if preferred.Config.Name != "4090" || chosen != preferred {
+		t.Errorf("expected idle 4090 to be chosen, got %s", chosen.Config.Name)
+	}
+
+	busy := s.GetBackend("4090").Queue
+	busy.push(ownedItem("bird", 0))
+	busy.take(context.Background())
+	chosen, preferred = selectBackend(s.Backends)
+	if preferred.Config.Name != "4090" || chosen.Config.Name != "remote" {
+		t.Errorf("expected the next biggest idle backend, got %s", chosen.Config.Name)
+	}
+}
+
+func TestSchedulerCancelUser(t *testing.T) {
+	s := NewScheduler(testComfyUiConfig())
+	b := s.GetBackend("4090")
+
+	owner := state.State{
+		Event:   girc.Event{Source: &girc.Source{Name: "bird", Ident: "~bird", Host: "nest.example"}},
+		Network: &networks.Network{NetworkName: "efnet"},
+		Command: state.Command{Action: "sd"},
+	}
+	other := owner
+	other.Event = girc.Event{Source: &girc.Source{Name: "crow", Ident: "~crow", Host: "tree.example"}}
+
+	running := QueueItem{Item: Item{State: owner, Function: func(ctx context.Context, _ state.State, _ meta.Backend) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}}
+	b.Queue.Enqueue(running)
+	b.Queue.Enqueue(QueueItem{Item: Item{State: owner}})
+	b.Queue.Enqueue(QueueItem{Item: Item{State: other}})
+
+	// Run a single item the way a worker does, so the other user's item stays queued
+	item, itemCtx, _ := b.Queue.take(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Queue.finish(item, item.Function(itemCtx, item.State, item.Backend))
+		close(done)
+	}()
+
+	cancelled, removed := s.CancelUser("efnet", "~bird", "nest.example")
+	if !cancelled || removed != 1 {
+		t.Fatalf("expected the running item cancelled and one removed, got %v and %d", cancelled, removed)
+	}
+
+	<-done
+	if item.Status != StatusCancelled {
+		t.Errorf("expected the running item to be cancelled, got %s", item.Status)
+	}
+	if b.Queue.IsCurrentlyProcessing() {
+		t.Error("queue should be idle once the cancelled item has returned")
+	}
+	if b.Queue.Len() != 1 {
+		t.Errorf("the other user's item should still be queued, got %d items", b.Queue.Len())
+	}
+
+	if cancelled, removed := s.CancelUser("efnet", "~bird", "nest.example"); cancelled || removed != 0 {
+		t.Errorf("nothing should be left to cancel, got %v and %d", cancelled, removed)
+	}
+}
+
+func TestSchedulerWorkers(t *testing.T) {
+	s := NewScheduler(settings.ComfyUiConfig{Ports: []settings.ComfyUiPort{{Name: "4090", Port: 8188, Concurrency: 2}}})
+	b := s.Backends[0]
+
+	finished := make(chan QueueItem, 10)
+	s.OnFinished = func(item QueueItem) { finished <- item }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.ProcessQueues(ctx)
+
+	enqueue := func(nick string, function func(context.Context, state.State, meta.Backend) error) {
+		item := ownedItem(nick, 0)
+		item.Function = function
+		if _, err := b.Queue.Enqueue(item); err != nil {
+			t.Fatalf("enqueue %s: %v", nick, err)
+		}
+	}
+	expect := func(nick string, status ItemStatus) {
+		t.Helper()
+		select {
+		case item := <-finished:
+			if item.State.Message() != nick || item.Status != status || item.Attempts != 1 {
+				t.Errorf("expected %s to be %s after one attempt, got %s %s after %d", nick, status, item.State.Message(), item.Status, item.Attempts)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", nick)
+		}
+	}
+
+	// Both items have to be running at the same time before either is let go
+	var started sync.WaitGroup
+	started.Add(2)
+	release := make(chan struct{})
+	blocking := func(ctx context.Context, _ state.State, _ meta.Backend) error {
+		started.Done()
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	enqueue("first", blocking)
+	enqueue("second", blocking)
+	started.Wait()
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case item := <-finished:
+			if item.Status != StatusDone {
+				t.Errorf("expected %s to be done, got %s", item.State.Message(), item.Status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the concurrent items")
+		}
+	}
+
+	enqueue("broken", func(context.Context, state.State, meta.Backend) error { return errors.New("boom") })
+	expect("broken", StatusFailed)
+
+	stuck := make(chan struct{})
+	waitForCancel := func(ctx context.Context, _ state.State, _ meta.Backend) error {
+		close(stuck)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	enqueue("stuck", waitForCancel)
+	<-stuck
+	if !b.Queue.RemoveCurrent() {
+		t.Fatal("expected a running item to cancel")
+	}
+	expect("stuck", StatusCancelled)
+
+	// Shutting down cancels running items without reporting them as finished, they are replayed on restart
+	stuck = make(chan struct{})
+	enqueue("shutdown", waitForCancel)
+	<-stuck
+	cancel()
+	for deadline := time.Now().Add(5 * time.Second); b.Queue.IsCurrentlyProcessing(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("running item was not cancelled on shutdown")
+		}
+	}
+	if _, _, ok := b.Queue.take(context.Background()); ok {
+		t.Error("a closed queue should not hand out items")
+	}
+	select {
+	case item := <-finished:
+		t.Errorf("%s should not be reported as finished during shutdown", item.State.Message())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSchedulerSuspectBackend(t *testing.T) {
+	s := NewScheduler(testComfyUiConfig())
+	big, small := s.Backends[0], s.Backends[1]
+
+	finished := make(chan QueueItem, 1)
+	s.OnFinished = func(item QueueItem) { finished <- item }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.ProcessQueues(ctx)
+
+	run := func(err error) {
+		t.Helper()
+		item := ownedItem("alice", 0)
+		item.Function = func(context.Context, state.State, meta.Backend) error { return err }
+		big.Queue.push(item)
+		select {
+		case <-finished:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the item")
+		}
+	}
+
+	run(fmt.Errorf("%w, your request was stopped after 5m0s", comfyui.ErrTimeout))
+	if !big.Suspect() || !s.GetDetailedStatus().Backends[0].Suspect {
+		t.Fatal("expected the backend to be suspect after a timeout")
+	}
+	if chosen, preferred := selectBackend([]*Backend{big, small}); chosen != small || preferred != small {
+		t.Errorf("expected the healthy 2070 to be chosen, got %s (preferred %s)", chosen.Name(), preferred.Name())
+	}
+	if chosen, _ := selectBackend([]*Backend{big}); chosen != big {
+		t.Error("a suspect backend should still be used when it is the only candidate")
+	}
+
+	run(errors.New("some other failure"))
+	if !big.Suspect() {
+		t.Error("other failures should not clear suspicion")
+	}
+	run(nil)
+	if big.Suspect() {
+		t.Error("expected a finished job to clear suspicion")
+	}
+}
+
+func TestSchedulerFailover(t *testing.T) {
+	config := testComfyUiConfig()
+	config.FailoverRetries = 2
+	s := NewScheduler(config)
+	fallback := s.fallbackBackend()
+
+	finished := make(chan QueueItem, 1)
+	s.OnFinished = func(item QueueItem) { finished <- item }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.ProcessQueues(ctx)
+
+	var runs atomic.Int32
+	run := func(err error) QueueItem {
+		t.Helper()
+		runs.Store(0)
+		item := ownedItem("alice", 0)
+		item.ID = "failover"
+		item.Function = func(context.Context, state.State, meta.Backend) error {
+			runs.Add(1)
+			return err
+		}
+		if _, err := s.Enqueue(item); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+		select {
+		case item := <-finished:
+			return item
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the item")
+		}
+		return QueueItem{}
+	}
+
+	// A backend failure is retried until the retries run out, not being a workflow it can only go back to the fallback
+	item := run(fmt.Errorf("%w, your request was stopped after 1s", comfyui.ErrTimeout))
+	if runs.Load() != 3 || item.Retries != 2 || item.Status != StatusFailed || item.Attempts != 1 {
+		t.Errorf("expected 3 runs and 2 retries ending in failure, got %d runs, %d retries, %s after %d attempts", runs.Load(), item.Retries, item.Status, item.Attempts)
+	}
+	if len(item.FailedOn) != 2 || item.FailedOn[0] != fallback.Name() {
+		t.Errorf("expected the failed backends to be recorded, got %v", item.FailedOn)
+	}
+
+	item = run(errors.New("⛔️ Sorry, you need access level 2 to use this command"))
+	if runs.Load() != 1 || item.Retries != 0 {
+		t.Errorf("expected a request error not to be retried, got %d runs", runs.Load())
+	}
+
+	// A job that stalled after starting would only start over elsewhere
+	item = run(fmt.Errorf("%w for 5m0s, your request was stopped", comfyui.ErrStalled))
+	if runs.Load() != 1 || item.Retries != 0 {
+		t.Errorf("expected a stalled job not to be retried, got %d runs", runs.Load())
+	}
+	if !s.fallbackBackend().Suspect() {
+		t.Error("expected a stalled job to make its backend suspect")
+	}
+}
+
+func TestSchedulerFailoverErrors(t *testing.T) {
+	config := testComfyUiConfig()
+	config.FailoverRetries = 2
+	s := NewScheduler(config)
+
+	finished := make(chan QueueItem, 1)
+	s.OnFinished = func(item QueueItem) { finished <- item }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.ProcessQueues(ctx)
+
+	// run fails the first runs of a job on its backend, each run telling the user of the error as the
+	// command handlers do
+	var runs, sent atomic.Int32
+	run := func(failures int32) QueueItem {
+		t.Helper()
+		runs.Store(0)
+		sent.Store(0)
+		item := ownedItem("alice", 0)
+		item.Function = func(ctx context.Context, _ state.State, _ meta.Backend) error {
+			if runs.Add(1) > failures {
+				return nil
+			}
+			err := fmt.Errorf("%w, your request was stopped after 1s", comfyui.ErrTimeout)
+			if !comfyui.IsTransient(err) || !meta.WillRetry(ctx) {
+				sent.Add(1)
+			}
+			return err
+		}
+		if _, err := s.Enqueue(item); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+		select {
+		case item := <-finished:
+			return item
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the item")
+		}
+		return QueueItem{}
+	}
+
+	if item := run(1); item.Status != StatusDone || sent.Load() != 0 {
+		t.Errorf("expected a job retried to success to send no error, got %d errors and %s", sent.Load(), item.Status)
+	}
+	if item := run(3); item.Status != StatusFailed || runs.Load() != 3 || sent.Load() != 1 {
+		t.Errorf("expected one error once the retries ran out, got %d errors after %d runs and %s", sent.Load(), runs.Load(), item.Status)
+	}
+}
+
+func TestSchedulerVramPolicy(t *testing.T) {
+	var freed int
+	newScheduler := func(policy string) (*Scheduler, *Backend) {
+		freed = 0
+		s := NewScheduler(settings.ComfyUiConfig{Ports: []settings.ComfyUiPort{{Name: "4090", Port: 8188, VramPolicy: policy}}})
+		s.FreeVram = func(meta.Backend) error {
+			freed++
+			return nil
+		}
+		return s, s.Backends[0]
+	}
+	push := func(b *Backend, family string) {
+		item := ownedItem("alice", 0)
+		item.Family = family
+		b.Queue.push(item)
+	}
+	// start takes the next item and applies the policy before it as a worker does, end after it
+	start := func(s *Scheduler, b *Backend) *QueueItem {
+		item, _, _ := b.Queue.take(context.Background())
+		s.beforeJob(b, *item)
+		return item
+	}
+	end := func(s *Scheduler, b *Backend, item *QueueItem) {
+		b.Queue.finish(item, nil)
+		s.afterJob(b, *item)
+	}
+	run := func(s *Scheduler, b *Backend) {
+		end(s, b, start(s, b))
+	}
+
+	s, b := newScheduler("")
+	push(b, "flux")
+	push(b, "")
+	run(s, b)
+	run(s, b)
+	if freed != 1 || b.LoadedFamily() != "" {
+		t.Errorf("always-free: expected one free for the workflow only, got %d with %q loaded", freed, b.LoadedFamily())
+	}
+
+	s, b = newScheduler(VramFreeOnSwitch)
+	push(b, "flux")
+	push(b, "flux")
+	push(b, "wan")
+	run(s, b)
+	if freed != 0 || b.LoadedFamily() != "flux" {
+		t.Errorf("free-on-switch: expected flux kept for the next flux job, got %d frees with %q loaded", freed, b.LoadedFamily())
+	}
+	run(s, b)
+	if freed != 1 || b.LoadedFamily() != "" {
+		t.Errorf("free-on-switch: expected a free with wan next, got %d frees with %q loaded", freed, b.LoadedFamily())
+	}
+	run(s, b)
+	if freed != 1 || b.LoadedFamily() != "wan" {
+		t.Errorf("free-on-switch: expected wan kept with nothing next, got %d frees with %q loaded", freed, b.LoadedFamily())
+	}
+	push(b, "flux")
+	run(s, b)
+	if freed != 2 || b.LoadedFamily() != "flux" {
+		t.Errorf("free-on-switch: expected a free before a flux job that came later, got %d frees with %q loaded", freed, b.LoadedFamily())
+	}
+
+	s, b = newScheduler("")
+	push(b, "flux")
+	push(b, "wan")
+	first, second := start(s, b), start(s, b)
+	end(s, b, first)
+	if freed != 0 {
+		t.Errorf("always-free: expected nothing freed while another job runs, got %d frees", freed)
+	}
+	end(s, b, second)
+	if freed != 1 {
+		t.Errorf("always-free: expected a free once the last job finished, got %d frees", freed)
+	}
+
+	s, b = newScheduler(VramFreeOnSwitch)
+	push(b, "flux")
+	push(b, "flux")
+	push(b, "flux")
+	first, second = start(s, b), start(s, b)
+	if b.LoadedFamily() != "" {
+		t.Errorf("free-on-switch: expected what is loaded to be unknown with two jobs running, got %q", b.LoadedFamily())
+	}
+	end(s, b, first)
+	end(s, b, second)
+	if freed != 1 {
+		t.Errorf("free-on-switch: expected a free before the next job after jobs ran side by side, got %d frees", freed)
+	}
+	run(s, b)
+	if freed != 1 || b.LoadedFamily() != "flux" {
+		t.Errorf("free-on-switch: expected flux known again after a free, got %d frees with %q loaded", freed, b.LoadedFamily())
+	}
+
+	s, b = newScheduler(VramIdleTimeout)
+	push(b, "flux")
+	run(s, b)
+	idle := b.vram.idle
+	if freed != 0 || idle == nil {
+		t.Fatalf("idle-timeout: expected the models kept and the idle timer started, got %d frees", freed)
+	}
+	idle.Stop()
+	push(b, "wan")
+	s.freeIdle(b)
+	if freed != 0 {
+		t.Error("idle-timeout: a backend with a job waiting is not idle")
+	}
+	b.Queue.Clear()
+	s.freeIdle(b)
+	if freed != 1 || b.LoadedFamily() != "" {
+		t.Errorf("idle-timeout: expected an idle backend to be freed, got %d frees with %q loaded", freed, b.LoadedFamily())
+	}
+}
+
+func TestSchedulerCapabilities(t *testing.T) {
+	registry := comfyui.Backends
+	comfyui.Backends = comfyui.NewBackendRegistry()
+	defer func() { comfyui.Backends = registry }()
+
+	s := NewScheduler(testComfyUiConfig())
+	workflow := &comfyui.Workflow{Name: "flux", Needs: comfyui.Requirements{
+		Nodes:  []string{"CheckpointLoaderSimple", "FluxGuidance"},
+		Models: []comfyui.ModelFile{{Node: "CheckpointLoaderSimple", File: "flux/flux1-dev.safetensors"}},
+	}}
+	check := func(backend meta.Backend) error { return comfyui.Backends.Check(backend, workflow) }
+
+	if !comfyui.Backends.Runnable(workflow) {
+		t.Error("a workflow should be runnable before any backend is probed")
+	}
+
+	comfyui.Backends.Set("4090", &comfyui.Capabilities{Running: 2, Pending: 1, Nodes: map[string]map[string]bool{
+		"CheckpointLoaderSimple": {"flux/flux1-dev.safetensors": true},
+		"FluxGuidance":           {},
+	}})
+	comfyui.Backends.Set("2070", &comfyui.Capabilities{Nodes: map[string]map[string]bool{
+		"CheckpointLoaderSimple": {"sd15.safetensors": true},
+	}})
+	candidates, err := capable(s.Backends, check)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := backendNames(candidates); names != "4090,remote" {
+		t.Errorf("expected the 2070 left out and the unprobed remote kept, got %s", names)
+	}
+
+	comfyui.Backends.Set("remote", &comfyui.Capabilities{Err: errors.New("connection refused")})
+	candidates, _ = capable(s.Backends, check)
+	if names := backendNames(candidates); names != "4090" {
+		t.Errorf("expected the offline remote left out, got %s", names)
+	}
+
+	_, err = capable(s.Backends[1:], check)
+	if err == nil || !strings.Contains(err.Error(), "node FluxGuidance") || !strings.Contains(err.Error(), "model flux/flux1-dev.safetensors") || !strings.Contains(err.Error(), "remote is offline") {
+		t.Errorf("expected what each backend lacks, got %v", err)
+	}
+
+	if got := s.GetBackend("4090").load(); got != 3 {
+		t.Errorf("expected the 4090's load to count the 3 prompts it has from elsewhere, got %d", got)
+	}
+
+	comfyui.Backends.Set("4090", &comfyui.Capabilities{Err: errors.New("timeout")})
+	if comfyui.Backends.Runnable(workflow) {
+		t.Error("a workflow no probed backend can run should not be runnable")
+	}
+}
+
+func TestSchedulerRigStatus(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "flux.json"), []byte(`{"3": {"class_type": "KSampler", "inputs": {}}}`), 0o644)
+	os.WriteFile(filepath.Join(dir, "flux"+comfyui.SidecarSuffix), []byte("accessLevel = 0\n"), 0o644)
+	workflows := comfyui.Workflows
+	comfyui.Workflows = comfyui.NewRegistry(dir)
+	defer func() { comfyui.Workflows = workflows }()
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`{"steam_running": false, "docker_status": {"comfyui": true}}`))
+	}))
+	defer server.Close()
+
+	enqueue := func(ports ...settings.ComfyUiPort) {
+		t.Helper()
+		requests.Store(0)
+		s := NewScheduler(settings.ComfyUiConfig{Url: "localhost", Ports: ports})
+		item := ownedItem("alice", 0)
+		item.Model = "flux"
+		item.State.Config = &settings.Config{AiBird: settings.AiBird{StatusUrl: server.URL}}
+		if _, err := s.Enqueue(item); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	// Plain backends are routed by their probes alone
+	enqueue(settings.ComfyUiPort{Name: "a", Port: 8188}, settings.ComfyUiPort{Name: "b", Port: 8189})
+	if requests.Load() != 0 {
+		t.Errorf("expected the status service not to be asked, got %d requests", requests.Load())
+	}
+
+	enqueue(settings.ComfyUiPort{Name: "a", Port: 8188, Container: "comfyui"}, settings.ComfyUiPort{Name: "b", Port: 8189})
+	if requests.Load() != 1 {
+		t.Errorf("expected a backend in a container to have the status service asked, got %d requests", requests.Load())
+	}
+
+	enqueue(settings.ComfyUiPort{Name: "a", Port: 8188, YieldToSteam: true})
+	if requests.Load() != 1 {
+		t.Errorf("expected a backend yielding to Steam to have the status service asked, got %d requests", requests.Load())
+	}
+}
+
+func TestSchedulerExternalLoad(t *testing.T) {
+	registry := comfyui.Backends
+	comfyui.Backends = comfyui.NewBackendRegistry()
+	defer func() { comfyui.Backends = registry }()
+
+	s := NewScheduler(settings.ComfyUiConfig{Ports: []settings.ComfyUiPort{{Name: "4090", Port: 8188}}})
+	b := s.Backends[0]
+	finished := make(chan QueueItem, 1)
+	s.OnFinished = func(item QueueItem) { finished <- item }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The probe ran while our job was running, it is the one prompt ComfyUI reported
+	started, release := make(chan struct{}), make(chan struct{})
+	item := ownedItem("alice", 0)
+	item.Function = func(context.Context, state.State, meta.Backend) error {
+		comfyui.Backends.Set("4090", &comfyui.Capabilities{Running: 1, Nodes: map[string]map[string]bool{}})
+		close(started)
+		<-release
+		return nil
+	}
+	if _, err := b.Queue.Enqueue(item); err != nil {
+		t.Fatal(err)
+	}
+	s.ProcessQueues(ctx)
+	<-started
+	if got := b.external(); got != 0 {
+		t.Errorf("our running job should not count as outside work, got %d", got)
+	}
+
+	close(release)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the job")
+	}
+	if got := b.load(); got != 0 || !b.idle() {
+		t.Errorf("a backend whose only job just finished should be idle until the next probe, got load %d", got)
+	}
+}
+
+func TestItemTransition(t *testing.T) {
+	item := QueueItem{}
+
+	if err := item.transition(StatusDone); err == nil {
+		t.Error("a queued item cannot be done without running")
+	}
+	if err := item.transition(StatusRunning); err != nil {
+		t.Fatalf("queued to running: %v", err)
+	}
+	if err := item.transition(StatusQueued); err == nil {
+		t.Error("a running item cannot go back to queued")
+	}
+	if err := item.transition(StatusFailed); err != nil {
+		t.Fatalf("running to failed: %v", err)
+	}
+	if err := item.transition(StatusRunning); err == nil {
+		t.Error("a failed item cannot run again")
+	}
+}
+
+func TestRuntimeStats(t *testing.T) {
+	var stats runtimeStats
+	stats.add(time.Second)
+	stats.add(3 * time.Second)
+	if stats.Runs != 2 || stats.Average != 2*time.Second {
+		t.Fatalf("expected a 2s average over 2 runs, got %s over %d", stats.Average, stats.Runs)
+	}
+
+	// Past the window old runs fade out instead of being averaged forever
+	for i := 0; i < 50; i++ {
+		stats.add(10 * time.Second)
+	}
+	if stats.Average < 9*time.Second {
+		t.Errorf("expected the average to follow recent runs, got %s", stats.Average)
+	}
+}
+
+func TestSchedulerEstimate(t *testing.T) {
+	s := NewScheduler(settings.ComfyUiConfig{Ports: []settings.ComfyUiPort{{Name: "4090", Port: 8188}}})
+	b := s.Backends[0]
+
+	if got := s.expectedRuntime("sd", b.Name()); got != defaultRuntime {
+		t.Errorf("expected %s without history, got %s", defaultRuntime, got)
+	}
+	now := time.Now()
+	s.recordRuntime(QueueItem{Model: "sd", Backend: b.Name(), Status: StatusDone, StartedAt: now.Add(-10 * time.Second), FinishedAt: now})
+	s.recordRuntime(QueueItem{Model: "sd", Backend: b.Name(), Status: StatusFailed, StartedAt: now.Add(-time.Hour), FinishedAt: now})
+	if got := s.expectedRuntime("sd", b.Name()); got != 10*time.Second {
+		t.Fatalf("expected failed runs to be ignored and a 10s average, got %s", got)
+	}
+
+	model := func(item QueueItem) QueueItem {
+		item.Model = "sd"
+		item.Backend = b.Name()
+		item.ID = item.State.Message()
+		return item
+	}
+	b.Queue.push(model(ownedItem("carol", 0)))
+	running, itemCtx, _ := b.Queue.take(context.Background())
+	for _, nick := range []string{"alice", "alice2", "bob"} {
+		item := model(ownedItem(nick, 0))
+		if nick == "alice2" {
+			item.State.Event.Source = ownedItem("alice", 0).State.Event.Source
+		}
+		b.Queue.push(item)
+	}
+
+	// Round-robin puts bob ahead of alice's second request, behind carol and alice
+	estimate, ok := s.Estimate("bob")
+	if !ok || estimate.Position != 2 {
+		t.Fatalf("expected bob at position 2, got %+v", estimate)
+	}
+	near := func(got, want time.Duration) bool { return (got - want).Abs() < time.Second }
+	if !near(estimate.Start, 20*time.Second) || !near(estimate.Finish, 30*time.Second) {
+		t.Errorf("expected bob to start in ~20s and finish in ~30s, got %s and %s", estimate.Start, estimate.Finish)
+	}
+	if _, ok := s.Estimate("carol"); ok {
+		t.Error("running items have no queue estimate")
+	}
+
+	// Working out positions must not move the real policy along
+	if order := drain(b.Queue); order != "alice,bob,alice2" {
+		t.Errorf("expected alice,bob,alice2, got %s", order)
+	}
+
+	// Progress reported by ComfyUI takes over from the average
+	running.StartedAt = time.Now().Add(-4 * time.Second)
+	meta.ReportProgress(itemCtx, "KSampler", 1, 2)
+	runningStatus := s.GetDetailedStatus().Backends[0].Running[0]
+	if !near(runningStatus.Remaining, 4*time.Second) {
+		t.Errorf("expected ~4s left at half way after 4s, got %s", runningStatus.Remaining)
+	}
+	if runningStatus.Progress != 0.5 || runningStatus.Node != "KSampler" {
+		t.Errorf("expected KSampler at 50%%, got %s at %g", runningStatus.Node, runningStatus.Progress)
+	}
+}
+
+func TestSchedulerJobs(t *testing.T) {
+	s := NewScheduler(settings.ComfyUiConfig{Ports: []settings.ComfyUiPort{{Name: "4090", Port: 8188}}})
+	b := s.Backends[0]
+
+	ids := make(map[string]string)
+	for _, nick := range []string{"carol", "alice", "bob", "dave"} {
+		item := ownedItem(nick, 0)
+		item.State.Command.Message = nick + " riding a bicycle through a field of sunflowers at dusk"
+		if _, err := s.Enqueue(item); err != nil {
+			t.Fatalf("enqueue %s: %v", nick, err)
+		}
+	}
+	b.Queue.take(context.Background())
+	for _, job := range s.Jobs() {
+		if len(job.ID) != 8 || ids[job.ID] != "" {
+			t.Errorf("expected a short unique ID, got %q", job.ID)
+		}
+		ids[job.ID] = job.Nick
+		ids[job.Nick] = job.ID
+	}
+
+	jobs := s.Jobs()
+	if len(jobs) != 4 || jobs[0].Nick != "carol" || jobs[0].Status != "running" || jobs[0].Position != 0 {
+		t.Fatalf("expected carol running first, got %+v", jobs)
+	}
+	if jobs[1].Nick != "alice" || jobs[1].Position != 1 || jobs[1].Network != "efnet" || jobs[1].Backend != "4090" || jobs[1].EnqueuedAt.IsZero() {
+		t.Errorf("unexpected record for alice: %+v", jobs[1])
+	}
+	if want := "alice riding a bicycle through a field o…"; jobs[1].Preview != want {
+		t.Errorf("expected preview %q, got %q", want, jobs[1].Preview)
+	}
+
+	// Moving dave to the front pins him ahead of the policy, the rest keep their order
+	if _, err := s.MoveJob(ids["dave"], 1); err != nil {
+		t.Fatalf("move dave: %v", err)
+	}
+	if _, err := s.MoveJob(ids["carol"], 1); !errors.Is(err, ErrJobRunning) {
+		t.Errorf("expected moving a running item to fail, got %v", err)
+	}
+	if _, err := s.MoveJob("nope", 1); !errors.Is(err, ErrNoSuchJob) {
+		t.Errorf("expected an unknown ID to fail, got %v", err)
+	}
+
+	alice := OwnerKey("efnet", "~alice", "alice.example")
+	if _, err := s.CancelJob(ids["bob"], alice); !errors.Is(err, ErrNotJobOwner) {
+		t.Errorf("expected alice to be refused bob's job, got %v", err)
+	}
+	if _, err := s.CancelJob(ids["alice"], alice); err != nil {
+		t.Errorf("expected alice to cancel her own job, got %v", err)
+	}
+	if item, err := s.CancelJob(ids["carol"], ""); err != nil || item.Status != StatusRunning {
+		t.Errorf("expected an admin to cancel carol's running job, got %v", err)
+	}
+
+	if order := drain(b.Queue); !strings.HasPrefix(order, "dave ") || !strings.Contains(order, ",bob ") || strings.Contains(order, "alice") {
+		t.Errorf("expected dave then bob, got %s", order)
+	}
+}
+
+func TestQueueMove(t *testing.T) {
+	q := NewQueue(PriorityPolicy{}, 0)
+	for _, item := range []QueueItem{ownedItem("a", 0), ownedItem("b", 0), ownedItem("vip", 2), ownedItem("c", 0)} {
+		item.ID = item.State.Message()
+		q.push(item)
+	}
+
+	if !q.Move("c", 2) {
+		t.Fatal("expected c to move")
+	}
+	if q.Move("missing", 1) {
+		t.Error("expected moving an unknown item to fail")
+	}
+	// vip and c are pinned, a and b are still up to the policy behind them
+	q.push(func() QueueItem { item := ownedItem("vip2", 2); item.ID = "vip2"; return item }())
+	if order := drain(q); order != "vip,c,vip2,a,b" {
+		t.Errorf("expected vip,c,vip2,a,b, got %s", order)
+	}
+}
+
+func TestQueueLimit(t *testing.T) {
+	config := testComfyUiConfig()
+	config.MaxQueueSize = 2
+	q := NewScheduler(config).Backends[0].Queue
+	for i := range 2 {
+		if _, err := q.Enqueue(ownedItem(fmt.Sprint(i), 0)); err != nil {
+			t.Fatalf("expected item %d to be queued, got %v", i, err)
+		}
+	}
+	if _, err := q.Enqueue(ownedItem("late", 0)); err == nil || !strings.Contains(err.Error(), "limit is 2") {
+		t.Errorf("expected a queue of 2 to be full, got %v", err)
+	}
+
+	q = NewQueue(nil, 0)
+	for i := range defaultQueueSize {
+		q.push(ownedItem(fmt.Sprint(i), 0))
+	}
+	if _, err := q.Enqueue(ownedItem("late", 0)); err == nil || !strings.Contains(err.Error(), "limit is 10") {
+		t.Errorf("expected an unset limit to be 10, got %v", err)
+	}
+}
+
+func TestNewJob(t *testing.T) {
+	item := QueueItem{
+		Item: Item{
+			State: state.State{
+				Event:     girc.Event{Source: &girc.Source{Name: "bird", Ident: "~bird", Host: "nest.example"}},
+				Network:   &networks.Network{NetworkName: "efnet"},
+				Channel:   &channels.Channel{Name: "#birdnest"},
+				Command:   state.Command{Action: "sd", Message: "a bird in a nest"},
+				Arguments: []state.Argument{{Key: "steps", Value: "20"}, {Key: "fresh", Value: true}},
+			},
+		},
+		ID:       "job-1",
+		Model:    "sd",
+		Backend:  "4090",
+		Attempts: 1,
+	}
+
+	jobJson, err := json.Marshal(newJob(item))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var job Job
+	if err := json.Unmarshal(jobJson, &job); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	want := Job{
+		ID:        "job-1",
+		Network:   "efnet",
+		Channel:   "#birdnest",
+		Nick:      "bird",
+		Ident:     "~bird",
+		Host:      "nest.example",
+		Action:    "sd",
+		Message:   "a bird in a nest",
+		Arguments: []state.Argument{{Key: "steps", Value: "20"}, {Key: "fresh", Value: true}},
+		Model:     "sd",
+		Backend:   "4090",
+		Attempts:  1,
+	}
+	if !reflect.DeepEqual(job, want) {
+		t.Errorf("job did not survive a round trip:\n got %+v\nwant %+v", job, want)
+	}
+}
+
+// ownedItem is a queue item from nick on efnet with the given access level
+func ownedItem(nick string, accessLevel int) QueueItem {
+	return QueueItem{
+		Item: Item{State: state.State{
+			Event:   girc.Event{Source: &girc.Source{Name: nick, Ident: "~" + nick, Host: nick + ".example"}},
+			Network: &networks.Network{NetworkName: "efnet"},
+			Command: state.Command{Action: "sd", Message: nick},
+		}},
+		User: &MockUser{accessLevel: accessLevel},
+	}
+}
+
+// drain dequeues every item and returns the owners' nicks in the order they ran
+func drain(q *Queue) string {
+	order := ""
+	for item := q.Dequeue(); item != nil; item = q.Dequeue() {
+		if order != "" {
+			order += ","
+		}
+		order += item.State.Message()
+	}
+	return order
+}
+
+func TestRoundRobinPolicy(t *testing.T) {
+	policy, _ := NewPolicy(PolicyRoundRobin)
+	q := NewQueue(policy, 0)
+
+	for i := 0; i < 3; i++ {
+		q.Enqueue(ownedItem("patron", 3))
+	}
+	q.Enqueue(ownedItem("free", 0))
+	q.Enqueue(ownedItem("other", 0))
+
+	if order := drain(q); order != "patron,free,other,patron,patron" {
+		t.Errorf("unexpected round-robin order %s", order)
+	}
+}
+
+func TestRoundRobinPolicyForgets(t *testing.T) {
+	policy, _ := NewPolicy(PolicyRoundRobin)
+	lastServed := policy.(*RoundRobinPolicy).lastServed
+	q := NewQueue(policy, 0)
+	run := func() {
+		item, _, _ := q.take(context.Background())
+		q.finish(item, nil)
+	}
+
+	for i := 0; i < 50; i++ {
+		q.Enqueue(ownedItem(fmt.Sprintf("user%d", i), 0))
+		run()
+	}
+	if len(lastServed) != 0 {
+		t.Errorf("expected users with nothing queued to be forgotten, %d are remembered", len(lastServed))
+	}
+
+	// A user served since the others last were keeps their turn, or they would go ahead of them
+	for _, nick := range []string{"a", "a", "b", "b"} {
+		q.Enqueue(ownedItem(nick, 0))
+	}
+	run()
+	run()
+	q.Enqueue(ownedItem("c", 0))
+	run()
+	q.Enqueue(ownedItem("c", 0))
+	if order := drain(q); order != "a,b,c" {
+		t.Errorf("expected c to wait for a and b again, got %s", order)
+	}
+}
+
+func TestWeightedPolicy(t *testing.T) {
+	policy, _ := NewPolicy(PolicyWeighted)
+	q := NewQueue(policy, 0)
+
+	for i := 0; i < 4; i++ {
+		q.Enqueue(ownedItem("free", 0))
+	}
+	for i := 0; i < 4; i++ {
+		q.Enqueue(ownedItem("patron", 1))
+	}
+
+	// Access level 1 weighs double, so the patron gets two turns for every free one
+	if order := drain(q); order != "patron,free,patron,patron,free,patron,free,free" {
+		t.Errorf("unexpected weighted order %s", order)
+	}
+}
+
+func TestPriorityPolicy(t *testing.T) {
+	policy, _ := NewPolicy(PolicyPriority)
+	q := NewQueue(policy, 0)
+
+	q.Enqueue(ownedItem("free", 0))
+	q.Enqueue(ownedItem("patron", 2))
+	q.Enqueue(ownedItem("other", 0))
+	q.Enqueue(ownedItem("vip", 3))
+
+	if next := q.Peek(); next.State.Message() != "patron" {
+		t.Errorf("expected the first supporter to be next, got %s", next.State.Message())
+	}
+
+	// Supporters no longer leapfrog each other, they are served in arrival order
+	if order := drain(q); order != "patron,vip,free,other" {
+		t.Errorf("unexpected priority order %s", order)
+	}
+}
+
+func TestNewPolicyUnknown(t *testing.T) {
+	if _, err := NewPolicy("lottery"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+func backendNames(backends []*Backend) string {
+	names := ""
+	for i, b := range backends {
+		if i > 0 {
+			names += ","
+		}
+		names += b.Config.Name
+	}
+	return names
+}
@@ -2,32 +2,233 @@ package queue
 
 import (
 	"aibird/irc/state"
+	"aibird/settings"
 	"aibird/shared/meta"
+	"context"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Item struct {
 	State    state.State
-	Function func(state.State, meta.GPUType)
+	Function func(context.Context, state.State, meta.Backend) error
 }
 
-// Dual Queue Types
-type DualQueue struct {
-	Queue4090 *Queue
-	Queue2070 *Queue
-	Mutex     sync.Mutex
+// Scheduler holds one queue per configured ComfyUI backend
+type Scheduler struct {
+	Backends []*Backend
+	Mutex    sync.Mutex
+
+	// Runner is the function replayed jobs are run with, set by the main package
+	Runner func(context.Context, state.State, meta.Backend) error
+	// OnFinished is called with every item that reached done, failed or cancelled. Items that failed
+	// over to another backend are not finished yet.
+	OnFinished func(QueueItem)
+	// FreeVram unloads the models of a backend, set by the main package. Backends are left alone
+	// while it is nil.
+	FreeVram func(meta.Backend) error
+
+	jobRetries      int
+	failoverRetries int
+	persistent      bool
+	stopped         bool  // set on shutdown, running jobs must stay saved for the next run
+	pending         []Job // restored jobs waiting for their network or channel to come back
+	persistMutex    sync.Mutex
+
+	runtimes     map[string]*runtimeStats // rolling run times by backend and model, loaded from birdbase on first use
+	runtimeMutex sync.Mutex
+}
+
+// Backend pairs a ComfyUI backend's configuration with its queue
+type Backend struct {
+	Config settings.ComfyUiPort
+	Queue  *Queue
+
+	suspect atomic.Bool // a job timed out here and none has finished since, routed to last
+	vram    vram
 }
 
 type QueueItem struct {
 	Item
-	Model string
-	User  UserAccess
-	GPU   meta.GPUType // Explicit GPU routing
+	ID       string
+	Model    string
+	Family   string // Model family the workflow loads first, empty for commands that aren't workflows
+	User     UserAccess
+	Backend  meta.Backend // Explicit backend routing
+	Attempts int          // Times the item was started, a restart mid-run leaves it counted
+	Retries  int          // Times the item was requeued after its backend failed
+	FailedOn []meta.Backend
+	Status   ItemStatus
+	Err      error // Why the item failed, set once it is done
+
+	EnqueuedAt time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Progress   float64 // Fraction of the current ComfyUI node done, 0 until it reports progress
+	Node       string  // Title of the ComfyUI node the progress is for
+
+	pinned bool // placed by an admin with Move, runs ahead of the policy
+}
+
+// previewLength is how many characters of the prompt ItemRecord shows
+const previewLength = 40
+
+// Nick returns the nick of whoever queued the item
+func (i QueueItem) Nick() string {
+	if i.State.Event.Source == nil {
+		return ""
+	}
+	return i.State.Event.Source.Name
+}
+
+// NetworkName returns the network the item was queued from
+func (i QueueItem) NetworkName() string {
+	if i.State.Network == nil {
+		return ""
+	}
+	return i.State.Network.NetworkName
+}
+
+// Preview returns the start of the item's prompt
+func (i QueueItem) Preview() string {
+	prompt := []rune(strings.TrimSpace(i.State.Message()))
+	if len(prompt) <= previewLength {
+		return string(prompt)
+	}
+	return strings.TrimSpace(string(prompt[:previewLength])) + "…"
+}
+
+// Record returns the item as shown by !queue and the JSON status
+func (i QueueItem) Record(position int) ItemRecord {
+	return ItemRecord{
+		ID:         i.ID,
+		Action:     i.State.Action(),
+		Nick:       i.Nick(),
+		Network:    i.NetworkName(),
+		Backend:    i.Backend,
+		Status:     i.Status.String(),
+		Position:   position,
+		EnqueuedAt: i.EnqueuedAt,
+		Preview:    i.Preview(),
+		Progress:   i.Progress,
+		Node:       i.Node,
+	}
+}
+
+// ItemStatus is where a queue item is in its life: queued → running → done, failed or cancelled
+type ItemStatus int
+
+const (
+	StatusQueued ItemStatus = iota
+	StatusRunning
+	StatusDone
+	StatusFailed
+	StatusCancelled
+)
+
+func (s ItemStatus) String() string {
+	switch s {
+	case StatusQueued:
+		return "queued"
+	case StatusRunning:
+		return "running"
+	case StatusDone:
+		return "done"
+	case StatusFailed:
+		return "failed"
+	case StatusCancelled:
+		return "cancelled"
+	default:
+		return fmt.Sprintf("ItemStatus(%d)", int(s))
+	}
+}
+
+// transition moves the item to the next status, only queued → running → done, failed or cancelled is allowed
+func (i *QueueItem) transition(to ItemStatus) error {
+	valid := false
+	switch i.Status {
+	case StatusQueued:
+		valid = to == StatusRunning
+	case StatusRunning:
+		valid = to == StatusDone || to == StatusFailed || to == StatusCancelled
+	}
+
+	if !valid {
+		return fmt.Errorf("item cannot go from %s to %s", i.Status, to)
+	}
+	i.Status = to
+	return nil
+}
+
+// Job is the persisted form of a QueueItem, enough to rebuild its state after a restart
+type Job struct {
+	ID         string           `json:"id"`
+	Network    string           `json:"network"`
+	Channel    string           `json:"channel"`
+	Nick       string           `json:"nick"`
+	Ident      string           `json:"ident"`
+	Host       string           `json:"host"`
+	Action     string           `json:"action"`
+	Message    string           `json:"message"`
+	Arguments  []state.Argument `json:"arguments"`
+	Model      string           `json:"model"`
+	Backend    meta.Backend     `json:"backend"`
+	Attempts   int              `json:"attempts"`
+	Retries    int              `json:"retries"`
+	FailedOn   []meta.Backend   `json:"failedOn,omitempty"`
+	EnqueuedAt time.Time        `json:"enqueuedAt"`
 }
 
 // UserAccess interface for queue items
 type UserAccess interface {
 	GetAccessLevel() int
-	CanUse4090() bool
+	HasAccessLevel(level int) bool
 	CanSkipQueue() bool
 }
+
+// BackendStatus is the state of a single backend queue
+type BackendStatus struct {
+	Name       string          `json:"name"`
+	Length     int             `json:"length"`
+	Processing bool            `json:"processing"`
+	Suspect    bool            `json:"suspect"`
+	Loaded     string          `json:"loaded"`   // model family thought to be in VRAM
+	Offline    bool            `json:"offline"`  // the last probe of the backend failed
+	External   int             `json:"external"` // prompts ComfyUI has from elsewhere
+	VramFree   int64           `json:"vramFree"` // bytes, as last probed
+	VramTotal  int64           `json:"vramTotal"`
+	Current    string          `json:"current"`
+	Running    []RunningStatus `json:"running"`
+	Items      []string        `json:"items"`
+	Jobs       []ItemRecord    `json:"jobs"` // running items first, then waiting items in the order they will run
+}
+
+// ItemRecord describes a running or waiting item
+type ItemRecord struct {
+	ID         string       `json:"id"`
+	Action     string       `json:"action"`
+	Nick       string       `json:"nick"`
+	Network    string       `json:"network"`
+	Backend    meta.Backend `json:"backend"`
+	Status     string       `json:"status"`
+	Position   int          `json:"position"` // 1 is next in line, 0 while running
+	EnqueuedAt time.Time    `json:"enqueuedAt"`
+	Preview    string       `json:"preview"`
+	Progress   float64      `json:"progress"` // while running, see QueueItem.Progress
+	Node       string       `json:"node"`
+}
+
+// RunningStatus is an item being processed and how long it should still take
+type RunningStatus struct {
+	Action    string        `json:"action"`
+	Remaining time.Duration `json:"remaining"`
+	Progress  float64       `json:"progress"`
+	Node      string        `json:"node"`
+}
+
+type QueueStatus struct {
+	Backends []BackendStatus `json:"backends"`
+}
@@ -0,0 +1,188 @@
+package queue
+
+import (
+	"aibird/image/comfyui"
+	"aibird/logger"
+	"sync"
+	"time"
+)
+
+// VRAM policies, set per backend with vramPolicy in [[comfyui.ports]]
+const (
+	VramAlwaysFree   = "always-free"    // unload the models after every job
+	VramFreeOnSwitch = "free-on-switch" // unload them only for a job of another model family
+	VramIdleTimeout  = "idle-timeout"   // unload them once the backend has been idle for a while
+)
+
+// DefaultIdleTimeout is how long an idle-timeout backend keeps its models when idleTimeout isn't set
+const DefaultIdleTimeout = 5 * time.Minute
+
+// vram is what a backend is thought to have loaded
+type vram struct {
+	mutex  sync.Mutex
+	loaded string      // model family of the last job, empty once freed
+	mixed  bool        // jobs ran side by side since the last free, so what is loaded isn't known
+	idle   *time.Timer // frees the backend once it has been idle for its idle timeout
+}
+
+// stageFamilies returns the model families a workflow loads in turn, one for a workflow and those of
+// its stages for a pipeline, nil for commands that aren't workflows
+func stageFamilies(model string) []string {
+	workflow, ok := comfyui.Workflows.Get(model)
+	if !ok {
+		return nil
+	}
+	var families []string
+	if workflow.Meta != nil {
+		for _, stage := range workflow.Meta.Pipeline {
+			if stageWorkflow, ok := comfyui.Workflows.Get(stage.Workflow); ok {
+				families = append(families, stageWorkflow.ModelFamily())
+			}
+		}
+	}
+	if len(families) == 0 {
+		return []string{workflow.ModelFamily()}
+	}
+	return families
+}
+
+// modelFamily returns the model family a workflow loads first, empty for commands that aren't
+// workflows and leave the backend's VRAM alone
+func modelFamily(model string) string {
+	families := stageFamilies(model)
+	if len(families) == 0 {
+		return ""
+	}
+	return families[0]
+}
+
+// lastFamily returns the model family a job leaves loaded, a pipeline's last stage's
+func lastFamily(item QueueItem) string {
+	families := stageFamilies(item.Model)
+	if len(families) == 0 {
+		return item.Family
+	}
+	return families[len(families)-1]
+}
+
+// vramPolicy returns the backend's VRAM policy, always-free unless it is set
+func (b *Backend) vramPolicy() string {
+	if b.Config.VramPolicy == "" {
+		return VramAlwaysFree
+	}
+	return b.Config.VramPolicy
+}
+
+// idleTimeout is how long the backend keeps its models with nothing to do, 0 for as long as it likes
+func (b *Backend) idleTimeout() time.Duration {
+	if b.Config.IdleTimeout > 0 {
+		return time.Duration(b.Config.IdleTimeout) * time.Second
+	}
+	if b.vramPolicy() == VramIdleTimeout {
+		return DefaultIdleTimeout
+	}
+	return 0
+}
+
+// beforeJob makes room for a job of another model family than the one loaded, under free-on-switch
+// when the queue couldn't see it coming. Nothing is freed while other jobs run on the backend, which
+// leaves what is loaded unknown until it is next freed.
+func (s *Scheduler) beforeJob(b *Backend, item QueueItem) {
+	if item.Family == "" || s.FreeVram == nil {
+		return
+	}
+
+	b.vram.mutex.Lock()
+	defer b.vram.mutex.Unlock()
+
+	if b.vram.idle != nil {
+		b.vram.idle.Stop()
+		b.vram.idle = nil
+	}
+	if b.Queue.Running() > 1 {
+		b.vram.mixed = true
+		return
+	}
+	if b.vramPolicy() == VramFreeOnSwitch && (b.vram.mixed || b.vram.loaded != "" && b.vram.loaded != item.Family) {
+		from := b.vram.loaded
+		if b.vram.mixed {
+			from = "jobs run side by side"
+		}
+		s.freeVram(b, "switching from "+from+" to "+item.Family)
+	}
+	b.vram.loaded = item.Family
+}
+
+// afterJob applies the backend's VRAM policy once a job has finished and no other is running on it.
+// free-on-switch peeks at the job the queue runs next and frees only if it loads another model family.
+func (s *Scheduler) afterJob(b *Backend, item QueueItem) {
+	if s.FreeVram == nil {
+		return
+	}
+
+	b.vram.mutex.Lock()
+	defer b.vram.mutex.Unlock()
+
+	// The jobs still running may be using the models, the last of them to finish applies the policy
+	if b.Queue.Running() > 0 {
+		return
+	}
+	if item.Family != "" && !b.vram.mixed {
+		b.vram.loaded = lastFamily(item)
+	}
+	if b.vram.loaded == "" && !b.vram.mixed {
+		return
+	}
+
+	switch b.vramPolicy() {
+	case VramFreeOnSwitch:
+		if next := b.Queue.Peek(); next != nil && next.Family != "" && (b.vram.mixed || next.Family != b.vram.loaded) {
+			s.freeVram(b, "next job is "+next.Family)
+			return
+		}
+	case VramIdleTimeout:
+	default:
+		s.freeVram(b, "job finished")
+		return
+	}
+
+	if timeout := b.idleTimeout(); timeout > 0 {
+		if b.vram.idle != nil {
+			b.vram.idle.Stop()
+		}
+		b.vram.idle = time.AfterFunc(timeout, func() { s.freeIdle(b) })
+	}
+}
+
+// freeIdle frees the backend when its idle timeout runs out, unless a job has started since
+func (s *Scheduler) freeIdle(b *Backend) {
+	b.vram.mutex.Lock()
+	defer b.vram.mutex.Unlock()
+
+	if b.vram.loaded == "" && !b.vram.mixed || b.load() > 0 {
+		return
+	}
+	b.vram.idle = nil
+	s.freeVram(b, "idle")
+}
+
+// freeVram frees the backend's VRAM, vram.mutex must be held
+func (s *Scheduler) freeVram(b *Backend, reason string) {
+	logger.Debug("Freeing VRAM", "backend", b.Name(), "policy", b.vramPolicy(), "reason", reason)
+	if err := s.FreeVram(b.Name()); err != nil {
+		logger.Error("Error freeing VRAM", "backend", b.Name(), "error", err)
+		return
+	}
+	b.vram.loaded, b.vram.mixed = "", false
+}
+
+// LoadedFamily returns the model family the backend is thought to have in VRAM, empty if none or if
+// it isn't known
+func (b *Backend) LoadedFamily() string {
+	b.vram.mutex.Lock()
+	defer b.vram.mutex.Unlock()
+	if b.vram.mixed {
+		return ""
+	}
+	return b.vram.loaded
+}
@@ -28,7 +28,12 @@ type (
 		StatusUrl          string    `toml:"statusUrl" validate:"omitempty,url"`
 		StatusApiKey       string    `toml:"statusApiKey"`
 		Proxy              Proxy     `toml:"proxy"`
+		FetchViaProxy      bool      `toml:"fetchViaProxy"` // Download the URLs users give through the proxy
 		KickRetryDelay     int       `toml:"kickRetryDelay" validate:"gte=0"`
+		MaxQueuedPerUser   int       `toml:"maxQueuedPerUser" validate:"gte=0"`                // 0 means no limit
+		MetricsListen      string    `toml:"metricsListen" validate:"omitempty,hostname_port"` // Address to serve /metrics on, empty turns it off
+		ProgressMilestones []int     `toml:"progressMilestones" validate:"dive,gt=0,lt=100"`   // Percentages of a node to send progress notices at
+		ProgressInterval   int       `toml:"progressInterval" validate:"gte=0"`                // Seconds between progress notices, 0 only sends milestones
 	}
 
 	Support struct {
@@ -61,17 +66,36 @@ type (
 	}
 
 	ComfyUiConfig struct {
-		Url            string        `toml:"url" validate:"required"`
-		Ports          []ComfyUiPort `toml:"ports" validate:"required,min=1,dive"`
-		BadWords       []string      `toml:"badWords"`
-		BadWordsPrompt string        `toml:"badWordsPrompt"`
-		MaxQueueSize   int           `toml:"maxQueueSize" validate:"gte=0"`
-		RewritePrompts bool          `toml:"rewritePrompts"`
+		Url              string        `toml:"url" validate:"required"`
+		Ports            []ComfyUiPort `toml:"ports" validate:"required,min=1,dive"`
+		BadWords         []string      `toml:"badWords"` // Replace the whole prompt with badWordsPrompt, checked before any filter rule
+		BadWordsPrompt   string        `toml:"badWordsPrompt"`
+		FilterDir        string        `toml:"filterDir"`    // Directory of prompt filter policies, empty is filters
+		FilterPolicy     string        `toml:"filterPolicy"` // Policy for networks, channels and workflows that don't name one, empty is default
+		WildcardDir      string        `toml:"wildcardDir"`  // Directory of __name__ wildcard files, empty is wildcards
+		MaxQueueSize     int           `toml:"maxQueueSize" validate:"gte=0"`
+		JobRetries       int           `toml:"jobRetries" validate:"gte=0"`                                               // Restarts a job may be interrupted by before it is dropped
+		FailoverRetries  int           `toml:"failoverRetries" validate:"gte=0"`                                          // Times a job is retried after its backend failed, 0 turns failover off
+		SchedulingPolicy string        `toml:"schedulingPolicy" validate:"omitempty,oneof=round-robin weighted priority"` // Empty is round-robin
+		Timeout          int           `toml:"timeout" validate:"gte=0"`                                                  // Seconds a generation may go without progress, 0 is five minutes
+		CacheExpiryHours int           `toml:"cacheExpiryHours" validate:"gte=0"`                                         // Hours the result cache answers identical requests, at most birdhole.expiry, 0 turns it off
+		RewritePrompts   bool          `toml:"rewritePrompts"`
 	}
 
+	// ComfyUiPort describes one ComfyUI backend. Each entry gets its own queue.
 	ComfyUiPort struct {
-		Name string `toml:"name" validate:"required"`
-		Port int    `toml:"port" validate:"required"`
+		Name         string `toml:"name" validate:"required"`
+		Port         int    `toml:"port" validate:"required"`
+		Url          string `toml:"url"`                          // Overrides comfyui.url for remote backends
+		Vram         int    `toml:"vram" validate:"gte=0"`        // VRAM class in GB, larger cards are preferred
+		BigModel     bool   `toml:"bigModel"`                     // Can run workflows marked bigModel
+		AccessLevel  int    `toml:"accessLevel" validate:"gte=0"` // Minimum user access level, admins and owners always pass
+		Container    string `toml:"container"`                    // Docker container name reported by the status service
+		YieldToSteam bool   `toml:"yieldToSteam"`                 // Unavailable while Steam is running on the rig
+		Concurrency  int    `toml:"concurrency" validate:"gte=0"` // Jobs run at the same time, 0 means 1
+		// When models are unloaded: always-free (the default), free-on-switch or idle-timeout
+		VramPolicy  string `toml:"vramPolicy" validate:"omitempty,oneof=always-free free-on-switch idle-timeout"`
+		IdleTimeout int    `toml:"idleTimeout" validate:"gte=0"` // Seconds an idle backend keeps its models under idle-timeout, and free-on-switch when set
 	}
 
 	BirdholeConfig struct {
@@ -80,7 +104,7 @@ type (
 		EndPoint    string `toml:"endPoint" validate:"required"`
 		Key         string `toml:"key" validate:"required"`
 		UrlLen      int    `toml:"urlLen"`
-		Expiry      int    `toml:"expiry"`
+		Expiry      int    `toml:"expiry"` // Hours an upload is kept, 0 for as long as birdhole likes
 		Description string `toml:"description"`
 	}
 )
@@ -1,13 +1,47 @@
 package meta
 
-type AibirdMeta struct {
-	AccessLevel int
-	BigModel    bool
+import "context"
+
+// Backend is the name of a ComfyUI instance as configured in [[comfyui.ports]].
+// An empty Backend means the first configured port.
+type Backend string
+
+// ProgressFunc receives sampling progress of a running generation, value steps out of max on the
+// node with the given title
+type ProgressFunc func(node string, value, max int)
+
+type progressKey struct{}
+
+// WithProgress returns a context that reports generation progress to fn, as well as to any
+// function set on ctx before it
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	if parent, ok := ctx.Value(progressKey{}).(ProgressFunc); ok && parent != nil {
+		child := fn
+		fn = func(node string, value, max int) {
+			parent(node, value, max)
+			child(node, value, max)
+		}
+	}
+	return context.WithValue(ctx, progressKey{}, fn)
 }
 
-type GPUType string
+// ReportProgress passes progress to the functions set with WithProgress, if any
+func ReportProgress(ctx context.Context, node string, value, max int) {
+	if fn, ok := ctx.Value(progressKey{}).(ProgressFunc); ok && fn != nil {
+		fn(node, value, max)
+	}
+}
 
-const (
-	GPU4090 GPUType = "4090"
-	GPU2070 GPUType = "2070"
-)
+type retryKey struct{}
+
+// WithRetry returns a context telling a job the queue retries it on another backend if its backend
+// fails, and tells the user about the failure itself once there is no retry left
+func WithRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryKey{}, true)
+}
+
+// WillRetry reports whether the queue retries the job should its backend fail
+func WillRetry(ctx context.Context) bool {
+	retry, _ := ctx.Value(retryKey{}).(bool)
+	return retry
+}
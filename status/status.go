@@ -2,13 +2,12 @@ package status
 
 import (
 	"aibird/settings"
-	"aibird/shared/meta"
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -24,11 +23,8 @@ type GPUInfo struct {
 	UtilizationGPU string `json:"utilization_gpu"`
 }
 
-type DockerStatus struct {
-	Ollama      bool `json:"ollama"`
-	ComfyUI     bool `json:"comfyui"`
-	ComfyUI2070 bool `json:"comfyui_2070"`
-}
+// DockerStatus maps the container names reported by birdcheck to whether they are running
+type DockerStatus map[string]bool
 
 type StatusResponse struct {
 	IsRunning    bool         `json:"steam_running"`
@@ -205,39 +201,26 @@ func (c *Client) GetGPUInfo() ([]GPUInfo, error) {
 }
 
 // GetDockerStatus returns just the Docker container status
-func (c *Client) GetDockerStatus() (*DockerStatus, error) {
+func (c *Client) GetDockerStatus() (DockerStatus, error) {
 	status, err := c.GetStatus()
 	if err != nil {
 		return nil, err
 	}
-	return &status.DockerStatus, nil
-}
-
-// IsOllamaRunning returns true if the Ollama container is running
-func (c *Client) IsOllamaRunning() (bool, error) {
-	status, err := c.GetStatus()
-	if err != nil {
-		return false, err
-	}
-	return status.DockerStatus.Ollama, nil
+	return status.DockerStatus, nil
 }
 
-// IsComfyUIRunning returns true if the ComfyUI container is running
-func (c *Client) IsComfyUIRunning() (bool, error) {
+// IsContainerRunning returns true if the named Docker container is running
+func (c *Client) IsContainerRunning(name string) (bool, error) {
 	status, err := c.GetStatus()
 	if err != nil {
 		return false, err
 	}
-	return status.DockerStatus.ComfyUI, nil
+	return status.DockerStatus[name], nil
 }
 
-// IsComfyUI2070Running returns true if the ComfyUI-2070 container is running
-func (c *Client) IsComfyUI2070Running() (bool, error) {
-	status, err := c.GetStatus()
-	if err != nil {
-		return false, err
-	}
-	return status.DockerStatus.ComfyUI2070, nil
+// IsOllamaRunning returns true if the Ollama container is running
+func (c *Client) IsOllamaRunning() (bool, error) {
+	return c.IsContainerRunning("ollama")
 }
 
 // formatGPUInfo formats a single GPU's information
@@ -260,14 +243,27 @@ func formatDockerStatus(docker DockerStatus) string {
 		return fmt.Sprintf("⚫ %s", name)
 	}
 
-	statuses := []string{
-		format("Ollama", docker.Ollama),
-		format("ComfyUI", docker.ComfyUI),
-		format("ComfyUI-2070", docker.ComfyUI2070),
+	names := make([]string, 0, len(docker))
+	for name := range docker {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	statuses := make([]string, 0, len(names))
+	for _, name := range names {
+		statuses = append(statuses, format(containerDisplayName(name), docker[name]))
 	}
 	return strings.Join(statuses, " | ")
 }
 
+// containerDisplayName turns a container name like comfyui_2070 into ComfyUI-2070
+func containerDisplayName(name string) string {
+	display := strings.ReplaceAll(name, "_", "-")
+	display = strings.Replace(display, "comfyui", "ComfyUI", 1)
+	display = strings.Replace(display, "ollama", "Ollama", 1)
+	return display
+}
+
 // GetFormattedStatus returns a formatted string suitable for IRC with newline separation
 func (c *Client) GetFormattedStatus() (string, error) {
 	status, err := c.GetStatus()
@@ -301,45 +297,3 @@ func (c *Client) GetFormattedStatus() (string, error) {
 
 	return strings.Join(lines, "\n"), nil
 }
-
-// UserAccess defines the necessary methods for a user object to perform access checks.
-type UserAccess interface {
-	GetAccessLevel() int
-	CanUse4090() bool
-}
-
-// CheckModelExecution performs various checks to see if a model can be executed.
-// It returns a boolean indicating if the high-performance port should be used, and an error if execution is not permitted.
-func (c *Client) CheckModelExecution(model string, meta *meta.AibirdMeta, user UserAccess, userNickName string) (bool, error) {
-	status, err := c.GetStatus()
-	if err != nil {
-		return false, errors.New("AI rig is offline!!! Sorry pal")
-	}
-
-	isSteamRunning := status.IsRunning
-	comfyUi4090Running := status.DockerStatus.ComfyUI
-	comfyUi2070Running := status.DockerStatus.ComfyUI2070
-
-	if !comfyUi2070Running && !comfyUi4090Running {
-		return false, errors.New("AI rig seems online but the comfyui generation is not running!!! Sorry pal")
-	}
-
-	// Access level check
-	if user.GetAccessLevel() < meta.AccessLevel {
-		return false, fmt.Errorf("⛔️ Sorry, you need access level %d to use this command. Check !support for more info", meta.AccessLevel)
-	}
-
-	// Big model check
-	if meta.BigModel && (isSteamRunning || !comfyUi4090Running) {
-		return false, errors.New("no GPU for these big models, sorry pal, have to wait for jewbird to stop gayming")
-	}
-
-	use4090Port := false
-	if !isSteamRunning && comfyUi4090Running {
-		if user.CanUse4090() || meta.BigModel {
-			use4090Port = true
-		}
-	}
-
-	return use4090Port, nil
-}
@@ -2,11 +2,13 @@ package gemini
 
 import (
 	"aibird/irc/state"
+	"aibird/metrics"
 	"aibird/settings"
 	"aibird/text"
 	"context"
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/google/generative-ai-go/genai"
 	"google.golang.org/api/option"
@@ -82,7 +84,9 @@ func Request(irc state.State) (string, error) {
 	// Append the new user message to our cache first
 	text.AppendChatCache(irc.UserAiChatCacheKey(), "user", message, irc.Config.AiBird.AiChatContextLimit)
 
+	start := time.Now()
 	resp, err := chat.SendMessage(ctx, genai.Text(message))
+	metrics.ObserveTextRequest("gemini", start, err)
 	if err != nil {
 		// If something fails, remove the user message we just added
 		text.TruncateLastMessage(irc.UserAiChatCacheKey())
@@ -109,7 +113,9 @@ func SingleRequest(prompt string, config settings.GeminiConfig) (string, error)
 	defer client.Close()
 
 	model := client.GenerativeModel("gemini-2.5-flash-lite-preview-06-17")
+	start := time.Now()
 	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+	metrics.ObserveTextRequest("gemini", start, err)
 	if err != nil {
 		return "", err
 	}
@@ -136,7 +142,9 @@ func GenerateLyrics(message string, config settings.GeminiConfig) (string, error
 		},
 	}
 	userPrompt := "Generate lyrics for a song about: " + message
+	start := time.Now()
 	resp, err := model.GenerateContent(ctx, genai.Text(userPrompt))
+	metrics.ObserveTextRequest("gemini", start, err)
 	if err != nil {
 		return "", err
 	}
@@ -5,10 +5,12 @@ import (
 	"aibird/helpers"
 	"aibird/http/request"
 	"aibird/irc/state"
+	"aibird/metrics"
 	"aibird/settings"
 	"aibird/text"
 	"errors"
 	"strings"
+	"time"
 )
 
 func ChatRequest(irc state.State) (string, error) {
@@ -78,7 +80,9 @@ func ChatRequest(irc state.State) (string, error) {
 	}
 
 	var response OllamaResponse
+	start := time.Now()
 	err := ollamaRequest.Call(&response)
+	metrics.ObserveTextRequest("ollama", start, err)
 
 	if err != nil {
 		return "", err
@@ -159,7 +163,9 @@ func SingleRequest(message string, system string, config settings.OllamaConfig)
 	}
 
 	var response OllamaResponse
+	start := time.Now()
 	err := ollamaRequest.Call(&response)
+	metrics.ObserveTextRequest("ollama", start, err)
 
 	if err != nil {
 		return "", err
@@ -7,10 +7,12 @@ import (
 	"aibird/http/request"
 	"aibird/irc/state"
 	"aibird/logger"
+	"aibird/metrics"
 	"aibird/settings"
 	"aibird/text"
 	"fmt"
 	"strings"
+	"time"
 )
 
 // OpenRouterRequest coordinates the entire process of handling an OpenRouter request.
@@ -30,7 +32,10 @@ func OpenRouterRequest(irc state.State) (string, error) {
 	// 4. Build and execute the HTTP request
 	httpRequest := buildHttpRequest(irc.Config.OpenRouter, requestBody)
 	var response OpenRouterResponse
-	if err := httpRequest.Call(&response); err != nil {
+	start := time.Now()
+	err := httpRequest.Call(&response)
+	metrics.ObserveTextRequest("openrouter", start, err)
+	if err != nil {
 		return "", err
 	}
 
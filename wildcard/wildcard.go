@@ -0,0 +1,229 @@
+// Package wildcard expands dynamic prompt syntax: {a|b|c} picks one of the options, {2::a|b} weighs
+// them, and __name__ draws a line of <dir>/name.txt, all at random.
+package wildcard
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultDir is where wildcard files are kept, relative to the working directory
+const DefaultDir = "wildcards"
+
+// maxDepth is how deep options and wildcard lines may nest, a wildcard naming itself stops here
+const maxDepth = 20
+
+// maxPicks is how many options and lines one prompt may draw, so wildcards that name each other
+// several times a line can't grow a prompt without end
+const maxPicks = 500
+
+var (
+	ErrNoWildcard = errors.New("there is no wildcard")
+	ErrEmpty      = errors.New("the wildcard has no lines")
+	ErrTooDeep    = errors.New("the prompt nests options or wildcards too deep")
+	ErrWeights    = errors.New("every option has a weight of 0")
+)
+
+// names are the wildcard names __name__ may hold, subdirectories included but never a way out of dir
+var names = regexp.MustCompile(`^[A-Za-z0-9_-]+(/[A-Za-z0-9_-]+)*$`)
+
+// expander expands one prompt, counting what it has drawn
+type expander struct {
+	dir   string
+	picks int
+}
+
+// Expand replaces every {a|b} in the prompt with one of its options and every __name__ with a line
+// of <dir>/name.txt, then does the same to what they were replaced with. A brace without its pair,
+// __ that doesn't make a name and a __name__ with no file, like __init__, are left as written.
+func Expand(dir, prompt string) (string, error) {
+	e := &expander{dir: dir}
+	return e.expand(prompt, 0)
+}
+
+// HasSyntax reports whether the prompt has anything Expand would replace
+func HasSyntax(prompt string) bool {
+	return strings.Contains(prompt, "{") || strings.Contains(prompt, "__")
+}
+
+func (e *expander) expand(text string, depth int) (string, error) {
+	if depth > maxDepth {
+		return "", ErrTooDeep
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		switch {
+		case text[i] == '{':
+			end := closing(text, i)
+			if end < 0 {
+				b.WriteByte(text[i])
+				i++
+				continue
+			}
+			option, err := e.pick(options(text[i+1 : end]))
+			if err != nil {
+				return "", err
+			}
+			expanded, err := e.expand(option, depth+1)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(expanded)
+			i = end + 1
+		case strings.HasPrefix(text[i:], "__"):
+			end := strings.Index(text[i+2:], "__")
+			if end < 0 || !names.MatchString(text[i+2:i+2+end]) {
+				b.WriteString("__")
+				i += 2
+				continue
+			}
+			line, err := e.draw(text[i+2 : i+2+end])
+			if errors.Is(err, ErrNoWildcard) {
+				b.WriteString(text[i : i+4+end])
+				i += end + 4
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			expanded, err := e.expand(line, depth+1)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(expanded)
+			i += end + 4
+		default:
+			b.WriteByte(text[i])
+			i++
+		}
+	}
+	return b.String(), nil
+}
+
+// closing returns the index of the brace that closes the one at open, or -1 if there is none
+func closing(text string, open int) int {
+	depth := 0
+	for i := open; i < len(text); i++ {
+		switch text[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// options splits the inside of braces at the | that aren't inside nested braces
+func options(text string) []string {
+	var split []string
+	depth, start := 0, 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '|':
+			if depth == 0 {
+				split = append(split, text[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(split, text[start:])
+}
+
+// pick draws one of the options, each weighed by a weight:: in front of it or 1
+func (e *expander) pick(options []string) (string, error) {
+	if e.picks++; e.picks > maxPicks {
+		return "", ErrTooDeep
+	}
+
+	texts := make([]string, len(options))
+	weights := make([]float64, len(options))
+	total := 0.0
+	for i, option := range options {
+		texts[i], weights[i] = option, 1
+		if before, after, ok := strings.Cut(option, "::"); ok {
+			if weight, err := strconv.ParseFloat(strings.TrimSpace(before), 64); err == nil && weight >= 0 {
+				texts[i], weights[i] = after, weight
+			}
+		}
+		total += weights[i]
+	}
+	if total == 0 {
+		return "", ErrWeights
+	}
+
+	n := rand.Float64() * total
+	for i, weight := range weights {
+		if n < weight {
+			return texts[i], nil
+		}
+		n -= weight
+	}
+	// Rounding can leave n just short of the last weight
+	for i := len(options) - 1; ; i-- {
+		if weights[i] > 0 {
+			return texts[i], nil
+		}
+	}
+}
+
+// draw returns a random line of the wildcard's file, leaving out blank lines and # comments
+func (e *expander) draw(name string) (string, error) {
+	if e.picks++; e.picks > maxPicks {
+		return "", ErrTooDeep
+	}
+
+	lines, err := readLines(e.dir, name)
+	if err != nil {
+		return "", err
+	}
+	return lines[rand.IntN(len(lines))], nil
+}
+
+// readLines returns the lines of a wildcard a draw picks from, read from its file each time so
+// edits are picked up straight away
+func readLines(dir, name string) ([]string, error) {
+	if !names.MatchString(name) {
+		return nil, fmt.Errorf("%w named %s", ErrNoWildcard, name)
+	}
+	file, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w named __%s__", ErrNoWildcard, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read wildcard %s: %w", name, err)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%w: __%s__", ErrEmpty, name)
+	}
+	return lines, nil
+}
@@ -0,0 +1,167 @@
+package wildcard
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// runs is how often a random expansion is repeated to see what it can come out as
+const runs = 200
+
+// wildcards writes wildcard files into a new directory
+func wildcards(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name)+".txt")
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// outcomes expands a prompt many times and returns each result it came out as
+func outcomes(t *testing.T, dir, prompt string) map[string]bool {
+	t.Helper()
+	seen := map[string]bool{}
+	for range runs {
+		expanded, err := Expand(dir, prompt)
+		if err != nil {
+			t.Fatalf("Expand(%q) failed: %v", prompt, err)
+		}
+		seen[expanded] = true
+	}
+	return seen
+}
+
+func TestExpand(t *testing.T) {
+	dir := wildcards(t, map[string]string{
+		"colour":        "# colours\nred\n\n  blue  \n",
+		"animals/birds": "a {tiny|huge} __colour__ bird",
+	})
+	tests := []struct {
+		prompt string
+		want   []string
+	}{
+		{"a plain prompt", []string{"a plain prompt"}},
+		{"a {cat|dog}", []string{"a cat", "a dog"}},
+		{"a {{tabby|black} cat|dog}", []string{"a tabby cat", "a black cat", "a dog"}},
+		{"{a|}b", []string{"ab", "b"}},
+		{"__colour__", []string{"red", "blue"}},
+		{"__animals/birds__", []string{"a tiny red bird", "a tiny blue bird", "a huge red bird", "a huge blue bird"}},
+		{"an {unclosed brace and a __half", []string{"an {unclosed brace and a __half"}},
+		{"__init__ and __main__", []string{"__init__ and __main__"}},
+		{"a __missing__ __colour__", []string{"a __missing__ red", "a __missing__ blue"}},
+		{"__../colour__ and __a b__", []string{"__../colour__ and __a b__"}},
+	}
+	for _, tt := range tests {
+		want := map[string]bool{}
+		for _, w := range tt.want {
+			want[w] = true
+		}
+		if got := outcomes(t, dir, tt.prompt); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expand(%q) came out as %v, want %v", tt.prompt, got, want)
+		}
+	}
+}
+
+func TestWeights(t *testing.T) {
+	tests := []struct {
+		prompt string
+		want   []string
+	}{
+		{"{0::cat|1::dog}", []string{"dog"}},
+		{"{cat|0::dog}", []string{"cat"}},
+		{"{ 2.5 :: cat|0::dog}", []string{" cat"}},
+		{"{-1::cat|0::dog}", []string{"-1::cat"}},
+		{"{x::cat|0::dog}", []string{"x::cat"}},
+		{"{0::{a|b}|1::{c|0::d}}", []string{"c"}},
+	}
+	for _, tt := range tests {
+		want := map[string]bool{}
+		for _, w := range tt.want {
+			want[w] = true
+		}
+		if got := outcomes(t, t.TempDir(), tt.prompt); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expand(%q) came out as %v, want %v", tt.prompt, got, want)
+		}
+	}
+
+	if _, err := Expand(t.TempDir(), "{0::cat|0.0::dog}"); !errors.Is(err, ErrWeights) {
+		t.Errorf("expected options that all weigh 0 to fail, got %v", err)
+	}
+}
+
+func TestPickLeavesOptions(t *testing.T) {
+	given := []string{"0::cat", "1::dog"}
+	e := &expander{}
+	if option, err := e.pick(given); err != nil || option != "dog" {
+		t.Errorf("expected dog, got %q, %v", option, err)
+	}
+	if !reflect.DeepEqual(given, []string{"0::cat", "1::dog"}) {
+		t.Errorf("pick changed the options it was given to %v", given)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	dir := wildcards(t, map[string]string{
+		"loop":  "a __loop__",
+		"twice": "__twice__ and __twice__",
+		"empty": "# nothing yet\n\n",
+	})
+	tests := []struct {
+		prompt string
+		err    error
+	}{
+		{"__loop__", ErrTooDeep},
+		{"__twice__", ErrTooDeep},
+		{strings.Repeat("{", maxDepth+2) + "deep" + strings.Repeat("}", maxDepth+2), ErrTooDeep},
+		{strings.Repeat("{a|b}", maxPicks+1), ErrTooDeep},
+		{"__empty__", ErrEmpty},
+	}
+	for _, tt := range tests {
+		if _, err := Expand(dir, tt.prompt); !errors.Is(err, tt.err) {
+			t.Errorf("Expand(%.40q) = %v, want %v", tt.prompt, err, tt.err)
+		}
+	}
+
+	if _, err := Expand(dir, strings.Repeat("{a|b}", maxPicks)); err != nil {
+		t.Errorf("expected %d options to be drawn, got %v", maxPicks, err)
+	}
+	if _, err := Expand(dir, strings.Repeat("{", maxDepth)+"deep"+strings.Repeat("}", maxDepth)); err != nil {
+		t.Errorf("expected options nested %d deep to expand, got %v", maxDepth, err)
+	}
+}
+
+func TestNames(t *testing.T) {
+	for _, name := range []string{"colour", "animals/birds", "a-b_c/d1"} {
+		if !names.MatchString(name) {
+			t.Errorf("expected %q to be a wildcard name", name)
+		}
+	}
+	for _, name := range []string{"../colour", "animals/../colour", "/etc/passwd", "animals/", "a.b", "a b", ""} {
+		if names.MatchString(name) {
+			t.Errorf("expected %q not to be a wildcard name", name)
+		}
+	}
+
+	// A file beside the wildcard directory can't be reached from inside it
+	parent := t.TempDir()
+	os.WriteFile(filepath.Join(parent, "secret.txt"), []byte("hunter2"), 0o644)
+	dir := filepath.Join(parent, "wildcards")
+	os.Mkdir(dir, 0o755)
+	if _, err := readLines(dir, "../secret"); !errors.Is(err, ErrNoWildcard) {
+		t.Errorf("expected ../secret to be refused, got %v", err)
+	}
+	if got, err := Expand(dir, "__../secret__"); err != nil || got != "__../secret__" {
+		t.Errorf("expected __../secret__ to be left as written, got %q, %v", got, err)
+	}
+}